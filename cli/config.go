@@ -2,6 +2,7 @@ package cli
 
 import (
 	"fmt"
+	"path/filepath"
 
 	"github.com/mcuadros/ofelia/core"
 	"github.com/mcuadros/ofelia/middlewares"
@@ -30,6 +31,8 @@ type Config struct {
 	ServiceJobs map[string]*RunServiceConfig `gcfg:"job-service-run" mapstructure:"job-service-run,squash"`
 	LocalJobs   map[string]*LocalJobConfig   `gcfg:"job-local" mapstructure:"job-local,squash"`
 
+	Webhooks map[string]*middlewares.WebhookSection `gcfg:"webhook" mapstructure:"webhook,squash"`
+
 	sh              *core.Scheduler
 	dockerHandler   *DockerHandler
 	logger          core.Logger
@@ -43,6 +46,7 @@ func NewConfig(logger core.Logger) *Config {
 	c.RunJobs = make(map[string]*RunJobConfig)
 	c.ServiceJobs = make(map[string]*RunServiceConfig)
 	c.LocalJobs = make(map[string]*LocalJobConfig)
+	c.Webhooks = make(map[string]*middlewares.WebhookSection)
 	c.logger = logger
 	defaults.SetDefaults(c)
 	return c
@@ -51,6 +55,7 @@ func NewConfig(logger core.Logger) *Config {
 // BuildFromFile builds a scheduler using the config from a file
 func BuildFromFile(filename string, logger core.Logger) (*Config, error) {
 	c := NewConfig(logger)
+	c.Global.WebhookFileConfig.SetConfigDir(filepath.Dir(filename))
 	err := gcfg.ReadFileInto(c, filename)
 	return c, err
 }
@@ -89,6 +94,11 @@ func (c *Config) InitializeApp() error {
 		c.buildSchedulerMiddlewares(c.sh)
 	}
 
+	// Fail fast on broken per-job webhook references before adding any job
+	if err := c.validateWebhookReferences(); err != nil {
+		return err
+	}
+
 	for name, j := range c.ExecJobs {
 		defaults.SetDefaults(j)
 		j.Client = c.dockerHandler.GetInternalDockerClient()
@@ -139,6 +149,46 @@ func (c *Config) InitializeApp() error {
 	return nil
 }
 
+// validateWebhookReferences checks the per-job webhook references of all jobs
+func (c *Config) validateWebhookReferences() error {
+	if c.webhookRegistry == nil {
+		return nil
+	}
+
+	jobs := make(map[string]*middlewares.WebhookConfig)
+	for name, j := range c.ExecJobs {
+		jobs[fmt.Sprintf("%s %q", jobExec, name)] = &j.WebhookConfig
+	}
+	for name, j := range c.RunJobs {
+		jobs[fmt.Sprintf("%s %q", jobRun, name)] = &j.WebhookConfig
+	}
+	for name, j := range c.LocalJobs {
+		jobs[fmt.Sprintf("%s %q", jobLocal, name)] = &j.WebhookConfig
+	}
+	for name, j := range c.ServiceJobs {
+		jobs[fmt.Sprintf("%s %q", jobServiceRun, name)] = &j.WebhookConfig
+	}
+
+	return middlewares.ValidateWebhookReferences(jobs, c.webhookRegistry)
+}
+
+// job returns the job of any type with the given name
+func (c *Config) job(name string) (core.Job, bool) {
+	if j, ok := c.ExecJobs[name]; ok {
+		return j, true
+	}
+	if j, ok := c.RunJobs[name]; ok {
+		return j, true
+	}
+	if j, ok := c.LocalJobs[name]; ok {
+		return j, true
+	}
+	if j, ok := c.ServiceJobs[name]; ok {
+		return j, true
+	}
+	return nil, false
+}
+
 func (c *Config) JobsCount() int {
 	return len(c.ExecJobs) + len(c.RunJobs) + len(c.LocalJobs) + len(c.ServiceJobs)
 }
@@ -148,12 +198,10 @@ func (c *Config) buildSchedulerMiddlewares(sh *core.Scheduler) {
 	sh.Use(middlewares.NewSave(&c.Global.SaveConfig))
 	sh.Use(middlewares.NewMail(&c.Global.MailConfig))
 
-	// Load webhook middlewares from config file and store registry
-	webhookMiddlewares, registry := middlewares.LoadWebhookMiddlewares(&c.Global.WebhookFileConfig, c.logger)
+	// Load webhook middlewares from config file and [webhook] sections and store registry
+	webhookMiddlewares, registry := middlewares.LoadWebhookMiddlewares(&c.Global.WebhookFileConfig, c.Webhooks, c.logger)
 	c.webhookRegistry = registry
-	for _, m := range webhookMiddlewares {
-		sh.Use(m)
-	}
+	sh.Use(middlewares.NewWebhookChain(webhookMiddlewares))
 }
 
 func (c *Config) dockerLabelsUpdate(labels map[string]map[string]string) {
@@ -47,6 +47,74 @@ func (s *SuiteConfig) TestBuildFromString(c *C) {
 	c.Assert(conf.JobsCount(), Equals, 5)
 }
 
+func (s *SuiteConfig) TestJobByName(c *C) {
+	conf, err := BuildFromString(`
+		[job-exec "foo"]
+		schedule = @every 10s
+
+		[job-local "baz"]
+		schedule = @every 10s
+  `, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	j, ok := conf.job("baz")
+	c.Assert(ok, Equals, true)
+	c.Assert(j, Equals, core.Job(conf.LocalJobs["baz"]))
+
+	_, ok = conf.job("missing")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *SuiteConfig) TestBuildWebhookSections(c *C) {
+	conf, err := BuildFromString(`
+		[webhook "ntfy"]
+		type = error
+		active = true
+		url = https://ntfy.sh/alerts
+		header = "Title: {{.JobName}} failed"
+		header = "Priority: high"
+		retry-count = 2
+
+		[job-local "foo"]
+		schedule = @every 10s
+		webhook-error-names = ntfy
+  `, &TestLogger{})
+
+	c.Assert(err, IsNil)
+	c.Assert(conf.Webhooks, HasLen, 1)
+
+	webhook := conf.Webhooks["ntfy"]
+	c.Assert(webhook.Type, Equals, "error")
+	c.Assert(webhook.Active, Equals, true)
+	c.Assert(webhook.URL, Equals, "https://ntfy.sh/alerts")
+	c.Assert(webhook.Header, DeepEquals, []string{"Title: {{.JobName}} failed", "Priority: high"})
+	c.Assert(webhook.RetryCount, Equals, 2)
+}
+
+func (s *SuiteConfig) TestValidateWebhookReferences(c *C) {
+	conf, err := BuildFromString(`
+		[webhook "errors"]
+		type = error
+		url = https://example.com/errors
+
+		[job-local "foo"]
+		schedule = @every 10s
+		webhook-info-names = errors
+
+		[job-exec "bar"]
+		schedule = @every 10s
+		webhook-error-names = errors, missing
+  `, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	_, conf.webhookRegistry = middlewares.LoadWebhookMiddlewares(&conf.Global.WebhookFileConfig, conf.Webhooks, &TestLogger{})
+
+	err = conf.validateWebhookReferences()
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, `(?s).*job job-exec "bar": webhook-error-names references unknown webhook "missing".*`)
+	c.Assert(err.Error(), Matches, `(?s).*job job-local "foo": webhook "errors" has type "error".*`)
+}
+
 func (s *SuiteConfig) TestJobDefaultsSet(c *C) {
 	j := &RunJobConfig{}
 	j.Pull = "false"
@@ -7,6 +7,7 @@ import (
 	"syscall"
 
 	"github.com/mcuadros/ofelia/core"
+	"github.com/mcuadros/ofelia/middlewares"
 )
 
 // DaemonCommand daemon process
@@ -14,7 +15,9 @@ type DaemonCommand struct {
 	ConfigFile        string   `long:"config" description:"configuration file" default:"/etc/ofelia.conf"`
 	DockerLabelConfig bool     `short:"d" long:"docker" description:"continiously poll docker labels for configurations"`
 	DockerFilters     []string `short:"f" long:"docker-filter" description:"filter to select docker containers. https://docs.docker.com/reference/cli/docker/container/ls/#filter"`
+	config            *Config
 	scheduler         *core.Scheduler
+	webhooks          *middlewares.WebhookRegistry
 	signals           chan os.Signal
 	done              chan bool
 	Logger            core.Logger
@@ -69,7 +72,9 @@ func (c *DaemonCommand) boot() (err error) {
 		return fmt.Errorf("can't start the app: %w", err)
 	}
 
+	c.config = config
 	c.scheduler = config.sh
+	c.webhooks = config.webhookRegistry
 
 	return err
 }
@@ -106,5 +111,11 @@ func (c *DaemonCommand) shutdown() error {
 	}
 
 	c.Logger.Warningf("Waiting running jobs.")
-	return c.scheduler.Stop()
+	err := c.scheduler.Stop()
+
+	// Stop webhook sends still retrying instead of sleeping through their backoff
+	if c.webhooks != nil {
+		c.webhooks.CancelSends()
+	}
+	return err
 }
@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/mcuadros/ofelia/core"
+)
+
+// RunCommand runs a single job once, right away
+type RunCommand struct {
+	ConfigFile        string   `long:"config" description:"configuration file" default:"/etc/ofelia.conf"`
+	DockerLabelConfig bool     `short:"d" long:"docker" description:"read job configurations from docker labels as well"`
+	DockerFilters     []string `short:"f" long:"docker-filter" description:"filter to select docker containers. https://docs.docker.com/reference/cli/docker/container/ls/#filter"`
+	Job               string   `long:"job" description:"name of the job to run" required:"true"`
+	Logger            core.Logger
+}
+
+// Execute runs the job with its middlewares, the execution is flagged as
+// manual, and waits for the webhooks it triggered before returning
+func (c *RunCommand) Execute(args []string) error {
+	daemon := &DaemonCommand{
+		ConfigFile:        c.ConfigFile,
+		DockerLabelConfig: c.DockerLabelConfig,
+		DockerFilters:     c.DockerFilters,
+		Logger:            c.Logger,
+	}
+	if err := daemon.boot(); err != nil {
+		return err
+	}
+
+	job, ok := daemon.config.job(c.Job)
+	if !ok {
+		return fmt.Errorf("unknown job %q", c.Job)
+	}
+
+	e := daemon.scheduler.RunJobManually(job)
+
+	if daemon.webhooks != nil {
+		daemon.webhooks.WaitSends()
+		daemon.webhooks.CancelSends()
+	}
+
+	if e.Failed {
+		return fmt.Errorf("job %q failed", c.Job)
+	}
+	return nil
+}
@@ -143,9 +143,19 @@ type Execution struct {
 	Skipped   bool
 	Error     error
 
+	// TriggeredBy tells what started the execution, TriggerSchedule or
+	// TriggerManual, empty when unknown
+	TriggeredBy string
+
 	OutputStream, ErrorStream *circbuf.Buffer `json:"-"`
 }
 
+// Origins of an execution, see Execution.TriggeredBy
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+)
+
 // NewExecution returns a new Execution, with a random ID
 func NewExecution() *Execution {
 	bufOut, _ := circbuf.NewBuffer(maxStreamSize)
@@ -61,6 +61,14 @@ func (s *Scheduler) RemoveJob(j Job) error {
 	return nil
 }
 
+// RunJobManually runs the job right away, outside of its schedule, the
+// execution is flagged as TriggerManual. It blocks until the job finishes and
+// returns its execution.
+func (s *Scheduler) RunJobManually(j Job) *Execution {
+	j.Use(s.Middlewares()...)
+	return (&jobWrapper{s, j}).run(TriggerManual)
+}
+
 func (s *Scheduler) CronJobs() []cron.Entry {
 	return s.cron.Entries()
 }
@@ -91,15 +99,21 @@ type jobWrapper struct {
 }
 
 func (w *jobWrapper) Run() {
+	w.run(TriggerSchedule)
+}
+
+func (w *jobWrapper) run(trigger string) *Execution {
 	w.s.wg.Add(1)
 	defer w.s.wg.Done()
 
 	e := NewExecution()
+	e.TriggeredBy = trigger
 	ctx := NewContext(w.s, w.j, e)
 
 	w.start(ctx)
 	err := ctx.Next()
 	w.stop(ctx, err)
+	return e
 }
 
 func (w *jobWrapper) start(ctx *Context) {
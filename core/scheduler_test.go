@@ -40,6 +40,31 @@ func (s *SuiteScheduler) TestStartStop(c *C) {
 	c.Assert(sc.IsRunning(), Equals, false)
 }
 
+// triggerJob records the origin of its last execution
+type triggerJob struct {
+	BareJob
+	triggeredBy string
+}
+
+func (j *triggerJob) Run(ctx *Context) error {
+	j.triggeredBy = ctx.Execution.TriggeredBy
+	return nil
+}
+
+func (s *SuiteScheduler) TestTriggeredBy(c *C) {
+	job := &triggerJob{}
+	job.Schedule = "@hourly"
+
+	sc := NewScheduler(&TestLogger{})
+	(&jobWrapper{sc, job}).Run()
+	c.Assert(job.triggeredBy, Equals, TriggerSchedule)
+
+	e := sc.RunJobManually(job)
+	c.Assert(job.triggeredBy, Equals, TriggerManual)
+	c.Assert(e.TriggeredBy, Equals, TriggerManual)
+	c.Assert(e.Failed, Equals, false)
+}
+
 func (s *SuiteScheduler) TestMergeMiddlewaresSame(c *C) {
 	mA, mB, mC := &TestMiddleware{}, &TestMiddleware{}, &TestMiddleware{}
 
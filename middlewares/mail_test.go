@@ -33,8 +33,9 @@ func (s *MailSuite) SetUpTest(c *C) {
 	c.Assert(err, IsNil)
 
 	s.l = ln
+	server := s.smtpd
 	go func() {
-		err := s.smtpd.Serve(ln)
+		err := server.Serve(ln)
 		c.Assert(err, IsNil)
 	}()
 
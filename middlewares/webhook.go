@@ -2,49 +2,208 @@ package middlewares
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mcuadros/ofelia/core"
 )
 
+// OnSendResult, when set, is called after every webhook delivery with its
+// outcome. It is meant to feed external metrics systems such as StatsD; set it
+// once at startup, before any job runs. It is invoked on the send goroutine so
+// it should return quickly.
+var OnSendResult func(SendResult)
+
+// OnRequestDuration, when set, is called after every request attempt with
+// the time the backend took to answer, excluding retry backoffs, and the
+// status code received (0 if none). It is meant to feed a latency histogram
+// labelled by webhook name. Like OnSendResult, set it once at startup; it is
+// invoked on the send goroutine so it should return quickly.
+var OnRequestDuration func(webhook string, statusCode int, duration time.Duration)
+
+// PreSendHook, when set, is called with every rendered request right before
+// it is delivered, and may change it, e.g. to add a computed header or rewrite
+// the URL. It runs once per send, before the first attempt, so retries carry
+// the same request. Set it once at startup, before any job runs. It is invoked
+// on the send goroutine so it should return quickly.
+var PreSendHook func(*WebhookRequest)
+
+// SuccessFunc, when set, decides whether a response of the http transport
+// counts as delivered, instead of its status code and any successCodes. It
+// is an escape hatch for endpoints that signal success some other way, e.g.
+// through a response header; use resp.Request to tell webhooks apart. It may
+// read the body but must not close it. Set it once at startup, before any job
+// runs.
+var SuccessFunc func(resp *http.Response) bool
+
+// sendHooks are the package hooks in effect for a webhook. They are read on
+// the goroutine building the webhook or running a job, so background sends
+// never read the package variables while a program or test changes them.
+type sendHooks struct {
+	preSend    func(*WebhookRequest)
+	onResult   func(SendResult)
+	onDuration func(webhook string, statusCode int, duration time.Duration)
+	success    func(resp *http.Response) bool
+}
+
+// captureHooks takes the current package hooks for the following sends
+func (w *Webhook) captureHooks() {
+	w.hooks.Store(&sendHooks{
+		preSend:    PreSendHook,
+		onResult:   OnSendResult,
+		onDuration: OnRequestDuration,
+		success:    SuccessFunc,
+	})
+}
+
+// loadHooks returns the hooks captured for the webhook
+func (w *Webhook) loadHooks() *sendHooks {
+	if hooks := w.hooks.Load(); hooks != nil {
+		return hooks
+	}
+	return &sendHooks{}
+}
+
+// SendResult describes the outcome of a webhook delivery, including retries
+type SendResult struct {
+	Webhook    string
+	Success    bool
+	Err        error
+	StatusCode int           // status code of the last attempt, 0 if no response was received
+	Attempts   int           // number of requests sent
+	Duration   time.Duration // total time spent, including retry backoffs
+
+	// ResponseHeaders holds the values of the captureResponseHeaders of a
+	// successful delivery, keyed by header name
+	ResponseHeaders map[string]string
+}
+
 // Webhook middleware sends HTTP requests to configured webhooks after job execution
 type Webhook struct {
 	name         string
 	webhookType  string // "error" | "info" | "all"
 	active       bool
 	url          string
+	balancer     *endpointBalancer // picks the url among several endpoints, nil for a single url
+	query        map[string]string
 	method       string
 	headers      map[string]string
+	emptyHeaders bool     // send headers that render to an empty string
+	capture      []string // response headers logged after a successful send
+	withOutput   bool     // copy stdout and stderr into the template data
+	maxOutput    int      // bytes copied from the end of each stream, 0 for all
+	delimiter    string   // only the output after its last occurrence is copied
+	redactFields []string // template data fields blanked before rendering
 	body         interface{}
+	bodyByStatus bool
+	leafBody     bool   // template each string of an object body on its own
+	mergeStdout  bool   // merge the body into the JSON object printed on stdout
+	bodyFile     string // template for the path of a file sent as the body
+	missingFile  string // what to do when the body file does not exist
+	chunkSize    int    // split the body into requests of at most this many bytes
+	envelope     *EnvelopeConfig
+	format       string
+	multipart    *MultipartConfig
+	templates    webhookTemplates // every template above, parsed once when built
 	onlyOnError  bool
+	failOnStderr bool // treat a success with stderr output as a failure
 	timeout      time.Duration
-	retryCount   int
-	retryBackoff time.Duration
+
+	retry          retryPolicy
+	retryOnError   *retryPolicy // replaces retry for failed executions, nil for none
+	retryOnSuccess *retryPolicy // replaces retry for successful executions, nil for none
+
+	transport    webhookTransport
+	subject      string // message subject for queue transports
+	batch        *webhookBatch
+	spool        *webhookSpool // on-disk queue delivered by a worker, nil to send directly
+	breaker      *circuitBreaker
+	signer       *webhookSigner
+	allowedHosts hostAllowlist // destinations allowed after templating, any when empty
+	slots        chan struct{} // concurrency limit, nil when unlimited
+	overflow     string        // what to do when every slot is taken
+	blockWait    time.Duration // longest time the "block" policy holds the job
+	trace        *TraceConfig
+
+	dedupKey    string
+	dedupWindow time.Duration
+	dedupMu     sync.Mutex
+	dedupSeen   map[string]time.Time
+
+	tokenFile     string
+	reloadSecrets bool
+	tokenMu       sync.Mutex
+	token         string
+
+	timestampHeader string // header carrying the send time, empty when disabled
+	signTimestamp   bool   // include the timestamp in the signed bytes
+
+	activeHours *activeHours  // daily window sends are limited to, nil for always
+	snoozeUntil time.Time     // no sends before this time, zero for none
+	alertAfter  time.Duration // send a running alert for executions still running after this long
+	heartbeat   time.Duration // send a running alert every interval while an execution runs
+
+	delay   time.Duration // hold failure sends this long, a success meanwhile cancels them
+	delayMu sync.Mutex
+	delayed map[string]*time.Timer // pending failure sends by job name
+
+	startupJitter time.Duration // upper bound of the random wait before the first send
+	startupOnce   sync.Once
+
+	hooks atomic.Pointer[sendHooks] // package hooks as of the last job run
+
+	// ctx is cancelled by Cancel, aborting retries and requests in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+	worker sync.WaitGroup // spool worker, waited for by Cancel
+	sends  sync.WaitGroup // sends started by dispatchNow, waited for by Wait
 
 	logger core.Logger
 	client *http.Client
+	sleep  func(time.Duration) // replaces the cancelable waits in tests
 }
 
-// NewWebhookFromDefinition creates a webhook middleware from a definition
-func NewWebhookFromDefinition(def WebhookDefinition, logger core.Logger) (core.Middleware, error) {
+// NewWebhookFromDefinition creates a webhook middleware from a definition. An
+// optional transport replaces the delivery chosen by the definition.
+func NewWebhookFromDefinition(def WebhookDefinition, logger core.Logger, custom ...Transport) (core.Middleware, error) {
+	if err := applyOutcomeBodies(&def); err != nil {
+		return nil, err
+	}
+
 	// Parse timeout
 	timeout := time.Duration(def.Timeout) * time.Second
 
-	// Parse retry config
-	retryCount := defaultRetryCount
-	retryBackoff := defaultRetryBackoff
-	if def.Retry != nil {
-		retryCount = def.Retry.Count
-		if def.Retry.Backoff != "" {
-			duration, err := time.ParseDuration(def.Retry.Backoff)
-			if err != nil {
-				return nil, fmt.Errorf("invalid retry backoff duration %q: %w", def.Retry.Backoff, err)
-			}
-			retryBackoff = duration
+	retry, err := newRetryPolicy(def.Name, "retry", def.Retry, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var dedupWindow time.Duration
+	if def.DedupWindow != "" {
+		duration, err := time.ParseDuration(def.DedupWindow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dedup window duration %q: %w", def.DedupWindow, err)
 		}
+		dedupWindow = duration
+	}
+
+	transport, err := newHTTPTransport(def)
+	if err != nil {
+		return nil, err
 	}
 
 	webhook := &Webhook{
@@ -52,22 +211,299 @@ func NewWebhookFromDefinition(def WebhookDefinition, logger core.Logger) (core.M
 		webhookType:  def.Type,
 		active:       def.Active,
 		url:          def.URL,
+		query:        def.Query,
 		method:       def.Method,
 		headers:      def.Headers,
 		body:         def.Body,
+		bodyByStatus: def.BodyByStatus,
+		leafBody:     def.TemplateLeaves,
+		mergeStdout:  def.MergeStdout,
+		bodyFile:     def.BodyFromFile,
+		missingFile:  def.MissingBodyFile,
+		chunkSize:    def.ChunkSize,
+		envelope:     def.Envelope,
+		emptyHeaders: def.KeepEmptyHeaders,
+		capture:      def.CaptureResponseHeaders,
+		withOutput:   def.IncludeOutput == nil || *def.IncludeOutput,
+		maxOutput:    def.MaxOutputBytes,
+		delimiter:    def.OutputDelimiter,
+		redactFields: def.RedactFields,
+		format:       def.Format,
+		multipart:    def.Multipart,
+		trace:        def.Trace,
+		subject:      def.Subject,
 		onlyOnError:  def.OnlyOnError,
+		failOnStderr: def.FailOnStderr,
 		timeout:      timeout,
-		retryCount:   retryCount,
-		retryBackoff: retryBackoff,
+		retry:        retry,
 		logger:       logger,
 		client: &http.Client{
-			Timeout: timeout,
+			Timeout:   timeout,
+			Transport: transport,
 		},
+		dedupKey:      def.DedupKey,
+		dedupWindow:   dedupWindow,
+		dedupSeen:     make(map[string]time.Time),
+		tokenFile:     def.TokenFile,
+		reloadSecrets: def.ReloadSecrets,
+	}
+	webhook.ctx, webhook.cancel = context.WithCancel(context.Background())
+	webhook.captureHooks()
+
+	// Outcome specific retries, falling back to retry
+	if def.RetryOnError != nil {
+		policy, err := newRetryPolicy(def.Name, "retryOnError", def.RetryOnError, logger)
+		if err != nil {
+			return nil, err
+		}
+		webhook.retryOnError = &policy
+	}
+	if def.RetryOnSuccess != nil {
+		policy, err := newRetryPolicy(def.Name, "retryOnSuccess", def.RetryOnSuccess, logger)
+		if err != nil {
+			return nil, err
+		}
+		webhook.retryOnSuccess = &policy
+	}
+
+	if len(def.URLs) > 0 {
+		webhook.balancer = newEndpointBalancer(def.URLs, def.LoadBalance)
+	}
+
+	if def.TokenFile != "" {
+		token, err := readSecretFile(def.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file: %w", err)
+		}
+		webhook.token = token
+	}
+
+	if def.Signature != nil {
+		signer, err := newWebhookSigner(def.Signature)
+		if err != nil {
+			return nil, err
+		}
+		webhook.signer = signer
+	}
+
+	if def.Timestamp != nil || (def.Signature != nil && def.Signature.Timestamp) {
+		webhook.timestampHeader = defaultTimestampHeader
+		webhook.signTimestamp = true
+		if def.Timestamp != nil {
+			if def.Timestamp.Header != "" {
+				webhook.timestampHeader = def.Timestamp.Header
+			}
+			if def.Timestamp.Sign != nil {
+				webhook.signTimestamp = *def.Timestamp.Sign
+			}
+		}
+	}
+
+	if def.AlertAfter != "" {
+		alertAfter, err := time.ParseDuration(def.AlertAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alertAfter duration %q: %w", def.AlertAfter, err)
+		}
+		webhook.alertAfter = alertAfter
+	}
+
+	if def.HeartbeatInterval != "" {
+		heartbeat, err := time.ParseDuration(def.HeartbeatInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid heartbeatInterval duration %q: %w", def.HeartbeatInterval, err)
+		}
+		if heartbeat <= 0 {
+			return nil, fmt.Errorf("heartbeatInterval must be positive, got %q", def.HeartbeatInterval)
+		}
+		webhook.heartbeat = heartbeat
+	}
+
+	if def.SnoozeUntil != "" {
+		until, err := time.Parse(time.RFC3339, def.SnoozeUntil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snoozeUntil time %q, must be RFC3339: %w", def.SnoozeUntil, err)
+		}
+		webhook.snoozeUntil = until
+	}
+
+	if def.StartupJitter != "" {
+		jitter, err := time.ParseDuration(def.StartupJitter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid startupJitter duration %q: %w", def.StartupJitter, err)
+		}
+		if jitter < 0 {
+			return nil, fmt.Errorf("startupJitter must not be negative, got %q", def.StartupJitter)
+		}
+		webhook.startupJitter = jitter
+	}
+
+	if def.ActiveHours != nil {
+		hours, err := newActiveHours(def.ActiveHours)
+		if err != nil {
+			return nil, err
+		}
+		webhook.activeHours = hours
+	}
+
+	if def.Delay != "" {
+		delay, err := time.ParseDuration(def.Delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay duration %q: %w", def.Delay, err)
+		}
+		webhook.delay = delay
+		webhook.delayed = make(map[string]*time.Timer)
+	}
+
+	switch {
+	case len(custom) > 0 && custom[0] != nil:
+		webhook.transport = &customTransport{transport: custom[0]}
+	case def.Transport == "" || def.Transport == TransportHTTP:
+		codes, err := newSuccessCodes(def.SuccessCodes, def.SuccessCodeRanges)
+		if err != nil {
+			return nil, err
+		}
+		if codes.acceptsRedirect() {
+			webhook.client.CheckRedirect = func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+		}
+		webhook.transport = &httpTransport{client: webhook.client, maxResponseBytes: def.MaxResponseBytes, successCodes: codes, hooks: &webhook.hooks}
+	case def.Transport == TransportNATS:
+		webhook.transport = &natsTransport{timeout: timeout, tlsConfig: transport.TLSClientConfig}
+	case def.Transport == TransportSNS:
+		region := def.Region
+		if region == "" {
+			region = snsRegion(def.TopicARN)
+		}
+		webhook.transport = &snsTransport{
+			http:        &httpTransport{client: webhook.client, maxResponseBytes: def.MaxResponseBytes, hooks: &webhook.hooks},
+			topicARN:    def.TopicARN,
+			region:      region,
+			credentials: newAWSCredentialsProvider(),
+			now:         time.Now,
+		}
+	case def.Transport == TransportExec:
+		webhook.transport = &execTransport{command: def.Command, timeout: timeout, maxResponseBytes: def.MaxResponseBytes}
+	default:
+		return nil, fmt.Errorf("invalid transport %q", def.Transport)
+	}
+
+	if def.OAuth2 != nil {
+		webhook.transport = newOAuth2Transport(webhook.ctx, def.OAuth2, webhook.client, webhook.transport)
+	}
+
+	if method, err := normalizeHTTPMethod(def.Method); err == nil && webhook.dropsBody(method) {
+		logger.Warningf("Webhook %q: %s requests are sent without a body, ignoring it", def.Name, method)
+	}
+
+	// Parse every template up front, so errors surface at load and sends
+	// reuse the parsed templates
+	if err := webhook.compileTemplates(); err != nil {
+		return nil, err
+	}
+
+	if def.MaxConcurrent > 0 {
+		webhook.slots = make(chan struct{}, def.MaxConcurrent)
+		webhook.overflow = def.OverflowPolicy
+		if webhook.overflow == "" {
+			webhook.overflow = OverflowBuffer
+		}
+		webhook.blockWait = timeout
+	}
+
+	if def.CircuitBreaker != nil {
+		breaker, err := newCircuitBreaker(def.CircuitBreaker)
+		if err != nil {
+			return nil, err
+		}
+		webhook.breaker = breaker
+	}
+
+	if def.Batch != nil {
+		batch, err := newWebhookBatch(def.Name, def.Batch, webhook)
+		if err != nil {
+			return nil, err
+		}
+		webhook.batch = batch
+	}
+
+	if def.Spool != nil {
+		spool, err := newWebhookSpool(def.Name, def.Spool)
+		if err != nil {
+			return nil, err
+		}
+		webhook.spool = spool
+		webhook.worker.Add(1)
+		go func() {
+			defer webhook.worker.Done()
+			spool.run(webhook)
+		}()
 	}
 
 	return webhook, nil
 }
 
+// newHTTPTransport builds the HTTP transport for a webhook definition
+func newHTTPTransport(def WebhookDefinition) (*http.Transport, error) {
+	minVersion, err := parseTLSVersion(def.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: minVersion,
+	}
+
+	// Keep idle connections briefly so collectors that drop long idle
+	// connections do not fail the next request
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+	if def.IdleConnTimeout != "" {
+		idleTimeout, err := time.ParseDuration(def.IdleConnTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idle connection timeout %q: %w", def.IdleConnTimeout, err)
+		}
+		transport.IdleConnTimeout = idleTimeout
+	}
+	transport.DisableKeepAlives = def.DisableKeepAlives
+
+	// Pin hosts to fixed addresses like curl --resolve. Only the dialed
+	// address changes, the Host header and TLS server name stay the same.
+	if len(def.ResolveHost) > 0 {
+		resolve := make(map[string]string, len(def.ResolveHost))
+		for from, to := range def.ResolveHost {
+			resolve[strings.ToLower(from)] = to
+		}
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if pinned, ok := resolve[strings.ToLower(addr)]; ok {
+				addr = pinned
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	return transport, nil
+}
+
+// parseTLSVersion converts a version string such as "1.2" into its tls constant
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return defaultMinTLSVersion, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid minimum TLS version %q, must be one of: 1.0, 1.1, 1.2, 1.3", version)
+	}
+}
+
 // ContinueOnStop returns true because we want to report final status
 func (w *Webhook) ContinueOnStop() bool {
 	return true
@@ -76,139 +512,907 @@ func (w *Webhook) ContinueOnStop() bool {
 // Run sends the webhook after job execution
 func (w *Webhook) Run(ctx *core.Context) error {
 	// Execute the job first
+	stop := watchRunning(ctx, w)
 	err := ctx.Next()
+	stop()
 	ctx.Stop(err)
+	recordExecution(ctx)
+	w.notify(ctx)
+
+	return err
+}
+
+// notify sends the webhook for a finished execution if it is active and its
+// type matches the outcome
+func (w *Webhook) notify(ctx *core.Context) {
+	w.cancelDelayed(ctx)
 
 	// Check if webhook is active
 	if !w.active {
 		ctx.Logger.Debugf("Webhook %q skipped (inactive)", w.name)
-		return err
+		return
 	}
 
 	// Check if webhook type matches job result
+	failed := w.failed(ctx)
 	shouldSend := false
 	if w.webhookType == WebhookTypeAll {
 		shouldSend = true
-	} else if ctx.Execution.Failed && w.webhookType == WebhookTypeError {
+	} else if failed && w.webhookType == WebhookTypeError {
 		shouldSend = true
-	} else if !ctx.Execution.Failed && w.webhookType == WebhookTypeInfo {
+	} else if !failed && w.webhookType == WebhookTypeInfo {
 		shouldSend = true
 	}
 
 	if !shouldSend {
 		ctx.Logger.Debugf("Webhook %q skipped (type mismatch: webhook type=%s, job failed=%t)",
-			w.name, w.webhookType, ctx.Execution.Failed)
-		return err
+			w.name, w.webhookType, failed)
+		return
 	}
 
 	// Also check the legacy onlyOnError flag for backward compatibility
-	if w.onlyOnError && !ctx.Execution.Failed {
+	if w.onlyOnError && !failed {
 		ctx.Logger.Debugf("Webhook %q skipped (onlyOnError=true but job succeeded)", w.name)
-		return err
+		return
 	}
 
 	// Send webhook asynchronously to avoid blocking
-	go w.sendWebhook(ctx)
+	w.dispatch(ctx)
+}
 
-	return err
+// dispatchDelayed holds a failure send for the delay, so a job that recovers
+// on its next run within the delay never alerts. A newer failure of the same
+// job restarts the delay.
+func (w *Webhook) dispatchDelayed(ctx *core.Context) {
+	name := ctx.Job.GetName()
+
+	w.delayMu.Lock()
+	defer w.delayMu.Unlock()
+
+	if pending, ok := w.delayed[name]; ok {
+		pending.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(w.delay, func() {
+		w.delayMu.Lock()
+		if w.delayed[name] == timer {
+			delete(w.delayed, name)
+		}
+		w.delayMu.Unlock()
+
+		w.dispatchNow(ctx)
+	})
+	w.delayed[name] = timer
+}
+
+// failed reports whether the execution counts as a failure for this webhook,
+// which includes successful runs that wrote to stderr with failOnStderr
+func (w *Webhook) failed(ctx *core.Context) bool {
+	if ctx.Execution.Failed {
+		return true
+	}
+	return w.failOnStderr && !ctx.Execution.Skipped && wroteStderr(ctx)
+}
+
+// wroteStderr reports whether the job wrote anything but whitespace to stderr
+func wroteStderr(ctx *core.Context) bool {
+	stream := ctx.Execution.ErrorStream
+	return stream != nil && stream.TotalWritten() > 0 && len(bytes.TrimSpace(stream.Bytes())) > 0
+}
+
+// cancelDelayed drops the pending failure send of a job that just succeeded
+func (w *Webhook) cancelDelayed(ctx *core.Context) {
+	if w.delay == 0 || w.failed(ctx) || ctx.Execution.Skipped {
+		return
+	}
+
+	name := ctx.Job.GetName()
+
+	w.delayMu.Lock()
+	defer w.delayMu.Unlock()
+
+	if pending, ok := w.delayed[name]; ok {
+		pending.Stop()
+		delete(w.delayed, name)
+		ctx.Logger.Noticef("Webhook %q: job %q recovered, cancelled delayed failure send", w.name, name)
+	}
+}
+
+// compileTemplates parses all templates of the webhook, which sends execute
+// from then on
+func (w *Webhook) compileTemplates() error {
+	templates := []string{w.url, w.method, w.subject, w.dedupKey, w.bodyFile}
+	if w.balancer != nil {
+		templates = append(templates, w.balancer.urls...)
+	}
+	for _, value := range w.headers {
+		templates = append(templates, value)
+	}
+	for _, value := range w.query {
+		templates = append(templates, value)
+	}
+	if w.trace != nil {
+		templates = append(templates, w.trace.Value)
+	}
+	if w.multipart != nil {
+		for _, value := range w.multipart.Fields {
+			templates = append(templates, value)
+		}
+		for _, file := range w.multipart.Files {
+			templates = append(templates, file.Filename, file.Content)
+		}
+	}
+
+	body, err := bodyTemplates(w.body, w.bodyByStatus, w.leafBody)
+	if err != nil {
+		return err
+	}
+	templates = append(templates, body...)
+
+	w.templates = make(webhookTemplates, len(templates))
+	for _, text := range templates {
+		if err := w.templates.add(text); err != nil {
+			return fmt.Errorf("template parse error: %w", err)
+		}
+	}
+	return nil
+}
+
+// snoozed reports whether sends are snoozed at the given time
+func (w *Webhook) snoozed(now time.Time) bool {
+	return now.Before(w.snoozeUntil)
+}
+
+// dispatch sends the webhook in the background, after the delay for failures.
+// Executions outside the active hours or while snoozed are not sent.
+func (w *Webhook) dispatch(ctx *core.Context) {
+	w.captureHooks()
+
+	now := time.Now()
+	if w.activeHours != nil && !w.activeHours.contains(now) {
+		ctx.Logger.Debugf("Webhook %q skipped (outside active hours)", w.name)
+		return
+	}
+	if w.snoozed(now) {
+		ctx.Logger.Noticef("Webhook %q skipped (snoozed until %s)", w.name, w.snoozeUntil.Format(time.RFC3339))
+		return
+	}
+
+	if w.delay > 0 && w.failed(ctx) {
+		w.dispatchDelayed(ctx)
+		return
+	}
+
+	w.dispatchNow(ctx)
+}
+
+// dispatchNow starts the send in the background. With a concurrency limit,
+// the overflow policy decides what happens when every slot is taken: "buffer"
+// queues the send, "drop" discards it and "block" holds the job for up to the
+// webhook timeout before dropping it, so a stuck receiver cannot stall the
+// middleware chain indefinitely.
+func (w *Webhook) dispatchNow(ctx *core.Context) {
+	if w.slots == nil {
+		w.sends.Add(1)
+		go func() {
+			defer w.sends.Done()
+			w.sendWebhook(ctx)
+		}()
+		return
+	}
+
+	send := func() {
+		defer w.sends.Done()
+		defer func() { <-w.slots }()
+		w.sendWebhook(ctx)
+	}
+
+	switch w.overflow {
+	case OverflowDrop:
+		select {
+		case w.slots <- struct{}{}:
+			w.sends.Add(1)
+			go send()
+		default:
+			ctx.Logger.Warningf("Webhook %q: concurrency limit reached, dropping send", w.name)
+		}
+	case OverflowBlock:
+		timer := time.NewTimer(w.blockWait)
+		defer timer.Stop()
+		select {
+		case w.slots <- struct{}{}:
+			w.sends.Add(1)
+			go send()
+		case <-timer.C:
+			ctx.Logger.Warningf("Webhook %q: concurrency limit reached for %v, dropping send", w.name, w.blockWait)
+		}
+	default:
+		w.sends.Add(1)
+		go func() {
+			w.slots <- struct{}{}
+			send()
+		}()
+	}
 }
 
-// sendWebhook sends the HTTP request to the configured webhook
+// sendWebhook sends the HTTP request to the configured webhook, or buffers the
+// execution when the webhook is batched
 func (w *Webhook) sendWebhook(ctx *core.Context) {
 	// Build template data
-	templateData := buildTemplateData(ctx)
+	templateData := buildTemplateData(ctx, w.withOutput, w.maxOutput, w.delimiter)
+	templateData.routedFailed = w.failed(ctx)
 
-	// Execute templates for URL
-	url, err := executeTemplate(w.url, templateData)
-	if err != nil {
-		ctx.Logger.Errorf("Webhook %q: failed to execute URL template: %v", w.name, err)
+	if w.batch != nil {
+		w.batch.add(templateData)
+		return
+	}
+
+	w.send(ctx.Logger, templateData)
+}
+
+// send renders the templates against the given data and delivers the request
+func (w *Webhook) send(logger core.Logger, templateData interface{}) {
+	// Suppress duplicates within the dedup window
+	if w.dedupWindow > 0 {
+		key, err := w.renderDedupKey(templateData)
+		if err != nil {
+			logger.Errorf("Webhook %q: %v", w.name, &TemplateError{Which: "dedup key", Err: err})
+			return
+		}
+		if w.isDuplicate(key, time.Now()) {
+			logger.Debugf("Webhook %q: suppressed duplicate (key %q within %v)", w.name, key, w.dedupWindow)
+			return
+		}
+	}
+
+	req, err := w.render(logger, templateData)
+	switch {
+	case errors.Is(err, errSendSkipped):
+		logger.Noticef("Webhook %q %v", w.name, err)
+		return
+	case err != nil:
+		logger.Errorf("Webhook %q: %v", w.name, err)
+		return
+	}
+
+	req.outcome = w.retryOutcome(templateData)
+
+	if hooks := w.loadHooks(); hooks.preSend != nil {
+		hooks.preSend(req)
+	}
+
+	// Templated URLs, and URLs changed by the hook, are only known now
+	if host, ok := w.checkEndpoints(req); !ok {
+		logger.Errorf("Webhook %q: host %q is not in webhook-allowed-hosts, not sending", w.name, host)
 		return
 	}
 
+	// Spooled requests are delivered by the spool worker
+	if w.spool != nil {
+		if err := w.spool.enqueue(req); err != nil {
+			logger.Errorf("Webhook %q: %v", w.name, err)
+		}
+		return
+	}
+
+	w.sendRendered(logger, req)
+}
+
+// sendRendered delivers a rendered request, in chunks when configured,
+// returning the error of the part that was not delivered
+func (w *Webhook) sendRendered(logger core.Logger, req *WebhookRequest) error {
+	// Spread the first sends of instances restarted together, concurrent
+	// sends wait for the same delay
+	if w.startupJitter > 0 {
+		w.startupOnce.Do(func() {
+			jitter := rand.N(w.startupJitter)
+			logger.Debugf("Webhook %q: delaying the first send by %v", w.name, jitter)
+			w.wait(jitter)
+		})
+	}
+
+	// Short-circuit while the endpoint is known to be down
+	if w.breaker != nil && !w.breaker.allow() {
+		logger.Warningf("Webhook %q: circuit open, skipping send to %s", w.name, req.URL)
+		return errCircuitOpen
+	}
+
+	if w.chunkSize == 0 {
+		return w.deliver(logger, req)
+	}
+
+	// Chunks are sent in order, a receiver cannot use the rest without the
+	// one that failed
+	chunks := splitChunks(req.Body, w.chunkSize)
+	for i, chunk := range chunks {
+		part := *req
+		part.Body = chunk
+		part.Headers = make(map[string]string, len(req.Headers)+1)
+		for key, value := range req.Headers {
+			part.Headers[key] = value
+		}
+		part.Headers[chunkHeader] = fmt.Sprintf("%d/%d", i+1, len(chunks))
+
+		if err := w.deliver(logger, &part); err != nil {
+			if i < len(chunks)-1 {
+				logger.Warningf("Webhook %q: chunk %d/%d failed, not sending the remaining %d", w.name, i+1, len(chunks), len(chunks)-i-1)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver signs the rendered request and sends it with retries, returning the
+// error of the last attempt
+func (w *Webhook) deliver(logger core.Logger, req *WebhookRequest) error {
+	// Sign last, so the signature covers the final body
+	var timestamp string
+	if w.timestampHeader != "" {
+		timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+		req.Headers[w.timestampHeader] = timestamp
+	}
+	if w.signer != nil {
+		if w.reloadSecrets {
+			if err := w.signer.reload(); err != nil {
+				logger.Warningf("Webhook %q: %v, signing with the previous one", w.name, err)
+			}
+		}
+		if !w.signTimestamp {
+			timestamp = ""
+		}
+		w.signer.sign(req.Headers, req.Body, timestamp)
+	}
+
+	// Send with retry logic
+	result := w.sendWithRetry(req)
+	if w.breaker != nil {
+		w.breaker.record(result.Success)
+	}
+	if hooks := w.loadHooks(); hooks.onResult != nil {
+		hooks.onResult(result)
+	}
+	if result.Err != nil && w.ctx.Err() != nil {
+		logger.Warningf("Webhook %q: cancelled after %d attempts: %v", w.name, result.Attempts, result.Err)
+	} else if result.Err != nil {
+		logger.Errorf("Webhook %q: failed after %d attempts: %v", w.name, result.Attempts, result.Err)
+	} else {
+		logger.Debugf("Webhook %q: sent successfully to %s", w.name, req.URL)
+		if len(result.ResponseHeaders) > 0 {
+			logger.Noticef("Webhook %q: response headers %s", w.name, formatCapturedHeaders(result.ResponseHeaders))
+		}
+	}
+
+	return result.Err
+}
+
+// render executes the templates of the webhook against the given data,
+// producing the request to deliver before signing and the pre-send hook
+func (w *Webhook) render(logger core.Logger, templateData interface{}) (*WebhookRequest, error) {
+	templateData = w.redact(templateData)
+
+	// Execute template for method, static methods skip templating
+	method := w.method
+	if strings.Contains(method, "{{") {
+		rendered, err := w.templates.execute(method, templateData)
+		if err != nil {
+			return nil, &TemplateError{Which: "method", Err: err}
+		}
+		method = rendered
+	}
+	method, err := normalizeHTTPMethod(method)
+	if err != nil {
+		return nil, err
+	}
+
+	// Execute templates for URL, picking the endpoint of this send first
+	urlTemplate := w.url
+	if w.balancer != nil {
+		urlTemplate = w.balancer.pick()
+	}
+	url, err := w.templates.execute(urlTemplate, templateData)
+	if err != nil {
+		return nil, &TemplateError{Which: "URL", Err: err}
+	}
+
+	// Execute templates for query parameters and merge them into the URL
+	if len(w.query) > 0 {
+		url, err = w.buildQuery(url, templateData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Healthcheck pings pick their endpoint from the execution status
+	if w.format == WebhookFormatHealthcheck {
+		url, err = healthcheckURL(url, templateData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Execute template for the message subject of queue transports
+	var subject string
+	if w.subject != "" {
+		subject, err = w.templates.execute(w.subject, templateData)
+		if err != nil {
+			return nil, &TemplateError{Which: "subject", Err: err}
+		}
+	}
+
+	// Templated methods can only be checked now, static ones were reported at load
+	dropBody := w.dropsBody(method)
+	if dropBody && strings.Contains(w.method, "{{") {
+		logger.Warningf("Webhook %q: %s requests are sent without a body, ignoring it", w.name, method)
+	}
+
 	// Execute templates for body
 	var bodyBytes []byte
-	if w.body != nil {
-		bodyBytes, err = executeTemplateForBody(w.body, templateData)
+	var contentType string
+	switch {
+	case dropBody:
+	case w.format == WebhookFormatMultipart:
+		bodyBytes, contentType, err = w.templates.executeMultipartBody(w.multipart, templateData)
 		if err != nil {
-			ctx.Logger.Errorf("Webhook %q: failed to execute body template: %v", w.name, err)
-			return
+			return nil, fmt.Errorf("failed to build multipart body: %w", err)
+		}
+	case w.bodyFile != "":
+		bodyBytes, err = w.readBodyFile(templateData)
+		if err != nil {
+			return nil, err
+		}
+		if w.format == WebhookFormatXML {
+			if err := validateXML(bodyBytes); err != nil {
+				return nil, err
+			}
+		}
+		if w.format == WebhookFormatNDJSON {
+			if bodyBytes, err = encodeNDJSON(bodyBytes); err != nil {
+				return nil, err
+			}
+		}
+		if w.envelope != nil {
+			bodyBytes = wrapEnvelope(w.envelope, bodyBytes)
+		}
+	case w.body != nil:
+		body := w.body
+		if w.bodyByStatus {
+			body = selectBodyByStatus(body, templateData)
+		}
+		if w.format == WebhookFormatXML || w.format == WebhookFormatRaw || w.format == WebhookFormatHealthcheck {
+			bodyBytes, err = w.templates.executeTextBody(body, templateData)
+		} else if w.leafBody {
+			bodyBytes, err = w.templates.executeLeafBody(body, templateData)
+		} else {
+			bodyBytes, err = w.templates.executeBody(body, templateData)
+		}
+		if err != nil {
+			return nil, &TemplateError{Which: "body", Err: err}
+		}
+		if w.format == WebhookFormatXML {
+			if err := validateXML(bodyBytes); err != nil {
+				return nil, err
+			}
+		}
+		if w.format == WebhookFormatNDJSON {
+			if bodyBytes, err = encodeNDJSON(bodyBytes); err != nil {
+				return nil, err
+			}
+		}
+		// A job that did not print JSON, e.g. because it failed early, still
+		// gets its alert with the configured fields only
+		if data, ok := templateData.(*WebhookTemplateData); ok && w.mergeStdout {
+			if merged, err := mergeStdoutJSON(bodyBytes, data.Stdout); err != nil {
+				logger.Warningf("Webhook %q: %v, sending the body without it", w.name, err)
+			} else {
+				bodyBytes = merged
+			}
+		}
+		if w.envelope != nil {
+			bodyBytes = wrapEnvelope(w.envelope, bodyBytes)
 		}
 	}
 
 	// Execute templates for headers
 	headers := make(map[string]string)
 	for key, value := range w.headers {
-		templatedValue, err := executeTemplate(value, templateData)
+		templatedValue, err := w.templates.execute(value, templateData)
 		if err != nil {
-			ctx.Logger.Errorf("Webhook %q: failed to execute header template for %q: %v", w.name, key, err)
-			return
+			return nil, &TemplateError{Which: fmt.Sprintf("header %q", key), Err: err}
+		}
+		// Strict receivers reject empty headers, so conditional headers are
+		// left out when their template renders nothing or calls skip
+		if strings.Contains(templatedValue, skipSentinel) || (templatedValue == "" && !w.emptyHeaders) {
+			continue
 		}
 		headers[key] = templatedValue
 	}
 
-	// Send with retry logic
-	err = w.sendWithRetry(url, headers, bodyBytes)
-	if err != nil {
-		ctx.Logger.Errorf("Webhook %q: failed after %d attempts: %v", w.name, w.retryCount+1, err)
-	} else {
-		ctx.Logger.Debugf("Webhook %q: sent successfully to %s", w.name, url)
+	// Correlation header, rendered once so every retry carries the same value
+	if w.trace != nil {
+		name, value, err := w.renderTraceHeader(templateData)
+		if err != nil {
+			return nil, &TemplateError{Which: "trace header", Err: err}
+		}
+		if value != "" {
+			headers[name] = value
+		}
+	}
+
+	// Formats that generate their own framing, such as a multipart boundary,
+	// always set the matching Content-Type. The default one of other formats
+	// only goes to HTTP, other transports would pass it on as an attribute,
+	// a message header or a variable nobody asked for.
+	if contentType != "" {
+		headers["Content-Type"] = contentType
+	} else if w.usesHTTP() && !hasHeader(headers, "Content-Type") {
+		if contentType = formatContentType(w.format, bodyBytes); contentType != "" {
+			headers["Content-Type"] = contentType
+		}
+	}
+
+	w.addToken(logger, headers)
+
+	req := &WebhookRequest{
+		Webhook: w.name,
+		Method:  method,
+		URL:     url,
+		Subject: subject,
+		Headers: headers,
+		Body:    bodyBytes,
 	}
+	if _, ok := w.transport.(*execTransport); ok {
+		req.env = execDataEnv(templateData)
+	}
+	return req, nil
 }
 
-// sendWithRetry sends the HTTP request with exponential backoff retry
-func (w *Webhook) sendWithRetry(url string, headers map[string]string, body []byte) error {
-	var lastErr error
-	backoff := w.retryBackoff
+// sendWithRetry delivers the request with exponential backoff retry. The
+// working backoff is local to each call so every send starts from the base.
+func (w *Webhook) sendWithRetry(req *WebhookRequest) SendResult {
+	result := SendResult{Webhook: w.name}
+	start := time.Now()
+	retry := w.retryFor(req.outcome)
+	backoff := retry.backoff
+	hooks := w.loadHooks()
 
-	for attempt := 0; attempt <= w.retryCount; attempt++ {
-		if attempt > 0 {
-			w.logger.Debugf("Webhook %q: retry attempt %d/%d after %v", w.name, attempt, w.retryCount, backoff)
-			time.Sleep(backoff)
+	for attempt := 1; retry.maxAttempts == 0 || attempt <= retry.maxAttempts; attempt++ {
+		if attempt > 1 {
+			if retry.maxElapsed > 0 && time.Since(start)+backoff > retry.maxElapsed {
+				w.logger.Debugf("Webhook %q: not retrying, the next attempt would start after retry.maxElapsed %v", w.name, retry.maxElapsed)
+				break
+			}
+			if retry.maxAttempts == 0 {
+				w.logger.Debugf("Webhook %q: retry attempt %d after %v", w.name, attempt-1, backoff)
+			} else {
+				w.logger.Debugf("Webhook %q: retry attempt %d/%d after %v", w.name, attempt-1, retry.maxAttempts-1, backoff)
+			}
+			if !w.wait(backoff) {
+				break
+			}
 			backoff *= 2 // Exponential backoff
 		}
 
-		err := w.sendRequest(url, headers, body)
-		if err == nil {
-			return nil
+		result.Attempts++
+		requestStart := time.Now()
+		var resp *webhookResponse
+		resp, result.Err = w.transport.send(w.ctx, req)
+		latency := time.Since(requestStart)
+		result.StatusCode = 0
+		if resp != nil {
+			result.StatusCode = resp.StatusCode
+		}
+		w.logger.Debugf("Webhook %q: request took %v (status %d)", w.name, latency, result.StatusCode)
+		if hooks.onDuration != nil {
+			hooks.onDuration(w.name, result.StatusCode, latency)
+		}
+		if result.Err == nil {
+			result.ResponseHeaders = w.capturedHeaders(resp)
+		}
+		if result.Err == nil || errors.Is(result.Err, errInvalidRequest) {
+			// Succeeded, or failed in a way retrying cannot fix
+			break
+		}
+	}
+
+	result.Success = result.Err == nil
+	result.Duration = time.Since(start)
+	return result
+}
+
+// wait sleeps for a retry backoff, returning false when the webhook is
+// cancelled in the meantime
+func (w *Webhook) wait(d time.Duration) bool {
+	if w.sleep != nil {
+		w.sleep(d)
+		return w.ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+// Cancel aborts the retries and requests in flight of the webhook, e.g. on
+// shutdown, stops any batch, spooling or dropping what it buffered, and waits
+// for the spool worker to stop. Later sends fail at once.
+func (w *Webhook) Cancel() {
+	w.cancel()
+	if w.batch != nil {
+		w.batch.stop()
+	}
+	w.worker.Wait()
+}
+
+// Wait blocks until the sends already started are done, retries included.
+// Sends held back by a failure delay are not waited for.
+func (w *Webhook) Wait() {
+	w.sends.Wait()
+}
+
+// capturedHeaders picks the captureResponseHeaders out of a response
+func (w *Webhook) capturedHeaders(resp *webhookResponse) map[string]string {
+	if len(w.capture) == 0 || resp == nil || resp.Header == nil {
+		return nil
+	}
+
+	captured := make(map[string]string)
+	for _, name := range w.capture {
+		if value := resp.Header.Get(name); value != "" {
+			captured[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return captured
+}
+
+// hasHeader reports whether headers sets name, ignoring case
+func hasHeader(headers map[string]string, name string) bool {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return true
 		}
+	}
+	return false
+}
 
-		lastErr = err
+// formatCapturedHeaders renders captured headers sorted by name for logging
+func formatCapturedHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	return lastErr
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, headers[name]))
+	}
+	return strings.Join(parts, " ")
 }
 
-// sendRequest sends a single HTTP request
-func (w *Webhook) sendRequest(url string, headers map[string]string, body []byte) error {
-	// Create request
-	var bodyReader io.Reader
-	if body != nil {
-		bodyReader = bytes.NewReader(body)
+// errInvalidRequest is returned when the request cannot be built, which no
+// retry can fix
+var errInvalidRequest = errors.New("failed to create request")
+
+// errCircuitOpen is returned for sends skipped while the circuit is open
+var errCircuitOpen = errors.New("circuit open")
+
+// Ping checks the webhook URL is reachable without sending a notification. It
+// sends a HEAD request to the URL, rendered with empty template data since no
+// execution is involved. Any response below 500 counts as reachable, as
+// endpoints commonly answer HEAD with 405 Method Not Allowed. A load balanced
+// webhook is reachable when all of its endpoints are.
+func (w *Webhook) Ping() error {
+	if !w.usesHTTP() {
+		return errors.New("ping is only supported by the http transport")
+	}
+
+	if w.balancer == nil {
+		return w.ping(w.url)
+	}
+	for _, url := range w.balancer.urls {
+		if err := w.ping(url); err != nil {
+			return fmt.Errorf("%s: %w", url, err)
+		}
 	}
+	return nil
+}
 
-	req, err := http.NewRequest(w.method, url, bodyReader)
+// ping sends the HEAD request of Ping to a single URL template
+func (w *Webhook) ping(urlTemplate string) error {
+	url, err := w.templates.execute(urlTemplate, &WebhookTemplateData{})
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return &TemplateError{Which: "URL", Err: err}
+	}
+	if ok, host := w.allowedHosts.allows(url); !ok {
+		return fmt.Errorf("host %q is not in webhook-allowed-hosts", host)
 	}
 
-	// Set headers
-	for key, value := range headers {
-		req.Header.Set(key, value)
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRequest, err)
 	}
 
-	// Send request
 	resp, err := w.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return &TransportError{Err: err}
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
 
-	// Check status code
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		// Read response body for error details
-		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return fmt.Errorf("non-2xx status code: %d, body: %s", resp.StatusCode, string(bodyBytes))
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("server error status code: %d", resp.StatusCode)
 	}
 
 	return nil
 }
+
+// buildQuery renders the query parameters and merges them, properly encoded,
+// with any query string already present in rawURL
+func (w *Webhook) buildQuery(rawURL string, templateData interface{}) (string, error) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+
+	values := u.Query()
+	for key, value := range w.query {
+		templatedValue, err := w.templates.execute(value, templateData)
+		if err != nil {
+			return "", &TemplateError{Which: fmt.Sprintf("query %q", key), Err: err}
+		}
+		values.Set(key, templatedValue)
+	}
+
+	u.RawQuery = values.Encode()
+	return u.String(), nil
+}
+
+// renderTraceHeader returns the correlation header name and value, the value
+// defaults to the execution ID
+func (w *Webhook) renderTraceHeader(templateData interface{}) (string, string, error) {
+	name := w.trace.Header
+	if name == "" {
+		name = defaultTraceHeader
+	}
+
+	if w.trace.Value != "" {
+		value, err := w.templates.execute(w.trace.Value, templateData)
+		return name, value, err
+	}
+
+	if data, ok := templateData.(*WebhookTemplateData); ok {
+		return name, data.ExecutionID, nil
+	}
+
+	return name, "", nil
+}
+
+// renderDedupKey renders the grouping key used for dedup, defaulting to the
+// webhook name
+func (w *Webhook) renderDedupKey(templateData interface{}) (string, error) {
+	if w.dedupKey == "" {
+		return w.name, nil
+	}
+
+	return w.templates.execute(w.dedupKey, templateData)
+}
+
+// isDuplicate reports whether key was already sent within the dedup window,
+// recording the send otherwise
+func (w *Webhook) isDuplicate(key string, now time.Time) bool {
+	w.dedupMu.Lock()
+	defer w.dedupMu.Unlock()
+
+	for k, sentAt := range w.dedupSeen {
+		if now.Sub(sentAt) >= w.dedupWindow {
+			delete(w.dedupSeen, k)
+		}
+	}
+
+	if _, ok := w.dedupSeen[key]; ok {
+		return true
+	}
+
+	w.dedupSeen[key] = now
+	return false
+}
+
+// currentToken returns the bearer token, re-reading the token file when
+// reloadSecrets is enabled. On a failed reload the last good token is kept.
+func (w *Webhook) currentToken(logger core.Logger) string {
+	w.tokenMu.Lock()
+	defer w.tokenMu.Unlock()
+
+	if w.tokenFile != "" && w.reloadSecrets {
+		token, err := readSecretFile(w.tokenFile)
+		if err != nil {
+			logger.Warningf("Webhook %q: failed to reload token file, using previous token: %v", w.name, err)
+		} else {
+			w.token = token
+		}
+	}
+
+	return w.token
+}
+
+// addToken authenticates with the token file unless the header was set
+// explicitly
+func (w *Webhook) addToken(logger core.Logger, headers map[string]string) {
+	if token := w.currentToken(logger); token != "" && !hasHeader(headers, "Authorization") {
+		headers["Authorization"] = "Bearer " + token
+	}
+}
+
+// readSecretFile reads a mounted secret, trimming the trailing newline most
+// secret stores append while keeping any inner line breaks
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// usesHTTP reports whether requests are delivered by the http transport,
+// authenticated or not
+func (w *Webhook) usesHTTP() bool {
+	transport := w.transport
+	if t, ok := transport.(*oauth2Transport); ok {
+		transport = t.next
+	}
+	_, ok := transport.(*httpTransport)
+	return ok
+}
+
+// dropsBody reports whether the body is left out of requests with the given
+// method. Many servers and proxies mishandle GET and HEAD requests with a body.
+func (w *Webhook) dropsBody(method string) bool {
+	if !w.usesHTTP() {
+		return false
+	}
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+	return w.body != nil || w.bodyFile != "" || w.format == WebhookFormatMultipart
+}
+
+// errSendSkipped is returned when rendering finds there is nothing to send,
+// which is not a failure
+var errSendSkipped = errors.New("skipped")
+
+// readBodyFile reads the body file for an execution
+func (w *Webhook) readBodyFile(templateData interface{}) ([]byte, error) {
+	path, err := w.templates.execute(w.bodyFile, templateData)
+	if err != nil {
+		return nil, &TemplateError{Which: "body file", Err: err}
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		return data, nil
+	case errors.Is(err, fs.ErrNotExist) && w.missingFile != MissingBodyFileError:
+		return nil, fmt.Errorf("%w (body file %q does not exist)", errSendSkipped, path)
+	default:
+		return nil, fmt.Errorf("failed to read body file: %w", err)
+	}
+}
+
+// normalizeHTTPMethod upper-cases the given method and checks it is a legal HTTP verb
+func normalizeHTTPMethod(method string) (string, error) {
+	normalized := strings.ToUpper(strings.TrimSpace(method))
+	switch normalized {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return normalized, nil
+	default:
+		return "", fmt.Errorf("invalid HTTP method %q", method)
+	}
+}
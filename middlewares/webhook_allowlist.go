@@ -0,0 +1,100 @@
+package middlewares
+
+import (
+	neturl "net/url"
+	"strings"
+)
+
+// hostAllowlist restricts the hosts webhooks may send to. An entry matches
+// the host itself, or any subdomain when written as "*.example.com". An empty
+// list allows every host.
+type hostAllowlist []string
+
+func newHostAllowlist(hosts []string) hostAllowlist {
+	var allowlist hostAllowlist
+	for _, host := range hosts {
+		for _, entry := range strings.Split(host, ",") {
+			if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+				allowlist = append(allowlist, entry)
+			}
+		}
+	}
+	return allowlist
+}
+
+// allows reports whether the host of rawURL is allowed, returning the host
+func (a hostAllowlist) allows(rawURL string) (bool, string) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return len(a) == 0, rawURL
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(a) == 0 {
+		return true, host
+	}
+
+	for _, entry := range a {
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true, host
+			}
+		} else if host == entry {
+			return true, host
+		}
+	}
+	return false, host
+}
+
+// staticEndpoints returns the URLs of a definition known before templating,
+// including those reached without a url: the regional endpoint of an SNS
+// webhook and the OAuth2 token endpoint
+func staticEndpoints(def WebhookDefinition) []string {
+	urls := append([]string{def.URL}, def.URLs...)
+	if def.Transport == TransportSNS && def.URL == "" && len(def.URLs) == 0 {
+		region := def.Region
+		if region == "" {
+			region = snsRegion(def.TopicARN)
+		}
+		urls = append(urls, snsEndpoint(region))
+	}
+	if def.OAuth2 != nil {
+		urls = append(urls, def.OAuth2.TokenURL)
+	}
+
+	static := urls[:0]
+	for _, url := range urls {
+		if url != "" && !strings.Contains(url, "{{") {
+			static = append(static, url)
+		}
+	}
+	return static
+}
+
+// endpoints returns the URLs a rendered request reaches, the same ones
+// staticEndpoints finds at load
+func (w *Webhook) endpoints(req *WebhookRequest) []string {
+	var urls []string
+	if req.URL != "" {
+		urls = append(urls, req.URL)
+	}
+	switch t := w.transport.(type) {
+	case *snsTransport:
+		if req.URL == "" {
+			urls = append(urls, snsEndpoint(t.region))
+		}
+	case *oauth2Transport:
+		urls = append(urls, t.tokenURL)
+	}
+	return urls
+}
+
+// checkEndpoints checks every endpoint of a rendered request against the
+// allowlist, returning the first host that is not allowed
+func (w *Webhook) checkEndpoints(req *WebhookRequest) (string, bool) {
+	for _, url := range w.endpoints(req) {
+		if ok, host := w.allowedHosts.allows(url); !ok {
+			return host, false
+		}
+	}
+	return "", true
+}
@@ -0,0 +1,37 @@
+package middlewares
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// Policies spreading the sends of a webhook across its endpoints
+const (
+	LoadBalanceRoundRobin = "roundrobin" // each endpoint in turn
+	LoadBalanceRandom     = "random"     // an endpoint picked at random
+)
+
+// endpointBalancer picks the URL of each send among the endpoints of a
+// webhook. Every endpoint is assumed healthy, a failed send is retried on the
+// endpoint it was sent to.
+type endpointBalancer struct {
+	urls   []string
+	policy string
+	next   atomic.Uint64 // round-robin position
+}
+
+func newEndpointBalancer(urls []string, policy string) *endpointBalancer {
+	if policy == "" {
+		policy = LoadBalanceRoundRobin
+	}
+	return &endpointBalancer{urls: urls, policy: policy}
+}
+
+// pick returns the URL template of the next send
+func (b *endpointBalancer) pick() string {
+	if b.policy == LoadBalanceRandom {
+		return b.urls[rand.IntN(len(b.urls))]
+	}
+	n := b.next.Add(1) - 1
+	return b.urls[n%uint64(len(b.urls))]
+}
@@ -0,0 +1,79 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookBalance struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookBalance{})
+
+func (s *SuiteWebhookBalance) TestRoundRobin(c *C) {
+	received := make(chan string, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name: "collector",
+		Type: WebhookTypeAll,
+		URLs: []string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/{{.JobName}}"},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 4; i++ {
+		webhook.(*Webhook).send(&TestLogger{}, &WebhookTemplateData{JobName: "c"})
+	}
+	c.Assert(<-received, Equals, "/a")
+	c.Assert(<-received, Equals, "/b")
+	c.Assert(<-received, Equals, "/c")
+	c.Assert(<-received, Equals, "/a")
+}
+
+func (s *SuiteWebhookBalance) TestRandom(c *C) {
+	balancer := newEndpointBalancer([]string{"a", "b"}, LoadBalanceRandom)
+	picked := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		picked[balancer.pick()]++
+	}
+	c.Assert(picked, HasLen, 2)
+	c.Assert(picked["a"]+picked["b"], Equals, 200)
+}
+
+func (s *SuiteWebhookBalance) TestInvalidConfig(c *C) {
+	for def, expected := range map[*WebhookDefinition]string{
+		{Name: "n", Type: "all", URL: "http://a", URLs: []string{"http://b"}}:                        ".*url and urls cannot be used together",
+		{Name: "n", Type: "all", URLs: []string{"http://a", ""}}:                                     ".*empty entry in urls",
+		{Name: "n", Type: "all", URL: "http://a", LoadBalance: LoadBalanceRandom}:                    ".*loadBalance requires urls",
+		{Name: "n", Type: "all", URLs: []string{"http://a"}, LoadBalance: "weighted"}:                `.*invalid loadBalance "weighted".*`,
+		{Name: "n", Type: "all", URLs: []string{"http://a"}, Transport: TransportNATS, Subject: "s"}: ".*urls only apply to the http transport",
+	} {
+		c.Assert(prepareWebhookDefinition(def), ErrorMatches, expected)
+	}
+}
+
+func (s *SuiteWebhookBalance) TestAllowedHosts(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "mixed", "type": "all", "urls": ["http://127.0.0.1/a", "https://evil.example.net/b"]}
+		]
+	}`)
+	defer os.Remove(path)
+
+	config := &WebhookFileConfig{WebhookConfigFile: path, WebhookAllowedHosts: []string{"127.0.0.1"}}
+	logger := &recordingLogger{}
+	_, registry := LoadWebhookMiddlewares(config, nil, logger)
+	c.Assert(logger.errors, DeepEquals, []string{`Webhook "mixed" rejected: host "evil.example.net" is not in webhook-allowed-hosts`})
+	_, ok := registry.Get("mixed")
+	c.Assert(ok, Equals, false)
+}
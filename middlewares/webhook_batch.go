@@ -0,0 +1,224 @@
+package middlewares
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// BatchConfig turns a webhook into a digest: executions are buffered and sent
+// as a single request once one of the flush triggers fires
+type BatchConfig struct {
+	MaxSize  int    `json:"maxSize"`  // flush once this many executions are buffered
+	MaxWait  string `json:"maxWait"`  // flush this long after the first buffered execution
+	Schedule string `json:"schedule"` // flush on a cron schedule, e.g. "@daily"
+}
+
+// WebhookBatchData contains all data available to batched webhook templates
+type WebhookBatchData struct {
+	// Batch information
+	Name string
+	Jobs []*WebhookTemplateData
+
+	// Counters
+	Count     int
+	Failed    int
+	Skipped   int
+	Succeeded int
+
+	// Time range covered by the batch
+	StartTime time.Time
+	EndTime   time.Time
+
+	// Metadata
+	Hostname  string
+	Timestamp string
+}
+
+// batchMaxBuffered caps the executions a batch without maxSize buffers
+// between time based flushes, the oldest are dropped beyond it
+const batchMaxBuffered = 1000
+
+var batchScheduleParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// webhookBatch buffers execution results for a webhook. It is owned by the
+// Webhook instance, which the registry shares between the global chain and
+// per-job references, so replacing a definition starts a new batch.
+type webhookBatch struct {
+	name     string
+	maxSize  int
+	maxWait  time.Duration
+	schedule cron.Schedule
+	webhook  *Webhook
+
+	mu      sync.Mutex
+	items   []*WebhookTemplateData
+	dropped int // executions dropped since the last flush, the buffer was full
+	timer   *time.Timer
+}
+
+func newWebhookBatch(name string, config *BatchConfig, webhook *Webhook) (*webhookBatch, error) {
+	batch := &webhookBatch{
+		name:    name,
+		maxSize: config.MaxSize,
+		webhook: webhook,
+	}
+
+	if config.MaxWait != "" {
+		duration, err := time.ParseDuration(config.MaxWait)
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch maxWait duration %q: %w", config.MaxWait, err)
+		}
+		batch.maxWait = duration
+	}
+
+	if config.Schedule != "" {
+		schedule, err := batchScheduleParser.Parse(config.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch schedule %q: %w", config.Schedule, err)
+		}
+		batch.schedule = schedule
+	}
+
+	if batch.maxSize <= 0 && batch.maxWait <= 0 && batch.schedule == nil {
+		return nil, fmt.Errorf("batch for webhook %q needs at least one of maxSize, maxWait or schedule", name)
+	}
+
+	return batch, nil
+}
+
+// add buffers an execution, flushing when the size threshold is reached.
+// Without one, the oldest execution is dropped once batchMaxBuffered are
+// waiting for the next flush.
+func (b *webhookBatch) add(data *WebhookTemplateData) {
+	b.mu.Lock()
+	if b.maxSize <= 0 && len(b.items) >= batchMaxBuffered {
+		if b.dropped == 0 {
+			b.webhook.logger.Warningf("Webhook %q: batch holds %d executions, dropping the oldest until the next flush", b.name, batchMaxBuffered)
+		}
+		copy(b.items, b.items[1:])
+		b.items = b.items[:len(b.items)-1]
+		b.dropped++
+	}
+	b.items = append(b.items, data)
+
+	if b.maxSize > 0 && len(b.items) >= b.maxSize {
+		items := b.take()
+		b.mu.Unlock()
+		b.send(items)
+		return
+	}
+
+	if b.timer == nil {
+		if wait := b.nextFlush(time.Now()); wait > 0 {
+			b.timer = time.AfterFunc(wait, b.flush)
+		}
+	}
+	b.mu.Unlock()
+}
+
+// nextFlush returns how long to wait for the earliest time based trigger
+func (b *webhookBatch) nextFlush(now time.Time) time.Duration {
+	var wait time.Duration
+	if b.maxWait > 0 {
+		wait = b.maxWait
+	}
+
+	if b.schedule != nil {
+		if untilSchedule := b.schedule.Next(now).Sub(now); wait == 0 || untilSchedule < wait {
+			wait = untilSchedule
+		}
+	}
+
+	return wait
+}
+
+// flush sends everything buffered so far
+func (b *webhookBatch) flush() {
+	b.mu.Lock()
+	items := b.take()
+	b.mu.Unlock()
+
+	b.send(items)
+}
+
+// stop cancels the pending flush, the webhook it would be sent with is going
+// away. What is buffered is written to the spool, if any, to be sent on the
+// next start, and dropped with a warning otherwise.
+func (b *webhookBatch) stop() {
+	b.mu.Lock()
+	items := b.take()
+	b.mu.Unlock()
+
+	if len(items) == 0 {
+		return
+	}
+	if b.webhook.spool != nil {
+		b.send(items)
+		return
+	}
+	b.webhook.logger.Warningf("Webhook %q: dropping %d buffered executions, the webhook is stopping", b.name, len(items))
+}
+
+// take empties the buffer and stops the pending timer, the caller must hold the lock
+func (b *webhookBatch) take() []*WebhookTemplateData {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	if b.dropped > 0 {
+		b.webhook.logger.Warningf("Webhook %q: %d executions were dropped from this batch, the buffer was full", b.name, b.dropped)
+		b.dropped = 0
+	}
+
+	items := b.items
+	b.items = nil
+	return items
+}
+
+func (b *webhookBatch) send(items []*WebhookTemplateData) {
+	if len(items) == 0 {
+		return
+	}
+
+	b.webhook.send(b.webhook.logger, buildBatchData(b.name, items))
+}
+
+// buildBatchData creates batch template data from the buffered executions
+func buildBatchData(name string, items []*WebhookTemplateData) *WebhookBatchData {
+	hostname, _ := os.Hostname()
+
+	data := &WebhookBatchData{
+		Name:      name,
+		Jobs:      items,
+		Count:     len(items),
+		Hostname:  hostname,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+
+	for _, item := range items {
+		switch {
+		case item.Failed:
+			data.Failed++
+		case item.Skipped:
+			data.Skipped++
+		default:
+			data.Succeeded++
+		}
+
+		if data.StartTime.IsZero() || item.StartTime.Before(data.StartTime) {
+			data.StartTime = item.StartTime
+		}
+		if item.EndTime.After(data.EndTime) {
+			data.EndTime = item.EndTime
+		}
+	}
+
+	return data
+}
@@ -0,0 +1,281 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookBatch struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookBatch{})
+
+func (s *SuiteWebhookBatch) newServer(received chan string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+}
+
+func (s *SuiteWebhookBatch) TestFlushOnMaxSize(c *C) {
+	received := make(chan string, 2)
+	ts := s.newServer(received)
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:    "batch-max-size",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "POST",
+		Body:    "{{.Count}} runs, {{.Failed}} failed:{{range .Jobs}} {{.JobName}}={{if .Failed}}fail{{else}}ok{{end}}{{end}}",
+		Timeout: 5,
+		Batch:   &BatchConfig{MaxSize: 2},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.job.Name = "first"
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case <-received:
+		c.Fatal("batch flushed before reaching maxSize")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s.SetUpTest(c)
+	s.job.Name = "second"
+	s.ctx.Start()
+	s.ctx.Stop(errors.New("test error"))
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case body := <-received:
+		c.Assert(body, Equals, "2 runs, 1 failed: first=ok second=fail")
+	case <-time.After(2 * time.Second):
+		c.Fatal("batch not received")
+	}
+}
+
+func (s *SuiteWebhookBatch) TestFlushOnMaxWait(c *C) {
+	received := make(chan string, 1)
+	ts := s.newServer(received)
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:    "batch-max-wait",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "POST",
+		Body:    "{{.Count}}",
+		Timeout: 5,
+		Batch:   &BatchConfig{MaxSize: 10, MaxWait: "50ms"},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case body := <-received:
+		c.Assert(body, Equals, "1")
+	case <-time.After(2 * time.Second):
+		c.Fatal("batch not received")
+	}
+}
+
+func (s *SuiteWebhookBatch) TestArrayBody(c *C) {
+	received := make(chan string, 1)
+	ts := s.newServer(received)
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:    "batch-array",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "POST",
+		Body:    `[{{range $i, $job := .Jobs}}{{if $i}},{{end}}{"job":{{quote $job.JobName}},"failed":{{$job.Failed}}}{{end}}]`,
+		Timeout: 5,
+		Batch:   &BatchConfig{MaxSize: 2},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	for _, name := range []string{"import", "export"} {
+		s.SetUpTest(c)
+		s.job.Name = name
+		s.ctx.Start()
+		s.ctx.Stop(nil)
+		c.Assert(webhook.Run(s.ctx), IsNil)
+	}
+
+	select {
+	case body := <-received:
+		var jobs []map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(body), &jobs), IsNil)
+		c.Assert(jobs, HasLen, 2)
+
+		// Sends run in the background, the two runs may be buffered in any order
+		names := []interface{}{jobs[0]["job"], jobs[1]["job"]}
+		if names[0] == "export" {
+			names[0], names[1] = names[1], names[0]
+		}
+		c.Assert(names, DeepEquals, []interface{}{"import", "export"})
+		c.Assert(jobs[0]["failed"], Equals, false)
+	case <-time.After(2 * time.Second):
+		c.Fatal("batch not received")
+	}
+}
+
+func (s *SuiteWebhookBatch) TestInvalidBatchConfig(c *C) {
+	_, err := newWebhookBatch("invalid", &BatchConfig{}, nil)
+	c.Assert(err, ErrorMatches, ".*needs at least one of.*")
+
+	_, err = newWebhookBatch("invalid", &BatchConfig{MaxWait: "soon"}, nil)
+	c.Assert(err, ErrorMatches, ".*invalid batch maxWait.*")
+
+	_, err = newWebhookBatch("invalid", &BatchConfig{Schedule: "@sometimes"}, nil)
+	c.Assert(err, ErrorMatches, ".*invalid batch schedule.*")
+}
+
+func (s *SuiteWebhookBatch) TestScheduleFlush(c *C) {
+	batch, err := newWebhookBatch("schedule", &BatchConfig{Schedule: "@hourly", MaxWait: "2h"}, nil)
+	c.Assert(err, IsNil)
+
+	now := time.Date(2024, 1, 15, 14, 30, 0, 0, time.Local)
+	c.Assert(batch.nextFlush(now), Equals, 30*time.Minute)
+}
+
+// Test replacing a batched definition sends with the new one
+func (s *SuiteWebhookBatch) TestRegisterReplaces(c *C) {
+	oldReceived, newReceived := make(chan string, 1), make(chan string, 1)
+	oldServer, newServer := s.newServer(oldReceived), s.newServer(newReceived)
+	defer oldServer.Close()
+	defer newServer.Close()
+
+	def := WebhookDefinition{
+		Name:    "batch-replaced",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     oldServer.URL,
+		Method:  "POST",
+		Body:    "{{.Count}}:{{range .Jobs}} {{.JobName}}{{end}}",
+		Timeout: 5,
+		Batch:   &BatchConfig{MaxSize: 2},
+	}
+	registry := NewWebhookRegistry()
+	registry.Register(def)
+
+	run := func(name string) {
+		webhook, err := registry.webhook(def.Name, &TestLogger{})
+		c.Assert(err, IsNil)
+		s.SetUpTest(c)
+		s.job.Name = name
+		s.ctx.Start()
+		s.ctx.Stop(nil)
+		c.Assert(webhook.Run(s.ctx), IsNil)
+	}
+
+	// The execution buffered by the old definition is dropped with it, with
+	// a warning as there is no spool
+	run("first")
+	def.URL = newServer.URL
+	registry.Register(def)
+	run("second")
+	run("third")
+
+	// Sends run in the background, the two runs may be buffered in any order
+	select {
+	case body := <-newReceived:
+		c.Assert(body, Matches, "2: (second third|third second)")
+	case <-time.After(2 * time.Second):
+		c.Fatal("batch not received")
+	}
+	select {
+	case body := <-oldReceived:
+		c.Fatalf("old definition sent %q", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Test a batch flushed on a schedule only keeps the newest executions
+func (s *SuiteWebhookBatch) TestBufferCap(c *C) {
+	logger := &recordingLogger{}
+	webhook, err := NewWebhookFromDefinition(WebhookDefinition{
+		Name:    "batch-capped",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     "http://127.0.0.1:1",
+		Method:  "POST",
+		Timeout: 5,
+		Batch:   &BatchConfig{Schedule: "@yearly"},
+	}, logger)
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	for i := 0; i < batchMaxBuffered+5; i++ {
+		wh.batch.add(&WebhookTemplateData{JobName: fmt.Sprint(i)})
+	}
+	wh.batch.mu.Lock()
+	c.Assert(wh.batch.items, HasLen, batchMaxBuffered)
+	c.Assert(wh.batch.items[0].JobName, Equals, "5")
+	wh.batch.mu.Unlock()
+	c.Assert(logger.warnings, HasLen, 1)
+
+	// Stopping without a spool reports both the dropped and the buffered executions
+	wh.Cancel()
+	c.Assert(logger.warnings, DeepEquals, []string{
+		`Webhook "batch-capped": batch holds 1000 executions, dropping the oldest until the next flush`,
+		`Webhook "batch-capped": 5 executions were dropped from this batch, the buffer was full`,
+		`Webhook "batch-capped": dropping 1000 buffered executions, the webhook is stopping`,
+	})
+}
+
+// Test stopping a spooled batch keeps the buffered executions for the next start
+func (s *SuiteWebhookBatch) TestStopSpools(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	dir := c.MkDir()
+	def := WebhookDefinition{
+		Name:   "batch-spooled",
+		Type:   WebhookTypeAll,
+		Active: true,
+		URL:    ts.URL,
+		Body:   "{{.Count}}",
+		Batch:  &BatchConfig{Schedule: "@yearly"},
+		Spool:  &SpoolConfig{Dir: dir},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	wh.batch.add(&WebhookTemplateData{JobName: "first"})
+	wh.batch.add(&WebhookTemplateData{JobName: "second"})
+	c.Assert(spoolFiles(c, dir, def.Name), HasLen, 0)
+
+	wh.Cancel()
+	c.Assert(spoolFiles(c, dir, def.Name), HasLen, 1)
+}
@@ -0,0 +1,121 @@
+package middlewares
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultCooldownPeriod   = 1 * time.Minute
+)
+
+// CircuitBreakerConfig stops sending to a webhook that keeps failing
+type CircuitBreakerConfig struct {
+	FailureThreshold int    `json:"failureThreshold"` // consecutive failed deliveries before opening, defaults to 5
+	CooldownPeriod   string `json:"cooldownPeriod"`   // how long to stay open before testing recovery, defaults to 1m
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker tracks consecutive delivery failures of a webhook. Once the
+// threshold is reached the circuit opens and sends are short-circuited until
+// the cooldown elapses, then a single trial send is let through (half-open):
+// success closes the circuit, failure opens it again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(config *CircuitBreakerConfig) (*circuitBreaker, error) {
+	b := &circuitBreaker{
+		threshold: config.FailureThreshold,
+		cooldown:  defaultCooldownPeriod,
+		now:       time.Now,
+	}
+
+	if b.threshold <= 0 {
+		b.threshold = defaultFailureThreshold
+	}
+
+	if config.CooldownPeriod != "" {
+		duration, err := time.ParseDuration(config.CooldownPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit breaker cooldown duration %q: %w", config.CooldownPeriod, err)
+		}
+		b.cooldown = duration
+	}
+
+	return b, nil
+}
+
+// allow reports whether a send may go through
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		// Cooldown elapsed, let a single trial send through
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// A trial send is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a delivery
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+// currentState returns the state of the circuit
+func (b *circuitBreaker) currentState() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
@@ -0,0 +1,92 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookBreaker struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookBreaker{})
+
+func (s *SuiteWebhookBreaker) TestTransitions(c *C) {
+	breaker, err := newCircuitBreaker(&CircuitBreakerConfig{FailureThreshold: 2, CooldownPeriod: "1m"})
+	c.Assert(err, IsNil)
+
+	now := time.Date(2024, 1, 15, 14, 30, 0, 0, time.UTC)
+	breaker.now = func() time.Time { return now }
+
+	// Closed until the threshold is reached
+	c.Assert(breaker.allow(), Equals, true)
+	breaker.record(false)
+	c.Assert(breaker.currentState(), Equals, circuitClosed)
+	breaker.record(false)
+	c.Assert(breaker.currentState(), Equals, circuitOpen)
+
+	// Open during the cooldown
+	now = now.Add(30 * time.Second)
+	c.Assert(breaker.allow(), Equals, false)
+
+	// Half-open after the cooldown, a single trial is let through
+	now = now.Add(31 * time.Second)
+	c.Assert(breaker.allow(), Equals, true)
+	c.Assert(breaker.currentState(), Equals, circuitHalfOpen)
+	c.Assert(breaker.allow(), Equals, false)
+
+	// A failed trial opens the circuit again
+	breaker.record(false)
+	c.Assert(breaker.currentState(), Equals, circuitOpen)
+	c.Assert(breaker.allow(), Equals, false)
+
+	// A successful trial closes it
+	now = now.Add(time.Minute)
+	c.Assert(breaker.allow(), Equals, true)
+	breaker.record(true)
+	c.Assert(breaker.currentState(), Equals, circuitClosed)
+	c.Assert(breaker.allow(), Equals, true)
+}
+
+func (s *SuiteWebhookBreaker) TestDefaults(c *C) {
+	breaker, err := newCircuitBreaker(&CircuitBreakerConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(breaker.threshold, Equals, defaultFailureThreshold)
+	c.Assert(breaker.cooldown, Equals, defaultCooldownPeriod)
+
+	_, err = newCircuitBreaker(&CircuitBreakerConfig{CooldownPeriod: "later"})
+	c.Assert(err, ErrorMatches, ".*invalid circuit breaker cooldown.*")
+}
+
+func (s *SuiteWebhookBreaker) TestShortCircuitsSends(c *C) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:           "test",
+		URL:            ts.URL,
+		Method:         "POST",
+		Timeout:        5,
+		CircuitBreaker: &CircuitBreakerConfig{FailureThreshold: 2, CooldownPeriod: "1h"},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	for i := 0; i < 5; i++ {
+		webhook.(*Webhook).sendWebhook(s.ctx)
+	}
+
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(2))
+}
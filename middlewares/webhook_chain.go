@@ -0,0 +1,49 @@
+package middlewares
+
+import (
+	"github.com/mcuadros/ofelia/core"
+)
+
+// WebhookChain runs the global webhooks as a single middleware. The scheduler
+// keeps one middleware per type, so using each webhook on its own would drop
+// every webhook but the first.
+type WebhookChain struct {
+	webhooks []*Webhook
+}
+
+// NewWebhookChain returns a middleware running the webhooks returned by
+// LoadWebhookMiddlewares in their order, or nil if there are none
+func NewWebhookChain(ms []core.Middleware) core.Middleware {
+	var m core.Middleware
+	chain := &WebhookChain{}
+	for _, middleware := range ms {
+		if webhook, ok := middleware.(*Webhook); ok {
+			chain.webhooks = append(chain.webhooks, webhook)
+		}
+	}
+	if len(chain.webhooks) > 0 {
+		m = chain
+	}
+
+	return m
+}
+
+// ContinueOnStop returns true because we want to report final status
+func (c *WebhookChain) ContinueOnStop() bool {
+	return true
+}
+
+// Run runs the job, then hands the execution to every webhook in order
+func (c *WebhookChain) Run(ctx *core.Context) error {
+	stop := watchRunning(ctx, c.webhooks...)
+	err := ctx.Next()
+	stop()
+	ctx.Stop(err)
+	recordExecution(ctx)
+
+	for _, webhook := range c.webhooks {
+		webhook.notify(ctx)
+	}
+
+	return err
+}
@@ -0,0 +1,32 @@
+package middlewares
+
+import "unicode/utf8"
+
+// chunkHeader numbers the requests of a chunked body, e.g. "2/3"
+const chunkHeader = "X-Chunk"
+
+// splitChunks splits the body into parts of at most size bytes, without
+// cutting UTF-8 sequences in two. An empty body is a single empty part.
+func splitChunks(body []byte, size int) [][]byte {
+	if len(body) <= size {
+		return [][]byte{body}
+	}
+
+	var chunks [][]byte
+	for len(body) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(body[end]) {
+			end--
+		}
+		// A size smaller than a single character still makes progress
+		if end == 0 {
+			end = size
+		}
+		chunks = append(chunks, body[:end])
+		body = body[end:]
+	}
+	if len(body) > 0 {
+		chunks = append(chunks, body)
+	}
+	return chunks
+}
@@ -0,0 +1,69 @@
+package middlewares
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookChunk struct{}
+
+var _ = Suite(&SuiteWebhookChunk{})
+
+func (s *SuiteWebhookChunk) TestSplitChunks(c *C) {
+	c.Assert(splitChunks([]byte("abcdefgh"), 3), DeepEquals, [][]byte{[]byte("abc"), []byte("def"), []byte("gh")})
+	c.Assert(splitChunks([]byte("abcdef"), 3), DeepEquals, [][]byte{[]byte("abc"), []byte("def")})
+	c.Assert(splitChunks(nil, 3), DeepEquals, [][]byte{nil})
+
+	// "é" is two bytes and is not cut in two
+	c.Assert(splitChunks([]byte("aébc"), 2), DeepEquals, [][]byte{[]byte("a"), []byte("é"), []byte("bc")})
+}
+
+func (s *SuiteWebhookChunk) TestChunkedSend(c *C) {
+	type request struct{ chunk, body string }
+	received := make(chan request, 4)
+	fail := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.Header.Get("X-Chunk"), string(body)}
+		if r.Header.Get("X-Chunk") == fail {
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:      "logs",
+		Type:      WebhookTypeAll,
+		URL:       ts.URL,
+		Format:    WebhookFormatRaw,
+		Body:      "{{.Stdout}}",
+		ChunkSize: 10,
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	stdout := strings.Repeat("0123456789", 2) + "tail"
+
+	webhook.(*Webhook).send(&TestLogger{}, &WebhookTemplateData{Stdout: stdout})
+	c.Assert(<-received, Equals, request{"1/3", "0123456789"})
+	c.Assert(<-received, Equals, request{"2/3", "0123456789"})
+	c.Assert(<-received, Equals, request{"3/3", "tail"})
+
+	// A failed chunk stops the sequence
+	fail = "2/3"
+	logger := &recordingLogger{}
+	webhook.(*Webhook).send(logger, &WebhookTemplateData{Stdout: stdout})
+	c.Assert(<-received, Equals, request{"1/3", "0123456789"})
+	c.Assert(<-received, Equals, request{"2/3", "0123456789"})
+	c.Assert(received, HasLen, 0)
+	c.Assert(logger.warnings, DeepEquals, []string{`Webhook "logs": chunk 2/3 failed, not sending the remaining 1`})
+
+	def.ChunkSize = -1
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*invalid chunkSize -1.*")
+}
@@ -1,11 +1,21 @@
 package middlewares
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mcuadros/ofelia/core"
@@ -16,21 +26,198 @@ const (
 	defaultTimeout           = 10 * time.Second
 	defaultRetryCount        = 0
 	defaultRetryBackoff      = 1 * time.Second
+	defaultMinTLSVersion     = tls.VersionTLS12
+	defaultTraceHeader       = "X-Correlation-ID"
+	defaultTimestampHeader   = "X-Ofelia-Timestamp"
+	defaultIdleConnTimeout   = 30 * time.Second
+
+	// disableWebhooksEnv lists webhook names to mute regardless of their config
+	disableWebhooksEnv = "OFELIA_WEBHOOK_DISABLE"
+	// webhooksEnabledEnv turns every webhook off when false, overriding the
+	// enabled flag of the config file
+	webhooksEnabledEnv = "OFELIA_WEBHOOKS_ENABLED"
 
 	// Webhook types
 	WebhookTypeError = "error"
 	WebhookTypeInfo  = "info"
 	WebhookTypeAll   = "all"
+
+	// Webhook body formats
+	WebhookFormatMultipart   = "multipart"
+	WebhookFormatXML         = "xml"         // string body checked to be well-formed XML
+	WebhookFormatRaw         = "raw"         // body rendered as-is, without validation
+	WebhookFormatHealthcheck = "healthcheck" // dead man's switch ping, /fail appended to the URL on failure
+	WebhookFormatNDJSON      = "ndjson"      // JSON body on one line, one line per element of an array
+
+	// Overflow policies when a webhook reaches its concurrency limit
+	OverflowBuffer = "buffer"
+	OverflowDrop   = "drop"
+	OverflowBlock  = "block"
+
+	// What to do when the body file of a webhook does not exist
+	MissingBodyFileSkip  = "skip"  // log a notice and send nothing
+	MissingBodyFileError = "error" // log an error and send nothing
 )
 
 // WebhookFileConfig is the global config that specifies the webhook config file location
 type WebhookFileConfig struct {
-	WebhookConfigFile string `gcfg:"webhook-config-file" mapstructure:"webhook-config-file"`
+	WebhookConfigFile      string   `gcfg:"webhook-config-file" mapstructure:"webhook-config-file"`
+	WebhookAllowedHosts    []string `gcfg:"webhook-allowed-hosts" mapstructure:"webhook-allowed-hosts"`       // hosts webhooks may send to, any when empty
+	WebhookSelfTest        bool     `gcfg:"webhook-self-test" mapstructure:"webhook-self-test"`               // ping every active webhook at startup
+	WebhookAllowedCommands []string `gcfg:"webhook-allowed-commands" mapstructure:"webhook-allowed-commands"` // executables exec webhooks may run, none when empty
+
+	configDir string
+}
+
+// SetConfigDir sets the directory a relative webhook-config-file is resolved
+// against, usually the directory of the main config file
+func (c *WebhookFileConfig) SetConfigDir(dir string) {
+	c.configDir = dir
+}
+
+// configFilePath returns the webhook config file to load: the WEBHOOK_CONFIG
+// environment variable first, then the config, then the default
+func (c *WebhookFileConfig) configFilePath() string {
+	if path := os.Getenv("WEBHOOK_CONFIG"); path != "" {
+		return path
+	}
+
+	path := c.WebhookConfigFile
+	if path == "" {
+		return defaultWebhookConfigPath
+	}
+
+	// Resolve against the main config rather than the working directory,
+	// which is unpredictable when running as a service
+	if !filepath.IsAbs(path) && c.configDir != "" {
+		path = filepath.Join(c.configDir, path)
+	}
+	return path
+}
+
+// WebhookSection is a simple webhook defined inline in the main config as a
+// [webhook "name"] section, for setups that do not need the JSON file
+type WebhookSection struct {
+	Type         string   `gcfg:"type" mapstructure:"type"`
+	Active       bool     `gcfg:"active" mapstructure:"active"`
+	Priority     int      `gcfg:"priority" mapstructure:"priority"`
+	URL          string   `gcfg:"url" mapstructure:"url"`
+	Method       string   `gcfg:"method" mapstructure:"method"`
+	Header       []string `gcfg:"header" mapstructure:"header"` // "Name: value", may be repeated
+	Body         string   `gcfg:"body" mapstructure:"body"`
+	OnlyOnError  bool     `gcfg:"only-on-error" mapstructure:"only-on-error"`
+	FailOnStderr bool     `gcfg:"fail-on-stderr" mapstructure:"fail-on-stderr"`
+	Timeout      int      `gcfg:"timeout" mapstructure:"timeout"`
+	RetryCount   int      `gcfg:"retry-count" mapstructure:"retry-count"`
+	RetryBackoff string   `gcfg:"retry-backoff" mapstructure:"retry-backoff"`
+}
+
+// definition maps the section to a webhook definition
+func (s *WebhookSection) definition(name string) (WebhookDefinition, error) {
+	def := WebhookDefinition{
+		Name:         name,
+		Type:         s.Type,
+		Active:       s.Active,
+		Priority:     s.Priority,
+		URL:          s.URL,
+		Method:       s.Method,
+		OnlyOnError:  s.OnlyOnError,
+		FailOnStderr: s.FailOnStderr,
+		Timeout:      s.Timeout,
+	}
+
+	if s.Body != "" {
+		def.Body = s.Body
+	}
+
+	if len(s.Header) > 0 {
+		def.Headers = make(map[string]string, len(s.Header))
+		for _, header := range s.Header {
+			key, value, ok := strings.Cut(header, ":")
+			if !ok || strings.TrimSpace(key) == "" {
+				return def, fmt.Errorf("invalid header %q, must be \"Name: value\"", header)
+			}
+			def.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	if s.RetryCount != 0 || s.RetryBackoff != "" {
+		def.Retry = &RetryConfig{Count: s.RetryCount, Backoff: s.RetryBackoff}
+	}
+
+	return def, nil
 }
 
 // WebhooksFile represents the structure of the webhooks configuration JSON file
 type WebhooksFile struct {
-	Webhooks []WebhookDefinition `json:"webhooks"`
+	Enabled        *bool               `json:"enabled"` // kill switch for every webhook, defaults to true
+	Defaults       *WebhookDefaults    `json:"defaults"`
+	DefaultHeaders map[string]string   `json:"defaultHeaders"` // merged into every webhook, its own headers win
+	TemplateDir    string              `json:"templateDir"`    // directory of *.tmpl partials, relative to this file
+	Partials       map[string]string   `json:"partials"`       // named partials defined inline, alongside those of templateDir
+	Webhooks       []WebhookDefinition `json:"webhooks"`
+}
+
+// mergeDefaultHeaders adds the default headers a definition does not set
+// itself, comparing header names case-insensitively
+func mergeDefaultHeaders(def *WebhookDefinition, defaults map[string]string) {
+	if len(defaults) == 0 {
+		return
+	}
+
+	set := make(map[string]bool, len(def.Headers))
+	for key := range def.Headers {
+		set[http.CanonicalHeaderKey(key)] = true
+	}
+
+	if def.Headers == nil {
+		def.Headers = make(map[string]string, len(defaults))
+	}
+	for key, value := range defaults {
+		if !set[http.CanonicalHeaderKey(key)] {
+			def.Headers[key] = value
+		}
+	}
+}
+
+// WebhookDefaults holds values applied to every webhook that does not set its own
+type WebhookDefaults struct {
+	Method       string            `json:"method"`
+	Headers      map[string]string `json:"headers"`
+	Timeout      int               `json:"timeout"`
+	Retry        *RetryConfig      `json:"retry"`
+	Envelope     *EnvelopeConfig   `json:"envelope"`
+	RedactFields []string          `json:"redactFields"` // added to the redactFields of every webhook
+}
+
+// apply fills the unset fields of def with the defaults
+func (d *WebhookDefaults) apply(def *WebhookDefinition) {
+	if def.Method == "" {
+		def.Method = d.Method
+	}
+	if def.Headers == nil && d.Headers != nil {
+		def.Headers = make(map[string]string, len(d.Headers))
+		for key, value := range d.Headers {
+			def.Headers[key] = value
+		}
+	}
+	if def.Timeout == 0 {
+		def.Timeout = d.Timeout
+	}
+	if def.Retry == nil && d.Retry != nil {
+		retry := *d.Retry
+		def.Retry = &retry
+	}
+	if def.Envelope == nil && d.Envelope != nil {
+		envelope := *d.Envelope
+		def.Envelope = &envelope
+	}
+	// Redaction is a guarantee, a webhook can add fields but not drop them
+	for _, field := range d.RedactFields {
+		if !slices.Contains(def.RedactFields, field) {
+			def.RedactFields = append(def.RedactFields, field)
+		}
+	}
 }
 
 // WebhookDefinition defines a single webhook configuration
@@ -40,35 +227,190 @@ type WebhookDefinition struct {
 	Active      bool              `json:"active"` // defaults to false
 	Priority    int               `json:"priority"`
 	URL         string            `json:"url"`
+	Query       map[string]string `json:"query"`
 	Method      string            `json:"method"`
 	Headers     map[string]string `json:"headers"`
 	Body        interface{}       `json:"body"`
+	Format      string            `json:"format"` // "" (body as-is) | "multipart" | "xml" | "raw"
+	Multipart   *MultipartConfig  `json:"multipart"`
 	OnlyOnError bool              `json:"onlyOnError"`
 	Timeout     int               `json:"timeout"`
 	Retry       *RetryConfig      `json:"retry"`
+	Batch       *BatchConfig      `json:"batch"`
+	Spool       *SpoolConfig      `json:"spool"`
+
+	BodyByStatus     bool                  `json:"bodyByStatus"`   // Body is keyed by "success" | "error" | "skipped" | "running" | "default"
+	BodyOnError      interface{}           `json:"bodyOnError"`    // body sent for failed runs instead of Body
+	BodyOnSuccess    interface{}           `json:"bodyOnSuccess"`  // body sent for successful runs instead of Body
+	TemplateLeaves   bool                  `json:"templateLeaves"` // template each string of an object body on its own instead of its JSON text
+	MergeStdout      bool                  `json:"mergeStdout"`    // merge the object body into the JSON object the job printed on stdout
+	CircuitBreaker   *CircuitBreakerConfig `json:"circuitBreaker"`
+	Trace            *TraceConfig          `json:"trace"`
+	Signature        *SignatureConfig      `json:"signature"`
+	Timestamp        *TimestampConfig      `json:"timestamp"`
+	KeepEmptyHeaders bool                  `json:"keepEmptyHeaders"` // send headers whose template renders empty instead of omitting them
+	FailOnStderr     bool                  `json:"failOnStderr"`     // route successful runs that wrote to stderr as failures
+	MaxConcurrent    int                   `json:"maxConcurrent"`    // limit on sends in flight, 0 for no limit
+	OverflowPolicy   string                `json:"overflowPolicy"`   // "buffer" (default) | "drop" | "block"
+	Delay            string                `json:"delay"`            // hold failure sends this long, cancelled if the job succeeds meanwhile
+	AlertAfter       string                `json:"alertAfter"`       // also send once while the job is still running after this long
+	ActiveHours      *ActiveHoursConfig    `json:"activeHours"`      // only send within this daily time window
+	IncludeOutput    *bool                 `json:"includeOutput"`    // copy stdout/stderr into the template data, defaults to true
+	MaxOutputBytes   int                   `json:"maxOutputBytes"`   // copy at most the last N bytes of stdout/stderr, 0 for no limit
+	OutputDelimiter  string                `json:"outputDelimiter"`  // copy only the stdout/stderr after the last occurrence of this marker
+	Transport        string                `json:"transport"`        // "http" (default) | "nats" | "sns" | "exec"
+	Subject          string                `json:"subject"`          // template for the message subject of queue transports
+	TopicARN         string                `json:"topicArn"`         // SNS topic the body is published to
+	Region           string                `json:"region"`           // SNS region, defaults to the region of the topic ARN
+	Command          []string              `json:"command"`          // executable and arguments the exec transport pipes the body to
+
+	MinTLSVersion          string   `json:"minTLSVersion"`          // "1.0" | "1.1" | "1.2" | "1.3", defaults to "1.2"
+	IdleConnTimeout        string   `json:"idleConnTimeout"`        // how long idle keep-alive connections are kept, defaults to 30s
+	DisableKeepAlives      bool     `json:"disableKeepAlives"`      // open a new connection for every request
+	DedupKey               string   `json:"dedupKey"`               // template for the dedup grouping key, defaults to the name
+	DedupWindow            string   `json:"dedupWindow"`            // suppress sends with the same key within this duration
+	TokenFile              string   `json:"tokenFile"`              // file holding a bearer token, e.g. a mounted secret
+	ReloadSecrets          bool     `json:"reloadSecrets"`          // re-read the token file and signature secret or key file on every send
+	CaptureResponseHeaders []string `json:"captureResponseHeaders"` // response headers logged after a successful send
+	MaxResponseBytes       int      `json:"maxResponseBytes"`       // error response bytes kept for logging, defaults to 1024
+	SuccessCodes           []int    `json:"successCodes"`           // status codes counted as delivered instead of any 2xx
+	SuccessCodeRanges      []string `json:"successCodeRanges"`      // "from-to" status code ranges counted as delivered, e.g. "200-399"
+	BodyFromFile           string   `json:"bodyFromFile"`           // template for the path of a file sent as the body, read at send time
+	MissingBodyFile        string   `json:"missingBodyFile"`        // "skip" (default) | "error", when the body file does not exist
+	ChunkSize              int      `json:"chunkSize"`              // split bodies larger than this many bytes into sequential requests
+	URLs                   []string `json:"urls"`                   // endpoints sends are spread across, instead of url
+	LoadBalance            string   `json:"loadBalance"`            // "roundrobin" (default) | "random", how urls are picked
+	HeartbeatInterval      string   `json:"heartbeatInterval"`      // also send every interval while the job is still running
+	RedactFields           []string `json:"redactFields"`           // template data fields blanked before rendering, e.g. "Stdout"
+	SnoozeUntil            string   `json:"snoozeUntil"`            // RFC3339 time before which sends are skipped, e.g. during maintenance
+	StartupJitter          string   `json:"startupJitter"`          // random wait of up to this long before the first send after start
+
+	Envelope    *EnvelopeConfig   `json:"envelope"`    // wrap the JSON body in a versioned envelope
+	ResolveHost map[string]string `json:"resolveHost"` // "host:port" to "ip:port" dial overrides, like curl --resolve
+	OAuth2      *OAuth2Config     `json:"oauth2"`      // authenticate with a client credentials token
+
+	RetryOnError   *RetryConfig `json:"retryOnError"`   // replaces retry for failed executions
+	RetryOnSuccess *RetryConfig `json:"retryOnSuccess"` // replaces retry for successful and skipped executions
+}
+
+// TraceConfig injects a correlation header so a job run can be traced to its
+// downstream webhook handling
+type TraceConfig struct {
+	Header string `json:"header"` // defaults to "X-Correlation-ID"
+	Value  string `json:"value"`  // template, defaults to the execution ID
+}
+
+// TimestampConfig adds the send time as a Unix timestamp header, so receivers
+// can reject stale or replayed requests
+type TimestampConfig struct {
+	Header string `json:"header"` // defaults to "X-Ofelia-Timestamp"
+	Sign   *bool  `json:"sign"`   // include the timestamp in the signature, defaults to true
+}
+
+// EnvelopeConfig nests the rendered body in a versioned envelope, e.g.
+// {"version":"1","event":{...}}, so collectors see one schema for every webhook
+type EnvelopeConfig struct {
+	Version string `json:"version"` // REQUIRED
+	Field   string `json:"field"`   // name of the payload field, defaults to "event"
 }
 
 // RetryConfig defines retry behavior for webhooks
 type RetryConfig struct {
-	Count   int    `json:"count"`
-	Backoff string `json:"backoff"`
+	Count      int    `json:"count"`      // retries after the first attempt, 0 disables retries unless maxElapsed is set
+	Backoff    string `json:"backoff"`    // delay before the first retry, doubled on each retry
+	MaxElapsed string `json:"maxElapsed"` // stop retrying once a retry would start later than this after the first attempt
 }
 
 // WebhookRegistry stores loaded webhooks for per-job lookups
 type WebhookRegistry struct {
 	webhooks map[string]*WebhookDefinition
+
+	// instances holds one Webhook per definition, shared by the global
+	// middleware chain and every per-job reference so that state such as
+	// dedup windows is kept per definition
+	mu        sync.Mutex
+	instances map[string]*Webhook
+
+	// disabled is set when webhooks are turned off globally, per-job
+	// references are still validated but nothing is sent
+	disabled bool
+
+	// allowedHosts restricts the destinations of every webhook
+	allowedHosts hostAllowlist
 }
 
 // NewWebhookRegistry creates a new webhook registry
 func NewWebhookRegistry() *WebhookRegistry {
 	return &WebhookRegistry{
-		webhooks: make(map[string]*WebhookDefinition),
+		webhooks:  make(map[string]*WebhookDefinition),
+		instances: make(map[string]*Webhook),
 	}
 }
 
-// Register adds a webhook to the registry
+// Register adds a webhook to the registry. Replacing a definition cancels
+// the instance built from the previous one, with its spool worker and batch.
 func (r *WebhookRegistry) Register(def WebhookDefinition) {
+	r.mu.Lock()
 	r.webhooks[def.Name] = &def
+	previous := r.instances[def.Name]
+	delete(r.instances, def.Name)
+	r.mu.Unlock()
+
+	if previous != nil {
+		previous.Cancel()
+	}
+}
+
+// webhook returns the shared Webhook instance for a registered definition,
+// building it on first use
+func (r *WebhookRegistry) webhook(name string, logger core.Logger) (*Webhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if wh, ok := r.instances[name]; ok {
+		return wh, nil
+	}
+
+	def, ok := r.webhooks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown webhook %q", name)
+	}
+
+	middleware, err := NewWebhookFromDefinition(*def, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	wh := middleware.(*Webhook)
+	wh.allowedHosts = r.allowedHosts
+	r.instances[name] = wh
+	return wh, nil
+}
+
+// CancelSends cancels every webhook built by the registry, so shutdown does
+// not wait on retries to unreachable endpoints
+func (r *WebhookRegistry) CancelSends() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, wh := range r.instances {
+		wh.Cancel()
+	}
+}
+
+// WaitSends waits for the sends started by every webhook built by the
+// registry, e.g. before a one-off run exits
+func (r *WebhookRegistry) WaitSends() {
+	r.mu.Lock()
+	instances := make([]*Webhook, 0, len(r.instances))
+	for _, wh := range r.instances {
+		instances = append(instances, wh)
+	}
+	r.mu.Unlock()
+
+	for _, wh := range instances {
+		wh.Wait()
+	}
 }
 
 // Get retrieves a webhook by name
@@ -86,6 +428,143 @@ func (r *WebhookRegistry) GetAll() []*WebhookDefinition {
 	return all
 }
 
+// applyOutcomeBodies folds bodyOnError and bodyOnSuccess into a status keyed
+// body, with Body as the fallback for the other outcomes
+func applyOutcomeBodies(def *WebhookDefinition) error {
+	if def.BodyOnError == nil && def.BodyOnSuccess == nil {
+		return nil
+	}
+	if def.BodyByStatus {
+		return fmt.Errorf("'bodyOnError' and 'bodyOnSuccess' cannot be combined with 'bodyByStatus'")
+	}
+
+	bodies := make(map[string]interface{})
+	if def.Body != nil {
+		bodies["default"] = def.Body
+	}
+	if def.BodyOnError != nil {
+		bodies["error"] = def.BodyOnError
+	}
+	if def.BodyOnSuccess != nil {
+		bodies["success"] = def.BodyOnSuccess
+	}
+
+	def.Body = bodies
+	def.BodyByStatus = true
+	def.BodyOnError, def.BodyOnSuccess = nil, nil
+	return nil
+}
+
+// validateBodyByStatus checks a status keyed body only uses known statuses
+func validateBodyByStatus(def WebhookDefinition) error {
+	if !def.BodyByStatus {
+		return nil
+	}
+
+	bodies, ok := def.Body.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("'bodyByStatus' requires 'body' to be an object keyed by status")
+	}
+
+	for status := range bodies {
+		switch status {
+		case "success", "error", "skipped", "running", "default":
+		default:
+			return fmt.Errorf("invalid body status %q, must be one of: %q, %q, %q, %q, %q",
+				status, "success", "error", "skipped", "running", "default")
+		}
+	}
+
+	return nil
+}
+
+// validateWebhookFormat validates the webhook format field
+func validateWebhookFormat(def WebhookDefinition) error {
+	if def.Envelope != nil {
+		if def.Format != "" {
+			return fmt.Errorf("envelope only applies to JSON bodies, not format %q", def.Format)
+		}
+		if def.Envelope.Version == "" {
+			return fmt.Errorf("envelope requires a version")
+		}
+		if def.Envelope.Field == envelopeVersionField {
+			return fmt.Errorf("envelope field cannot be %q", envelopeVersionField)
+		}
+	}
+
+	if def.BodyFromFile != "" {
+		if def.Body != nil {
+			return fmt.Errorf("bodyFromFile cannot be used with body, bodyOnError or bodyOnSuccess")
+		}
+		if def.Format == WebhookFormatMultipart {
+			return fmt.Errorf("bodyFromFile cannot be used with format %q", def.Format)
+		}
+	}
+
+	if def.MergeStdout {
+		if def.Format != "" {
+			return fmt.Errorf("mergeStdout only applies to JSON bodies, not format %q", def.Format)
+		}
+		if def.IncludeOutput != nil && !*def.IncludeOutput {
+			return fmt.Errorf("mergeStdout needs includeOutput")
+		}
+		if !isObjectBody(def.Body, def.BodyByStatus) {
+			return fmt.Errorf("mergeStdout requires an object body")
+		}
+		if def.Batch != nil {
+			return fmt.Errorf("mergeStdout cannot be used with batch")
+		}
+	}
+
+	switch def.Format {
+	case "":
+		return nil
+	case WebhookFormatMultipart:
+		if def.Multipart == nil {
+			return fmt.Errorf("format %q requires a 'multipart' section", def.Format)
+		}
+		return nil
+	case WebhookFormatXML:
+		if _, ok := def.Body.(string); !ok && def.Body != nil && !def.BodyByStatus {
+			return fmt.Errorf("format %q requires a string body", def.Format)
+		}
+		return nil
+	case WebhookFormatRaw:
+		return nil
+	case WebhookFormatHealthcheck:
+		if _, ok := def.Body.(string); !ok && def.Body != nil && !def.BodyByStatus {
+			return fmt.Errorf("format %q requires a string body", def.Format)
+		}
+		if def.Batch != nil {
+			return fmt.Errorf("format %q cannot be used with batch", def.Format)
+		}
+		if def.Transport != "" && def.Transport != TransportHTTP {
+			return fmt.Errorf("format %q only applies to the %s transport", def.Format, TransportHTTP)
+		}
+		return nil
+	case WebhookFormatNDJSON:
+		return nil
+	default:
+		return fmt.Errorf("invalid webhook format %q, must be one of: %q, %q, %q, %q, %q",
+			def.Format, WebhookFormatMultipart, WebhookFormatXML, WebhookFormatRaw, WebhookFormatHealthcheck, WebhookFormatNDJSON)
+	}
+}
+
+// webhookTypeOrder ranks webhooks of equal priority by type
+var webhookTypeOrder = map[string]int{
+	WebhookTypeError: 0,
+	WebhookTypeAll:   1,
+	WebhookTypeInfo:  2,
+}
+
+// webhookRunsBefore orders webhooks by priority, then by type
+func webhookRunsBefore(a, b *WebhookDefinition) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	return webhookTypeOrder[a.Type] < webhookTypeOrder[b.Type]
+}
+
 // validateWebhookType validates the webhook type field
 func validateWebhookType(webhookType string) error {
 	switch webhookType {
@@ -97,50 +576,94 @@ func validateWebhookType(webhookType string) error {
 	}
 }
 
-// LoadWebhookMiddlewares loads webhook configurations from a file and returns middlewares and registry
-func LoadWebhookMiddlewares(config *WebhookFileConfig, logger core.Logger) ([]core.Middleware, *WebhookRegistry) {
+// LoadWebhookMiddlewares loads webhook configurations from the config file and
+// the inline [webhook "name"] sections and returns middlewares and registry
+func LoadWebhookMiddlewares(config *WebhookFileConfig, sections map[string]*WebhookSection, logger core.Logger) ([]core.Middleware, *WebhookRegistry) {
 	// Create registry
 	registry := NewWebhookRegistry()
 
-	// Determine config file path - check environment variable first, then config, then default
-	configPath := os.Getenv("WEBHOOK_CONFIG")
-	if configPath == "" {
-		configPath = config.WebhookConfigFile
+	webhookDefs, enabled := loadWebhookConfigFile(config, logger)
+	if value := os.Getenv(webhooksEnabledEnv); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			logger.Errorf("Invalid %s value %q, expected true or false", webhooksEnabledEnv, value)
+		} else {
+			enabled = parsed
+		}
 	}
-	if configPath == "" {
-		configPath = defaultWebhookConfigPath
+	registry.disabled = !enabled
+
+	inlineDefs, err := parseWebhookSections(sections)
+	if err != nil {
+		logger.Errorf("Failed to parse webhook sections: %v", err)
+	} else {
+		webhookDefs = mergeWebhookDefinitions(webhookDefs, inlineDefs, logger)
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		logger.Debugf("Webhook config file not found at %q, skipping webhook middleware", configPath)
+	if len(webhookDefs) == 0 {
+		logger.Debugf("No webhooks defined")
 		return nil, registry
 	}
 
-	// Read and parse the config file
-	webhookDefs, err := parseWebhookConfigFile(configPath)
-	if err != nil {
-		logger.Errorf("Failed to parse webhook config file %q: %v", configPath, err)
-		return nil, registry
+	// Reject static URLs outside the allowlist now, templated ones are
+	// checked on every send. Commands are never templated and are only
+	// checked here.
+	registry.allowedHosts = newHostAllowlist(config.WebhookAllowedHosts)
+	allowedCommands := newCommandAllowlist(config.WebhookAllowedCommands)
+	allowedDefs := webhookDefs[:0]
+	for _, def := range webhookDefs {
+		allowed := true
+		if def.Transport == TransportExec && !allowedCommands.allows(def.Command[0]) {
+			logger.Errorf("Webhook %q rejected: command %q is not in webhook-allowed-commands", def.Name, def.Command[0])
+			continue
+		}
+		for _, url := range staticEndpoints(def) {
+			if ok, host := registry.allowedHosts.allows(url); !ok {
+				logger.Errorf("Webhook %q rejected: host %q is not in webhook-allowed-hosts", def.Name, host)
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			allowedDefs = append(allowedDefs, def)
+		}
 	}
+	webhookDefs = allowedDefs
 
-	if len(webhookDefs) == 0 {
-		logger.Debugf("No webhooks defined in config file %q", configPath)
-		return nil, registry
+	// Force-deactivate webhooks muted through the environment
+	disabled := disabledWebhookNames()
+	for i := range webhookDefs {
+		if disabled[webhookDefs[i].Name] && webhookDefs[i].Active {
+			webhookDefs[i].Active = false
+			logger.Noticef("Webhook %q disabled by %s", webhookDefs[i].Name, disableWebhooksEnv)
+		}
 	}
 
-	// Sort by priority (lower number = higher priority = runs first)
-	sort.Slice(webhookDefs, func(i, j int) bool {
-		return webhookDefs[i].Priority < webhookDefs[j].Priority
+	// Execution order: by priority, lower numbers first. Within equal
+	// priority "error" webhooks come before "all" and "all" before "info", so
+	// failure alerts go out ahead of notes, and remaining ties keep the order
+	// of the config file followed by the [webhook] sections, sorted by name.
+	sort.SliceStable(webhookDefs, func(i, j int) bool {
+		return webhookRunsBefore(&webhookDefs[i], &webhookDefs[j])
 	})
 
+	// Register every webhook even when disabled, so per-job references
+	// still validate
+	if registry.disabled {
+		for _, def := range webhookDefs {
+			registry.Register(def)
+		}
+		logger.Warningf("All webhooks are DISABLED (%s or \"enabled\": false), no webhook will be sent", webhooksEnabledEnv)
+		return nil, registry
+	}
+
 	// Create middlewares from definitions and register them
 	middlewares := make([]core.Middleware, 0, len(webhookDefs))
 	for _, def := range webhookDefs {
 		// Register webhook in registry
 		registry.Register(def)
 
-		middleware, err := NewWebhookFromDefinition(def, logger)
+		middleware, err := registry.webhook(def.Name, logger)
 		if err != nil {
 			logger.Errorf("Failed to create webhook middleware %q: %v", def.Name, err)
 			continue
@@ -150,49 +673,363 @@ func LoadWebhookMiddlewares(config *WebhookFileConfig, logger core.Logger) ([]co
 			def.Name, def.Type, def.Active, def.Priority)
 	}
 
+	if config.WebhookSelfTest {
+		registry.SelfTest(logger)
+	}
+
 	return middlewares, registry
 }
 
+// loadWebhookConfigFile returns the definitions of the webhook config file,
+// or none if the file does not exist or is invalid, and whether webhooks are
+// enabled by it
+func loadWebhookConfigFile(config *WebhookFileConfig, logger core.Logger) ([]WebhookDefinition, bool) {
+	configPath := config.configFilePath()
+	if absPath, err := filepath.Abs(configPath); err == nil {
+		configPath = absPath
+	}
+
+	// Check if file exists
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		logger.Debugf("Webhook config file not found at %q, skipping", configPath)
+		return nil, true
+	}
+
+	// Read and parse the config file
+	logger.Noticef("Loading webhook config file %q", configPath)
+	file, err := readWebhooksFile(configPath)
+	if err != nil {
+		logger.Errorf("Failed to load webhook config file %q: %v", configPath, err)
+		return nil, true
+	}
+
+	if len(file.Webhooks) == 0 {
+		logger.Debugf("No webhooks defined in config file %q", configPath)
+	}
+	return file.Webhooks, file.Enabled == nil || *file.Enabled
+}
+
+// disabledWebhookNames returns the webhook names listed in the disable env var
+func disabledWebhookNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv(disableWebhooksEnv), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
 // parseWebhookConfigFile reads and parses the webhook configuration file
 func parseWebhookConfigFile(path string) ([]WebhookDefinition, error) {
-	data, err := os.ReadFile(path)
+	file, err := readWebhooksFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return nil, err
 	}
+	return file.Webhooks, nil
+}
+
+// readWebhooksFile reads the webhook configuration file, validates its
+// definitions and loads its template partials
+func readWebhooksFile(path string) (*WebhooksFile, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = expandConfigEnv(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reject unknown fields so misspelled keys are not silently ignored
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
 
 	var config WebhooksFile
-	if err := json.Unmarshal(data, &config); err != nil {
+	if err := decoder.Decode(&config); err != nil {
 		return nil, fmt.Errorf("failed to parse JSON: %w", err)
 	}
 
 	// Validate webhook definitions
-	for i, def := range config.Webhooks {
-		if def.URL == "" {
+	for i := range config.Webhooks {
+		if config.Defaults != nil {
+			config.Defaults.apply(&config.Webhooks[i])
+		}
+		mergeDefaultHeaders(&config.Webhooks[i], config.DefaultHeaders)
+
+		// SNS webhooks default to the regional endpoint
+		if config.Webhooks[i].URL == "" && len(config.Webhooks[i].URLs) == 0 && config.Webhooks[i].Transport != TransportSNS && config.Webhooks[i].Transport != TransportExec {
 			return nil, fmt.Errorf("webhook at index %d is missing required 'url' field", i)
 		}
 
-		// Validate type field (REQUIRED)
-		if def.Type == "" {
-			return nil, fmt.Errorf("webhook %q is missing required 'type' field", def.Name)
+		if err := prepareWebhookDefinition(&config.Webhooks[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	templateDir := config.TemplateDir
+	if templateDir != "" && !filepath.IsAbs(templateDir) {
+		templateDir = filepath.Join(filepath.Dir(path), templateDir)
+	}
+	if err := loadWebhookPartials(templateDir, config.Partials); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// readConfigFile reads the webhook configuration file, explaining the usual
+// misconfigurations instead of returning the bare system error
+func readConfigFile(path string) ([]byte, error) {
+	// Docker creates a directory when a mounted file is missing on the host
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("%q is a directory, not a file; check the path, or the mount if it is a Docker volume", path)
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return nil, fmt.Errorf("permission denied reading %q, make it readable by the user running Ofelia", path)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	case len(bytes.TrimSpace(data)) == 0:
+		return nil, fmt.Errorf("%q is empty, it must hold a JSON object such as {\"webhooks\": []}", path)
+	}
+
+	return data, nil
+}
+
+// parseWebhookSections maps the inline [webhook "name"] sections to
+// definitions, ordered by name
+func parseWebhookSections(sections map[string]*WebhookSection) ([]WebhookDefinition, error) {
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]WebhookDefinition, 0, len(names))
+	for _, name := range names {
+		def, err := sections[name].definition(name)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %q: %w", name, err)
+		}
+
+		if def.URL == "" {
+			return nil, fmt.Errorf("webhook %q is missing required 'url' field", name)
+		}
+
+		if err := prepareWebhookDefinition(&def); err != nil {
+			return nil, err
+		}
+		defs = append(defs, def)
+	}
+
+	return defs, nil
+}
+
+// prepareWebhookDefinition validates a definition and fills in its defaults
+func prepareWebhookDefinition(def *WebhookDefinition) error {
+	// Validate type field (REQUIRED)
+	if def.Type == "" {
+		return fmt.Errorf("webhook %q is missing required 'type' field", def.Name)
+	}
+	if err := validateWebhookType(def.Type); err != nil {
+		return fmt.Errorf("webhook %q has invalid type: %w", def.Name, err)
+	}
+
+	if err := applyOutcomeBodies(def); err != nil {
+		return fmt.Errorf("webhook %q: %w", def.Name, err)
+	}
+	if err := validateWebhookFormat(*def); err != nil {
+		return fmt.Errorf("webhook %q: %w", def.Name, err)
+	}
+
+	if err := validateBodyByStatus(*def); err != nil {
+		return fmt.Errorf("webhook %q: %w", def.Name, err)
+	}
+
+	if def.Retry != nil && def.Retry.Count < 0 {
+		return fmt.Errorf("webhook %q has invalid retry count %d, must be 0 (no retries) or more", def.Name, def.Retry.Count)
+	}
+	if def.RetryOnError != nil && def.RetryOnError.Count < 0 {
+		return fmt.Errorf("webhook %q has invalid retryOnError count %d, must be 0 (no retries) or more", def.Name, def.RetryOnError.Count)
+	}
+	if def.RetryOnSuccess != nil && def.RetryOnSuccess.Count < 0 {
+		return fmt.Errorf("webhook %q has invalid retryOnSuccess count %d, must be 0 (no retries) or more", def.Name, def.RetryOnSuccess.Count)
+	}
+
+	if _, err := parseTLSVersion(def.MinTLSVersion); err != nil {
+		return fmt.Errorf("webhook %q: %w", def.Name, err)
+	}
+
+	if def.MaxConcurrent < 0 {
+		return fmt.Errorf("webhook %q has invalid maxConcurrent %d, must be 0 (no limit) or more", def.Name, def.MaxConcurrent)
+	}
+	if def.MaxResponseBytes < 0 {
+		return fmt.Errorf("webhook %q has invalid maxResponseBytes %d, must be 0 (default) or more", def.Name, def.MaxResponseBytes)
+	}
+	if def.ChunkSize < 0 {
+		return fmt.Errorf("webhook %q has invalid chunkSize %d, must be 0 (no chunks) or more", def.Name, def.ChunkSize)
+	}
+	if def.ChunkSize > 0 && def.Format == WebhookFormatMultipart {
+		return fmt.Errorf("webhook %q: chunkSize cannot be used with format %q", def.Name, def.Format)
+	}
+	if def.Spool != nil {
+		if def.Spool.Dir == "" {
+			return fmt.Errorf("webhook %q: spool requires a dir", def.Name)
+		}
+		if def.Spool.MaxEntries < 0 {
+			return fmt.Errorf("webhook %q has invalid spool maxEntries %d, must be 0 (default) or more", def.Name, def.Spool.MaxEntries)
+		}
+		if _, err := spoolDirName(def.Name); err != nil {
+			return err
+		}
+		// Credentials are not spooled and must be known again when sending
+		for key, value := range def.Headers {
+			if isSpoolSecretHeader(key) && strings.Contains(value, "{{") {
+				return fmt.Errorf("webhook %q: header %q cannot be templated with spool, it is not written to disk", def.Name, key)
+			}
+		}
+	}
+	if def.MaxOutputBytes < 0 {
+		return fmt.Errorf("webhook %q has invalid maxOutputBytes %d, must be 0 (no limit) or more", def.Name, def.MaxOutputBytes)
+	}
+	switch def.OverflowPolicy {
+	case "", OverflowBuffer, OverflowDrop, OverflowBlock:
+	default:
+		return fmt.Errorf("webhook %q has invalid overflow policy %q, must be one of: %q, %q, %q",
+			def.Name, def.OverflowPolicy, OverflowBuffer, OverflowDrop, OverflowBlock)
+	}
+
+	switch def.MissingBodyFile {
+	case "", MissingBodyFileSkip, MissingBodyFileError:
+	default:
+		return fmt.Errorf("webhook %q has invalid missingBodyFile %q, must be one of: %q, %q",
+			def.Name, def.MissingBodyFile, MissingBodyFileSkip, MissingBodyFileError)
+	}
+
+	if len(def.URLs) > 0 {
+		if def.URL != "" {
+			return fmt.Errorf("webhook %q: url and urls cannot be used together", def.Name)
 		}
-		if err := validateWebhookType(def.Type); err != nil {
-			return nil, fmt.Errorf("webhook %q has invalid type: %w", def.Name, err)
+		if def.Transport != "" && def.Transport != TransportHTTP {
+			return fmt.Errorf("webhook %q: urls only apply to the %s transport", def.Name, TransportHTTP)
 		}
+		for _, url := range def.URLs {
+			if url == "" {
+				return fmt.Errorf("webhook %q has an empty entry in urls", def.Name)
+			}
+		}
+	}
+	switch def.LoadBalance {
+	case "":
+	case LoadBalanceRoundRobin, LoadBalanceRandom:
+		if len(def.URLs) == 0 {
+			return fmt.Errorf("webhook %q: loadBalance requires urls", def.Name)
+		}
+	default:
+		return fmt.Errorf("webhook %q has invalid loadBalance %q, must be one of: %q, %q",
+			def.Name, def.LoadBalance, LoadBalanceRoundRobin, LoadBalanceRandom)
+	}
+
+	for from, to := range def.ResolveHost {
+		if _, _, err := net.SplitHostPort(from); err != nil {
+			return fmt.Errorf("webhook %q: invalid resolveHost entry %q, must be host:port", def.Name, from)
+		}
+		host, _, err := net.SplitHostPort(to)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("webhook %q: invalid resolveHost address %q for %q, must be ip:port", def.Name, to, from)
+		}
+	}
+	if len(def.ResolveHost) > 0 && (def.Transport == TransportNATS || def.Transport == TransportExec) {
+		return fmt.Errorf("webhook %q: resolveHost does not apply to the %s transport", def.Name, def.Transport)
+	}
 
-		// Set defaults
-		if def.Method == "" {
-			config.Webhooks[i].Method = "POST"
+	if def.OAuth2 != nil {
+		if def.Transport != "" && def.Transport != TransportHTTP {
+			return fmt.Errorf("webhook %q: oauth2 only applies to the %s transport", def.Name, TransportHTTP)
 		}
-		if def.Timeout == 0 {
-			config.Webhooks[i].Timeout = int(defaultTimeout.Seconds())
+		if def.OAuth2.TokenURL == "" || def.OAuth2.ClientID == "" {
+			return fmt.Errorf("webhook %q: oauth2 requires a tokenURL and a clientID", def.Name)
 		}
-		if def.Headers == nil {
-			config.Webhooks[i].Headers = make(map[string]string)
+		if def.TokenFile != "" {
+			return fmt.Errorf("webhook %q: oauth2 cannot be used with tokenFile", def.Name)
 		}
-		// Note: Active defaults to false (zero value)
 	}
 
-	return config.Webhooks, nil
+	if (len(def.SuccessCodes) > 0 || len(def.SuccessCodeRanges) > 0) && def.Transport != "" && def.Transport != TransportHTTP {
+		return fmt.Errorf("webhook %q: successCodes only apply to the %s transport", def.Name, TransportHTTP)
+	}
+
+	switch def.Transport {
+	case "", TransportHTTP:
+	case TransportNATS:
+		if def.Subject == "" {
+			return fmt.Errorf("webhook %q uses the %s transport and needs a subject", def.Name, def.Transport)
+		}
+	case TransportSNS:
+		if def.TopicARN == "" {
+			return fmt.Errorf("webhook %q uses the %s transport and needs a topicArn", def.Name, def.Transport)
+		}
+		if def.Region == "" && snsRegion(def.TopicARN) == "" {
+			return fmt.Errorf("webhook %q: cannot tell the region of topic %q, set region", def.Name, def.TopicARN)
+		}
+	case TransportExec:
+		if len(def.Command) == 0 || def.Command[0] == "" {
+			return fmt.Errorf("webhook %q uses the %s transport and needs a command", def.Name, def.Transport)
+		}
+	default:
+		return fmt.Errorf("webhook %q has invalid transport %q, must be one of: %q, %q, %q, %q",
+			def.Name, def.Transport, TransportHTTP, TransportNATS, TransportSNS, TransportExec)
+	}
+	if len(def.Command) > 0 && def.Transport != TransportExec {
+		return fmt.Errorf("webhook %q: command only applies to the %s transport", def.Name, TransportExec)
+	}
+
+	if err := validateRedactFields(def.RedactFields); err != nil {
+		return fmt.Errorf("webhook %q: %w", def.Name, err)
+	}
+
+	// Set defaults
+	if def.Method == "" {
+		def.Method = "POST"
+	} else if !strings.Contains(def.Method, "{{") {
+		// Templated methods are validated after rendering
+		if _, err := normalizeHTTPMethod(def.Method); err != nil {
+			return fmt.Errorf("webhook %q: %w", def.Name, err)
+		}
+	}
+	if def.Timeout == 0 {
+		def.Timeout = int(defaultTimeout.Seconds())
+	}
+	if def.Headers == nil {
+		def.Headers = make(map[string]string)
+	}
+	// Note: Active defaults to false (zero value)
+
+	return nil
+}
+
+// mergeWebhookDefinitions adds the inline definitions to the ones from the
+// config file, an inline webhook replaces a file webhook with the same name
+func mergeWebhookDefinitions(fileDefs, inlineDefs []WebhookDefinition, logger core.Logger) []WebhookDefinition {
+	merged := fileDefs
+	for _, def := range inlineDefs {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == def.Name {
+				logger.Warningf("Webhook %q defined in both the webhook config file and the main config, using the main config", def.Name)
+				merged[i] = def
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, def)
+		}
+	}
+	return merged
 }
 
 // WebhookConfig is the per-job webhook configuration
@@ -217,53 +1054,134 @@ func NewWebhookFromConfig(c *WebhookConfig, registry *WebhookRegistry, logger co
 		return nil, nil
 	}
 
-	// Validate and collect error webhooks
-	errorWebhooks := make([]*WebhookDefinition, 0, len(errorNames))
-	for _, name := range errorNames {
-		def, ok := registry.Get(name)
-		if !ok {
-			return nil, fmt.Errorf("webhook-error-names references unknown webhook %q", name)
+	// Validate and collect error and info webhooks
+	errorWebhooks, errorTemplates, err := collectWebhookReferences(errorNames, true, registry, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	infoWebhooks, infoTemplates, err := collectWebhookReferences(infoNames, false, registry, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if registry.disabled {
+		return nil, nil
+	}
+
+	return &PerJobWebhook{
+		errorWebhooks:  errorWebhooks,
+		infoWebhooks:   infoWebhooks,
+		errorTemplates: errorTemplates,
+		infoTemplates:  infoTemplates,
+		registry:       registry,
+		logger:         logger,
+	}, nil
+}
+
+// collectWebhookReferences validates the referenced webhook names against the
+// registry. Templated names can only be resolved per execution, so they are
+// returned as-is to be resolved at send time.
+func collectWebhookReferences(names []string, onError bool, registry *WebhookRegistry, logger core.Logger) ([]*WebhookDefinition, []string, error) {
+	webhooks := make([]*WebhookDefinition, 0, len(names))
+	var templates []string
+
+	for _, name := range names {
+		if strings.Contains(name, "{{") {
+			templates = append(templates, name)
+			continue
 		}
 
-		// Validate type
-		if def.Type != WebhookTypeError && def.Type != WebhookTypeAll {
-			return nil, fmt.Errorf("webhook %q has type %q but is referenced in webhook-error-names (must be %q or %q)",
-				name, def.Type, WebhookTypeError, WebhookTypeAll)
+		def, err := lookupWebhookReference(name, onError, registry)
+		if err != nil {
+			return nil, nil, err
 		}
 
 		if !def.Active {
 			logger.Noticef("Webhook %q is inactive and will not fire", name)
 		}
 
-		errorWebhooks = append(errorWebhooks, def)
+		webhooks = append(webhooks, def)
 	}
 
-	// Validate and collect info webhooks
-	infoWebhooks := make([]*WebhookDefinition, 0, len(infoNames))
-	for _, name := range infoNames {
-		def, ok := registry.Get(name)
-		if !ok {
-			return nil, fmt.Errorf("webhook-info-names references unknown webhook %q", name)
-		}
+	return webhooks, templates, nil
+}
 
-		// Validate type
-		if def.Type != WebhookTypeInfo && def.Type != WebhookTypeAll {
-			return nil, fmt.Errorf("webhook %q has type %q but is referenced in webhook-info-names (must be %q or %q)",
-				name, def.Type, WebhookTypeInfo, WebhookTypeAll)
-		}
+// lookupWebhookReference returns the registered webhook a per-job list refers
+// to, checking its type is compatible with the list
+func lookupWebhookReference(name string, onError bool, registry *WebhookRegistry) (*WebhookDefinition, error) {
+	def, ok := registry.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("%s references unknown webhook %q", webhookListName(onError), name)
+	}
 
-		if !def.Active {
-			logger.Noticef("Webhook %q is inactive and will not fire", name)
+	// Validate type
+	if err := checkWebhookReference(def, onError); err != nil {
+		return nil, err
+	}
+
+	return def, nil
+}
+
+// ValidateWebhookReferences checks the per-job webhook references of every job
+// at once, so a broken reference fails at startup with all problems listed
+// instead of one at a time. jobs maps a job label to its webhook config.
+// Templated names are only known per execution and are not checked.
+func ValidateWebhookReferences(jobs map[string]*WebhookConfig, registry *WebhookRegistry) error {
+	labels := make([]string, 0, len(jobs))
+	for label := range jobs {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var problems []string
+	for _, label := range labels {
+		config := jobs[label]
+		for _, onError := range []bool{true, false} {
+			names := config.WebhookInfoNames
+			if onError {
+				names = config.WebhookErrorNames
+			}
+
+			for _, name := range parseWebhookNames(names) {
+				if strings.Contains(name, "{{") {
+					continue
+				}
+				if _, err := lookupWebhookReference(name, onError, registry); err != nil {
+					problems = append(problems, fmt.Sprintf("job %s: %v", label, err))
+				}
+			}
 		}
+	}
 
-		infoWebhooks = append(infoWebhooks, def)
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid webhook references:\n  %s", strings.Join(problems, "\n  "))
 	}
+	return nil
+}
 
-	return &PerJobWebhook{
-		errorWebhooks: errorWebhooks,
-		infoWebhooks:  infoWebhooks,
-		logger:        logger,
-	}, nil
+// checkWebhookReference validates that a webhook type is compatible with the
+// per-job list it is referenced from
+func checkWebhookReference(def *WebhookDefinition, onError bool) error {
+	listType := WebhookTypeInfo
+	if onError {
+		listType = WebhookTypeError
+	}
+
+	if def.Type != listType && def.Type != WebhookTypeAll {
+		return fmt.Errorf("webhook %q has type %q but is referenced in %s (must be %q or %q)",
+			def.Name, def.Type, webhookListName(onError), listType, WebhookTypeAll)
+	}
+
+	return nil
+}
+
+// webhookListName returns the per-job config key of the error or info list
+func webhookListName(onError bool) string {
+	if onError {
+		return "webhook-error-names"
+	}
+	return "webhook-info-names"
 }
 
 // parseWebhookNames parses comma-separated or JSON array of webhook names
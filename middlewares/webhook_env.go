@@ -0,0 +1,87 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// configEnvPattern matches ${VAR} and ${VAR:-default} in config file strings,
+// and $${ which escapes a literal ${. Bare $VAR is left alone, templates use
+// it for their own variables.
+var configEnvPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandConfigEnv replaces environment variable references in the string
+// values of the webhook config file, so one file can serve several
+// environments
+func expandConfigEnv(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte("${")) {
+		return data, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var config interface{}
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	expanded, err := expandEnvValue(config)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(expanded)
+}
+
+// expandEnvValue expands the strings of a decoded JSON value
+func expandEnvValue(value interface{}) (interface{}, error) {
+	var err error
+	switch v := value.(type) {
+	case string:
+		return expandEnvString(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			if v[key], err = expandEnvValue(item); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			if v[i], err = expandEnvValue(item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+// expandEnvString expands the references in a single string. A default is
+// used when the variable is unset or empty, as in the shell; an unset
+// variable without default is an error.
+func expandEnvString(s string) (string, error) {
+	var missing string
+	result := configEnvPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+
+		groups := configEnvPattern.FindStringSubmatch(match)
+		name, hasDefault, fallback := groups[1], groups[2] != "", groups[3]
+		value, ok := os.LookupEnv(name)
+		switch {
+		case hasDefault && value == "":
+			return fallback
+		case !ok && missing == "":
+			missing = name
+		}
+		return value
+	})
+
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is not set, set it or use ${%s:-default}", missing, missing)
+	}
+	return result, nil
+}
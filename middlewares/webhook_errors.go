@@ -0,0 +1,53 @@
+package middlewares
+
+import "fmt"
+
+// HTTPStatusError is returned when the endpoint answers with a status outside
+// its success codes, any non-2xx by default, or when SuccessFunc rejects the
+// response. Body holds the start of the response body for context.
+type HTTPStatusError struct {
+	StatusCode int
+	Body       string
+	BodyErr    error // reading Body failed, e.g. it did not end within the timeout
+	Rejected   bool  // rejected by SuccessFunc, whatever the status code
+}
+
+func (e *HTTPStatusError) Error() string {
+	var incomplete string
+	if e.BodyErr != nil {
+		incomplete = fmt.Sprintf(" (incomplete: %v)", e.BodyErr)
+	}
+	if e.Rejected {
+		return fmt.Sprintf("response rejected by SuccessFunc, status code: %d, body: %s%s", e.StatusCode, e.Body, incomplete)
+	}
+	return fmt.Sprintf("non-2xx status code: %d, body: %s%s", e.StatusCode, e.Body, incomplete)
+}
+
+// TemplateError is returned when rendering one of the webhook templates fails.
+// Which names the template, e.g. "URL" or `header "Authorization"`.
+type TemplateError struct {
+	Which string
+	Err   error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("failed to execute %s template: %v", e.Which, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// TransportError is returned when a request could not be delivered at all,
+// such as a connection failure or timeout, so no response was received
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("request failed: %v", e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
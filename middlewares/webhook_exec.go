@@ -0,0 +1,144 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TransportExec = "exec"
+
+// execTransport pipes the body to the stdin of a local command. Headers are
+// passed as environment variables, so templated headers hand job data to
+// the command.
+type execTransport struct {
+	command          []string
+	timeout          time.Duration
+	maxResponseBytes int // output bytes kept for the error of a failed run
+}
+
+func (t *execTransport) send(ctx context.Context, r *WebhookRequest) (*webhookResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, t.command[0], t.command[1:]...)
+	cmd.Stdin = bytes.NewReader(r.Body)
+	cmd.Env = append(os.Environ(), execEnv(r)...)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			return nil, fmt.Errorf("%w: %v", errInvalidRequest, err)
+		}
+
+		limit := t.maxResponseBytes
+		if limit == 0 {
+			limit = defaultMaxResponseBytes
+		}
+		out := output.Bytes()
+		if len(out) > limit {
+			out = out[:limit]
+		}
+		return &webhookResponse{}, fmt.Errorf("command %s failed: %w, output: %s", t.command[0], err, strings.TrimSpace(string(out)))
+	}
+	return &webhookResponse{}, nil
+}
+
+// execEnv returns the environment variables describing a request. Header
+// names are upper-cased with any other character than letters and digits
+// replaced by "_", so "X-Job-Name" becomes X_JOB_NAME.
+func execEnv(r *WebhookRequest) []string {
+	env := []string{"OFELIA_WEBHOOK=" + r.Webhook}
+	if r.Subject != "" {
+		env = append(env, "OFELIA_SUBJECT="+r.Subject)
+	}
+	env = append(env, r.env...)
+	for name, value := range r.Headers {
+		env = append(env, execEnvName(name)+"="+value)
+	}
+	return env
+}
+
+// execDataEnv returns the OFELIA_* environment variables describing the
+// execution, or the batch, a request was rendered from
+func execDataEnv(data interface{}) []string {
+	switch d := data.(type) {
+	case *WebhookTemplateData:
+		return []string{
+			"OFELIA_JOB_NAME=" + d.JobName,
+			"OFELIA_JOB_SCHEDULE=" + d.JobSchedule,
+			"OFELIA_JOB_COMMAND=" + d.JobCommand,
+			"OFELIA_EXECUTION_ID=" + d.ExecutionID,
+			"OFELIA_STATUS=" + executionStatus(d),
+			"OFELIA_FAILED=" + strconv.FormatBool(d.Failed),
+			"OFELIA_SKIPPED=" + strconv.FormatBool(d.Skipped),
+			"OFELIA_ERROR=" + d.Error,
+			"OFELIA_DURATION=" + d.Duration,
+			"OFELIA_DURATION_SECONDS=" + strconv.FormatFloat(d.DurationSeconds, 'f', -1, 64),
+			"OFELIA_START_TIME=" + d.StartTimeISO,
+			"OFELIA_END_TIME=" + d.EndTimeISO,
+			"OFELIA_TRIGGERED_BY=" + d.TriggeredBy,
+			"OFELIA_HOSTNAME=" + d.Hostname,
+		}
+	case *WebhookBatchData:
+		return []string{
+			"OFELIA_BATCH=" + d.Name,
+			"OFELIA_BATCH_COUNT=" + strconv.Itoa(d.Count),
+			"OFELIA_BATCH_FAILED=" + strconv.Itoa(d.Failed),
+			"OFELIA_BATCH_SKIPPED=" + strconv.Itoa(d.Skipped),
+			"OFELIA_BATCH_SUCCEEDED=" + strconv.Itoa(d.Succeeded),
+			"OFELIA_HOSTNAME=" + d.Hostname,
+		}
+	}
+	return nil
+}
+
+func execEnvName(header string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, header)
+}
+
+// commandAllowlist lists the commands exec webhooks may run, matched on the
+// cleaned path of the executable. An empty list allows none.
+type commandAllowlist []string
+
+func newCommandAllowlist(commands []string) commandAllowlist {
+	var allowlist commandAllowlist
+	for _, command := range commands {
+		for _, entry := range strings.Split(command, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				allowlist = append(allowlist, filepath.Clean(entry))
+			}
+		}
+	}
+	return allowlist
+}
+
+// allows reports whether the executable may be run
+func (a commandAllowlist) allows(executable string) bool {
+	executable = filepath.Clean(executable)
+	for _, entry := range a {
+		if entry == executable {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mcuadros/ofelia/core"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookExec struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookExec{})
+
+func (s *SuiteWebhookExec) TestStdin(c *C) {
+	out := filepath.Join(c.MkDir(), "body")
+
+	def := WebhookDefinition{
+		Name:      "script",
+		Type:      WebhookTypeAll,
+		Active:    true,
+		Transport: TransportExec,
+		Command:   []string{"/bin/sh", "-c", `cat > "$0.tmp"; echo "$X_JOB_NAME $OFELIA_WEBHOOK" > "$0.env"; mv "$0.tmp" "$0"`, out},
+		Headers:   map[string]string{"X-Job-Name": "{{.JobName}}"},
+		Body:      `{"job": "{{.JobName}}", "failed": {{.Failed}}}`,
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	deadline := time.Now().Add(2 * time.Second)
+	body, err := os.ReadFile(out)
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		body, err = os.ReadFile(out)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, `{"job": "backup", "failed": false}`)
+
+	env, err := os.ReadFile(out + ".env")
+	c.Assert(err, IsNil)
+	c.Assert(string(env), Equals, "backup script\n")
+}
+
+func (s *SuiteWebhookExec) TestExecutionEnv(c *C) {
+	out := filepath.Join(c.MkDir(), "env")
+
+	def := WebhookDefinition{
+		Name:      "script",
+		Type:      WebhookTypeAll,
+		Active:    true,
+		Transport: TransportExec,
+		Command:   []string{"/bin/sh", "-c", `printf '%s\n' "$OFELIA_JOB_NAME" "$OFELIA_STATUS" "$OFELIA_FAILED" "$OFELIA_ERROR" "$OFELIA_DURATION" "$OFELIA_TRIGGERED_BY" > "$0.tmp"; mv "$0.tmp" "$0"`, out},
+		Body:      "{{.JobName}}",
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(errors.New("disk full"))
+	s.ctx.Execution.Duration = 90 * time.Second
+	s.ctx.Execution.TriggeredBy = core.TriggerManual
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	deadline := time.Now().Add(2 * time.Second)
+	env, err := os.ReadFile(out)
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		env, err = os.ReadFile(out)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(string(env), Equals, "backup\nerror\ntrue\ndisk full\n1m30s\nmanual\n")
+}
+
+func (s *SuiteWebhookExec) TestBatchEnv(c *C) {
+	env := execDataEnv(&WebhookBatchData{Name: "digest", Count: 3, Failed: 1, Succeeded: 2, Hostname: "host"})
+	c.Assert(env, DeepEquals, []string{
+		"OFELIA_BATCH=digest",
+		"OFELIA_BATCH_COUNT=3",
+		"OFELIA_BATCH_FAILED=1",
+		"OFELIA_BATCH_SKIPPED=0",
+		"OFELIA_BATCH_SUCCEEDED=2",
+		"OFELIA_HOSTNAME=host",
+	})
+}
+
+func (s *SuiteWebhookExec) TestFailure(c *C) {
+	transport := &execTransport{command: []string{"/bin/sh", "-c", "echo disk full >&2; exit 3"}, timeout: time.Second}
+	_, err := transport.send(context.Background(), &WebhookRequest{Body: []byte("x")})
+	c.Assert(err, ErrorMatches, "command /bin/sh failed: exit status 3, output: disk full")
+	c.Assert(errors.Is(err, errInvalidRequest), Equals, false)
+
+	// A missing executable is not retried
+	transport = &execTransport{command: []string{"/nonexistent/notify"}, timeout: time.Second}
+	_, err = transport.send(context.Background(), &WebhookRequest{})
+	c.Assert(errors.Is(err, errInvalidRequest), Equals, true)
+}
+
+func (s *SuiteWebhookExec) TestValidation(c *C) {
+	def := WebhookDefinition{Name: "script", Type: WebhookTypeAll, Transport: TransportExec}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `webhook "script" uses the exec transport and needs a command`)
+
+	def = WebhookDefinition{Name: "script", Type: WebhookTypeAll, URL: "http://example.com", Command: []string{"/bin/true"}}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `webhook "script": command only applies to the exec transport`)
+}
+
+func (s *SuiteWebhookExec) TestAllowedCommands(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "notify", "type": "all", "transport": "exec", "command": ["/usr/bin/notify-send", "Ofelia"]},
+			{"name": "logger", "type": "all", "transport": "exec", "command": ["/usr/bin/logger"]}
+		]
+	}`)
+	defer os.Remove(path)
+
+	logger := &recordingLogger{}
+	_, registry := LoadWebhookMiddlewares(&WebhookFileConfig{
+		WebhookConfigFile:      path,
+		WebhookAllowedCommands: []string{"/usr/local/bin/alert, /usr/bin/../bin/notify-send"},
+	}, nil, logger)
+	c.Assert(logger.errors, DeepEquals, []string{`Webhook "logger" rejected: command "/usr/bin/logger" is not in webhook-allowed-commands`})
+	_, ok := registry.Get("notify")
+	c.Assert(ok, Equals, true)
+	_, ok = registry.Get("logger")
+	c.Assert(ok, Equals, false)
+
+	// Exec webhooks are refused unless commands are allowed
+	logger = &recordingLogger{}
+	LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path}, nil, logger)
+	c.Assert(logger.errors, HasLen, 2)
+}
@@ -0,0 +1,251 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// MultipartConfig maps templates to the form fields and file parts of a
+// multipart/form-data body
+type MultipartConfig struct {
+	Fields map[string]string `json:"fields"`
+	Files  []MultipartFile   `json:"files"`
+}
+
+// MultipartFile is a file part whose content is rendered from a template,
+// e.g. "{{.Stdout}}" to attach the full job log
+type MultipartFile struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	Content     string `json:"content"`
+	ContentType string `json:"contentType"` // defaults to "application/octet-stream"
+}
+
+const defaultMultipartFileContentType = "application/octet-stream"
+
+var multipartQuoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// executeMultipartBody renders a multipart/form-data body, returning it
+// together with its boundary-aware Content-Type
+func (t webhookTemplates) executeMultipartBody(config *MultipartConfig, data interface{}) ([]byte, string, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	// Write fields in a stable order
+	names := make([]string, 0, len(config.Fields))
+	for name := range config.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, err := t.execute(config.Fields[name], data)
+		if err != nil {
+			return nil, "", fmt.Errorf("field %q: %w", name, err)
+		}
+		if err := writer.WriteField(name, value); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for _, file := range config.Files {
+		filename, err := t.execute(file.Filename, data)
+		if err != nil {
+			return nil, "", fmt.Errorf("file %q filename: %w", file.Field, err)
+		}
+
+		content, err := t.execute(file.Content, data)
+		if err != nil {
+			return nil, "", fmt.Errorf("file %q content: %w", file.Field, err)
+		}
+
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = defaultMultipartFileContentType
+		}
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			multipartQuoteEscaper.Replace(file.Field), multipartQuoteEscaper.Replace(filename)))
+		header.Set("Content-Type", contentType)
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write([]byte(content)); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), writer.FormDataContentType(), nil
+}
+
+const (
+	jsonContentType = "application/json"
+	xmlContentType  = "application/xml"
+	textContentType = "text/plain; charset=utf-8"
+)
+
+// formatContentType returns the Content-Type matching a rendered body of the
+// format, used when no Content-Type header is configured. Bodies of the
+// default format get one only when they are a JSON object or array, as string
+// bodies may be plain text that happens to parse, such as 42 or "ok", and raw
+// bodies never do.
+func formatContentType(format string, body []byte) string {
+	switch {
+	case len(body) == 0:
+		return ""
+	case format == WebhookFormatXML:
+		return xmlContentType
+	case format == WebhookFormatNDJSON:
+		return ndjsonContentType
+	case format == WebhookFormatHealthcheck:
+		return textContentType
+	case format == "" && isJSONContainer(body):
+		return jsonContentType
+	}
+	return ""
+}
+
+// isJSONContainer reports whether body is a JSON object or array
+func isJSONContainer(body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return false
+	}
+	return json.Valid(trimmed)
+}
+
+// executeTextBody renders the body as plain text without any validation. An
+// object body is rendered from its JSON encoding, as with the default format.
+func (t webhookTemplates) executeTextBody(body interface{}, data interface{}) ([]byte, error) {
+	text, ok := body.(string)
+	if !ok {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal body: %w", err)
+		}
+		text = string(encoded)
+	}
+
+	result, err := t.execute(text, data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(result), nil
+}
+
+// validateXML checks the rendered body is a well-formed XML document
+func validateXML(body []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	elements := 0
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("template resulted in invalid XML (use html for values that may contain markup): %w", err)
+		}
+		if _, ok := token.(xml.StartElement); ok {
+			elements++
+		}
+	}
+	if elements == 0 {
+		return errors.New("template resulted in invalid XML: no root element")
+	}
+	return nil
+}
+
+const ndjsonContentType = "application/x-ndjson"
+
+// encodeNDJSON puts the rendered JSON body on a single line, or each element
+// on its own line when the body is an array, such as the jobs of a digest
+func encodeNDJSON(body []byte) ([]byte, error) {
+	values := []json.RawMessage{bytes.TrimSpace(body)}
+	if bytes.HasPrefix(values[0], []byte("[")) {
+		values = nil
+		if err := json.Unmarshal(body, &values); err != nil {
+			return nil, fmt.Errorf("template resulted in invalid JSON: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, value := range values {
+		if err := json.Compact(&buf, value); err != nil {
+			return nil, fmt.Errorf("template resulted in invalid JSON: %w", err)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+const (
+	envelopeVersionField = "version"
+	defaultEnvelopeField = "event"
+)
+
+// wrapEnvelope nests a rendered JSON body in the envelope. A body that is not
+// JSON, such as a plain text template, is nested as a string.
+func wrapEnvelope(config *EnvelopeConfig, body []byte) []byte {
+	field := config.Field
+	if field == "" {
+		field = defaultEnvelopeField
+	}
+
+	payload := body
+	if !json.Valid(body) {
+		payload, _ = json.Marshal(string(body))
+	}
+
+	// Marshalling strings cannot fail
+	version, _ := json.Marshal(config.Version)
+	name, _ := json.Marshal(field)
+	return []byte(fmt.Sprintf(`{%q:%s,%s:%s}`, envelopeVersionField, version, name, payload))
+}
+
+// isObjectBody reports whether the body, or every body by status, is a JSON
+// object
+func isObjectBody(body interface{}, byStatus bool) bool {
+	object, ok := body.(map[string]interface{})
+	if !ok || !byStatus {
+		return ok
+	}
+	for _, statusBody := range object {
+		if _, ok := statusBody.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeStdoutJSON merges the rendered object body into the JSON object printed
+// on stdout. Fields of the body win over fields of the same name in stdout.
+func mergeStdoutJSON(body []byte, stdout string) ([]byte, error) {
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(strings.TrimSpace(stdout)), &merged); err != nil || merged == nil {
+		return nil, fmt.Errorf("stdout is not a JSON object: %q", truncateString(60, strings.TrimSpace(stdout)))
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("body is not a JSON object: %w", err)
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return json.Marshal(merged)
+}
@@ -0,0 +1,45 @@
+package middlewares
+
+import (
+	"fmt"
+	neturl "net/url"
+	"strconv"
+	"strings"
+)
+
+// Path suffixes and query parameter of dead man's switch pings, as understood
+// by Healthchecks.io and compatible services
+const (
+	healthcheckFailSuffix    = "/fail"
+	healthcheckStartSuffix   = "/start"
+	healthcheckDurationParam = "duration"
+)
+
+// healthcheckURL turns the base URL of a healthcheck webhook into the ping
+// of an execution: the base itself on success, /fail on failure and /start
+// while the job is still running, with the run time in seconds as a query
+// parameter
+func healthcheckURL(rawURL string, templateData interface{}) (string, error) {
+	data, ok := templateData.(*WebhookTemplateData)
+	if !ok {
+		return rawURL, nil
+	}
+
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+
+	switch {
+	case data.Failed:
+		u.Path = strings.TrimSuffix(u.Path, "/") + healthcheckFailSuffix
+	case data.IsRunning:
+		u.Path = strings.TrimSuffix(u.Path, "/") + healthcheckStartSuffix
+	}
+	u.RawPath = ""
+
+	values := u.Query()
+	values.Set(healthcheckDurationParam, strconv.FormatFloat(data.DurationSeconds, 'f', -1, 64))
+	u.RawQuery = values.Encode()
+	return u.String(), nil
+}
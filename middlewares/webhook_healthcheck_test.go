@@ -0,0 +1,78 @@
+package middlewares
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookHealthcheck struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookHealthcheck{})
+
+func (s *SuiteWebhookHealthcheck) TestPing(c *C) {
+	type ping struct {
+		path, duration, body string
+	}
+	received := make(chan ping, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- ping{r.URL.Path, r.URL.Query().Get("duration"), string(body)}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:   "deadman",
+		Type:   WebhookTypeAll,
+		Active: true,
+		URL:    ts.URL + "/ping/5c4b0a2e",
+		Format: WebhookFormatHealthcheck,
+		Body:   "{{.Error}}",
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	// A success pings the base URL
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	s.ctx.Execution.Duration = 1500 * time.Millisecond
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case p := <-received:
+		c.Assert(p, Equals, ping{"/ping/5c4b0a2e", "1.5", ""})
+	case <-time.After(2 * time.Second):
+		c.Fatal("success ping not received")
+	}
+
+	// A failure pings /fail, with the log as the body
+	s.SetUpTest(c)
+	s.ctx.Start()
+	s.ctx.Stop(errors.New("disk full"))
+	s.ctx.Execution.Duration = 2 * time.Second
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case p := <-received:
+		c.Assert(p, Equals, ping{"/ping/5c4b0a2e/fail", "2", "disk full"})
+	case <-time.After(2 * time.Second):
+		c.Fatal("failure ping not received")
+	}
+}
+
+func (s *SuiteWebhookHealthcheck) TestURL(c *C) {
+	url, err := healthcheckURL("https://hc-ping.com/uuid/?rid=1", &WebhookTemplateData{IsRunning: true, DurationSeconds: 60})
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "https://hc-ping.com/uuid/start?duration=60&rid=1")
+
+	def := WebhookDefinition{Name: "deadman", Type: WebhookTypeAll, URL: "nats://nats", Transport: TransportNATS, Subject: "x", Format: WebhookFormatHealthcheck}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `.*format "healthcheck" only applies to the http transport`)
+}
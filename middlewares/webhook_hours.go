@@ -0,0 +1,99 @@
+package middlewares
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ActiveHoursConfig limits sends to a daily time window, e.g. business hours
+// for informational webhooks or nights for on-call alerts
+type ActiveHoursConfig struct {
+	From string   `json:"from"` // "HH:MM", start of the window - REQUIRED
+	To   string   `json:"to"`   // "HH:MM", end of the window, before From for windows past midnight - REQUIRED
+	TZ   string   `json:"tz"`   // IANA time zone, e.g. "Europe/Madrid", defaults to local time
+	Days []string `json:"days"` // e.g. ["Mon-Fri"] or ["Sat", "Sun"], defaults to every day
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// activeHours is a parsed ActiveHoursConfig. From and to are minutes since
+// midnight; a window past midnight belongs to the day it starts on.
+type activeHours struct {
+	from, to int
+	location *time.Location
+	days     [7]bool
+}
+
+func newActiveHours(config *ActiveHoursConfig) (*activeHours, error) {
+	from, err := parseClock(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid activeHours.from: %w", err)
+	}
+	to, err := parseClock(config.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid activeHours.to: %w", err)
+	}
+	if from == to {
+		return nil, fmt.Errorf("activeHours.from and activeHours.to are both %s", config.From)
+	}
+
+	h := &activeHours{from: from, to: to, location: time.Local}
+	if config.TZ != "" {
+		h.location, err = time.LoadLocation(config.TZ)
+		if err != nil {
+			return nil, fmt.Errorf("invalid activeHours.tz: %w", err)
+		}
+	}
+
+	if len(config.Days) == 0 {
+		h.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, days := range config.Days {
+		first, last, isRange := strings.Cut(days, "-")
+		start, ok := weekdays[strings.ToLower(strings.TrimSpace(first))]
+		end, endOK := start, true
+		if isRange {
+			end, endOK = weekdays[strings.ToLower(strings.TrimSpace(last))]
+		}
+		if !ok || !endOK {
+			return nil, fmt.Errorf("invalid activeHours day %q, use Mon, Tue, ... or a range such as Mon-Fri", days)
+		}
+		for day := start; ; day = (day + 1) % 7 {
+			h.days[day] = true
+			if day == end {
+				break
+			}
+		}
+	}
+
+	return h, nil
+}
+
+// contains reports whether t falls inside the window
+func (h *activeHours) contains(t time.Time) bool {
+	t = t.In(h.location)
+	minute := t.Hour()*60 + t.Minute()
+
+	if h.from < h.to {
+		return h.days[t.Weekday()] && minute >= h.from && minute < h.to
+	}
+
+	// The window passes midnight, its early hours belong to the previous day
+	if minute >= h.from {
+		return h.days[t.Weekday()]
+	}
+	return minute < h.to && h.days[(t.Weekday()+6)%7]
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,214 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookHours struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookHours{})
+
+func (s *SuiteWebhookHours) TestBusinessHours(c *C) {
+	hours, err := newActiveHours(&ActiveHoursConfig{From: "09:00", To: "18:00", TZ: "Europe/Madrid", Days: []string{"Mon-Fri"}})
+	c.Assert(err, IsNil)
+
+	madrid, _ := time.LoadLocation("Europe/Madrid")
+	for value, expected := range map[string]bool{
+		"2024-06-03 09:00": true,  // Monday
+		"2024-06-03 08:59": false, // before the window
+		"2024-06-07 17:59": true,  // Friday
+		"2024-06-07 18:00": false, // end is exclusive
+		"2024-06-08 12:00": false, // Saturday
+	} {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", value, madrid)
+		c.Assert(hours.contains(t), Equals, expected, Commentf("time %s", value))
+	}
+
+	// Times are compared in the configured zone, 07:30 UTC is 09:30 in Madrid
+	c.Assert(hours.contains(time.Date(2024, 6, 3, 7, 30, 0, 0, time.UTC)), Equals, true)
+}
+
+func (s *SuiteWebhookHours) TestOvernight(c *C) {
+	hours, err := newActiveHours(&ActiveHoursConfig{From: "22:00", To: "06:00", TZ: "UTC", Days: []string{"Fri", "Sat"}})
+	c.Assert(err, IsNil)
+
+	for value, expected := range map[string]bool{
+		"2024-06-07 23:00": true,  // Friday night
+		"2024-06-08 05:59": true,  // early Saturday belongs to Friday night
+		"2024-06-08 06:00": false, // end is exclusive
+		"2024-06-09 03:00": true,  // early Sunday belongs to Saturday night
+		"2024-06-09 22:00": false, // Sunday night
+		"2024-06-07 03:00": false, // early Friday belongs to Thursday night
+	} {
+		t, _ := time.Parse("2006-01-02 15:04", value)
+		c.Assert(hours.contains(t), Equals, expected, Commentf("time %s", value))
+	}
+}
+
+func (s *SuiteWebhookHours) TestWrappingDays(c *C) {
+	hours, err := newActiveHours(&ActiveHoursConfig{From: "00:00", To: "23:59", TZ: "UTC", Days: []string{"sat-mon"}})
+	c.Assert(err, IsNil)
+	c.Assert(hours.days, DeepEquals, [7]bool{true, true, false, false, false, false, true})
+}
+
+func (s *SuiteWebhookHours) TestInvalidConfig(c *C) {
+	for _, t := range []struct {
+		config   ActiveHoursConfig
+		expected string
+	}{
+		{ActiveHoursConfig{From: "9am", To: "18:00"}, `invalid activeHours.from: "9am" is not a HH:MM time`},
+		{ActiveHoursConfig{From: "09:00", To: "24:00"}, `invalid activeHours.to: .*`},
+		{ActiveHoursConfig{From: "09:00", To: "09:00"}, `activeHours.from and activeHours.to are both 09:00`},
+		{ActiveHoursConfig{From: "09:00", To: "18:00", TZ: "Mars/Base"}, `invalid activeHours.tz: .*`},
+		{ActiveHoursConfig{From: "09:00", To: "18:00", Days: []string{"Monday-Fri"}}, `invalid activeHours day "Monday-Fri".*`},
+	} {
+		_, err := newActiveHours(&t.config)
+		c.Assert(err, ErrorMatches, t.expected)
+	}
+}
+
+func (s *SuiteWebhookHours) TestSkipOutsideWindow(c *C) {
+	received := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	// A window starting in an hour never contains now
+	now := time.Now().UTC()
+	def := WebhookDefinition{
+		Name:    "test",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "POST",
+		Timeout: 5,
+		ActiveHours: &ActiveHoursConfig{
+			From: now.Add(time.Hour).Format("15:04"),
+			To:   now.Add(2 * time.Hour).Format("15:04"),
+			TZ:   "UTC",
+		},
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case <-received:
+		c.Fatal("webhook sent outside its active hours")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Inside the window it is sent
+	def.ActiveHours.From = now.Add(-time.Hour).Format("15:04")
+	def.ActiveHours.To = now.Add(time.Hour).Format("15:04")
+	webhook, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.SetUpTest(c)
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		c.Fatal("webhook not received")
+	}
+}
+
+func (s *SuiteWebhookHours) TestSnoozeUntil(c *C) {
+	received := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:        "test",
+		Type:        WebhookTypeAll,
+		Active:      true,
+		URL:         ts.URL,
+		Method:      "POST",
+		Timeout:     5,
+		SnoozeUntil: time.Now().Add(time.Hour).Format(time.RFC3339),
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case <-received:
+		c.Fatal("webhook sent while snoozed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Once the time has passed it is sent again
+	def.SnoozeUntil = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	webhook, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.SetUpTest(c)
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		c.Fatal("webhook not received")
+	}
+
+	def.SnoozeUntil = "tomorrow"
+	_, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, `invalid snoozeUntil time "tomorrow", must be RFC3339: .*`)
+}
+
+// Test webhooks referenced by name from a job are snoozed too
+func (s *SuiteWebhookHours) TestSnoozeUntilPerJob(c *C) {
+	received := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	registry := NewWebhookRegistry()
+	registry.Register(WebhookDefinition{
+		Name:        "ticket",
+		Type:        WebhookTypeError,
+		Active:      true,
+		URL:         ts.URL,
+		Method:      "POST",
+		Timeout:     5,
+		SnoozeUntil: time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+
+	middleware, err := NewWebhookFromConfig(&WebhookConfig{WebhookErrorNames: "ticket"}, registry, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.ctx.Start()
+	s.ctx.Stop(errors.New("disk full"))
+	c.Assert(middleware.Run(s.ctx), IsNil)
+
+	select {
+	case <-received:
+		c.Fatal("per-job webhook sent while snoozed")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,61 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OAuth2Config authenticates a webhook with a bearer token obtained through
+// the OAuth2 client credentials flow
+type OAuth2Config struct {
+	TokenURL     string   `json:"tokenURL"`
+	ClientID     string   `json:"clientID"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// oauth2Transport attaches a bearer token to every attempt of the wrapped
+// transport. The token is cached and fetched again shortly before it
+// expires, so retries and spooled requests never carry a stale one.
+type oauth2Transport struct {
+	next     webhookTransport
+	tokenURL string
+	source   oauth2.TokenSource
+}
+
+// newOAuth2Transport wraps next, fetching tokens through client so they
+// share the TLS settings and timeout of the webhook
+func newOAuth2Transport(ctx context.Context, config *OAuth2Config, client *http.Client, next webhookTransport) *oauth2Transport {
+	credentials := &clientcredentials.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		TokenURL:     config.TokenURL,
+		Scopes:       config.Scopes,
+	}
+	return &oauth2Transport{
+		next:     next,
+		tokenURL: config.TokenURL,
+		source:   credentials.TokenSource(context.WithValue(ctx, oauth2.HTTPClient, client)),
+	}
+}
+
+func (t *oauth2Transport) send(ctx context.Context, r *WebhookRequest) (*webhookResponse, error) {
+	token, err := t.source.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OAuth2 token from %s: %w", t.tokenURL, err)
+	}
+
+	// The request is shared by every attempt, the header is set on a copy
+	authorized := *r
+	authorized.Headers = make(map[string]string, len(r.Headers)+1)
+	for key, value := range r.Headers {
+		authorized.Headers[key] = value
+	}
+	authorized.Headers["Authorization"] = token.Type() + " " + token.AccessToken
+
+	return t.next.send(ctx, &authorized)
+}
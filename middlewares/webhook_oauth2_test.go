@@ -0,0 +1,115 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookOAuth2 struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookOAuth2{})
+
+// tokenServer issues numbered client credentials tokens valid for expiresIn
+// seconds, or fails with status when set
+func tokenServer(c *C, expiresIn int, status int) (*httptest.Server, *atomic.Int32) {
+	var issued atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.FormValue("grant_type"), Equals, "client_credentials")
+		c.Check(r.FormValue("scope"), Equals, "alerts:write")
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		if id, secret, _ := r.BasicAuth(); id != "ofelia" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := issued.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "bearer", "expires_in": %d}`, n, expiresIn)
+	}))
+	return ts, &issued
+}
+
+func (s *SuiteWebhookOAuth2) newWebhook(c *C, tokenURL, url string) *Webhook {
+	def := WebhookDefinition{
+		Name: "gateway",
+		Type: WebhookTypeAll,
+		URL:  url,
+		OAuth2: &OAuth2Config{
+			TokenURL:     tokenURL,
+			ClientID:     "ofelia",
+			ClientSecret: "s3cret",
+			Scopes:       []string{"alerts:write"},
+		},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	return webhook.(*Webhook)
+}
+
+func (s *SuiteWebhookOAuth2) TestToken(c *C) {
+	authorizations := make(chan string, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations <- r.Header.Get("Authorization")
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	// A token valid for an hour is fetched once and reused
+	tokens, issued := tokenServer(c, 3600, 0)
+	defer tokens.Close()
+
+	w := s.newWebhook(c, tokens.URL, ts.URL)
+	req := &WebhookRequest{Method: "POST", URL: ts.URL, Headers: map[string]string{}}
+	c.Assert(w.sendWithRetry(req).Err, IsNil)
+	c.Assert(w.sendWithRetry(req).Err, IsNil)
+	c.Assert(<-authorizations, Equals, "Bearer token-1")
+	c.Assert(<-authorizations, Equals, "Bearer token-1")
+	c.Assert(issued.Load(), Equals, int32(1))
+	c.Assert(req.Headers, HasLen, 0)
+
+	// A token about to expire is replaced before use
+	expiring, issued := tokenServer(c, 1, 0)
+	defer expiring.Close()
+
+	w = s.newWebhook(c, expiring.URL, ts.URL)
+	c.Assert(w.sendWithRetry(req).Err, IsNil)
+	c.Assert(w.sendWithRetry(req).Err, IsNil)
+	c.Assert(<-authorizations, Equals, "Bearer token-1")
+	c.Assert(<-authorizations, Equals, "Bearer token-2")
+	c.Assert(issued.Load(), Equals, int32(2))
+}
+
+func (s *SuiteWebhookOAuth2) TestTokenFailure(c *C) {
+	var sent atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent.Store(true)
+	}))
+	defer ts.Close()
+
+	tokens, _ := tokenServer(c, 3600, http.StatusServiceUnavailable)
+	defer tokens.Close()
+
+	w := s.newWebhook(c, tokens.URL, ts.URL)
+	result := w.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL, Headers: map[string]string{}})
+	c.Assert(result.Success, Equals, false)
+	c.Assert(result.Err, ErrorMatches, "failed to fetch OAuth2 token from "+tokens.URL+": (?s).*503 Service Unavailable.*")
+	c.Assert(sent.Load(), Equals, false)
+}
+
+func (s *SuiteWebhookOAuth2) TestValidation(c *C) {
+	def := WebhookDefinition{Name: "gateway", Type: WebhookTypeAll, URL: "https://example.com", OAuth2: &OAuth2Config{ClientID: "ofelia"}}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `webhook "gateway": oauth2 requires a tokenURL and a clientID`)
+
+	def.OAuth2.TokenURL = "https://auth.example.com/token"
+	def.TokenFile = "/run/secrets/token"
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `webhook "gateway": oauth2 cannot be used with tokenFile`)
+}
@@ -1,6 +1,8 @@
 package middlewares
 
 import (
+	"sort"
+
 	"github.com/mcuadros/ofelia/core"
 )
 
@@ -8,7 +10,12 @@ import (
 type PerJobWebhook struct {
 	errorWebhooks []*WebhookDefinition
 	infoWebhooks  []*WebhookDefinition
+	registry      *WebhookRegistry
 	logger        core.Logger
+
+	// Templated webhook names, resolved against the registry per execution
+	errorTemplates []string
+	infoTemplates  []string
 }
 
 // ContinueOnStop returns true because we want to report final status
@@ -19,82 +26,130 @@ func (w *PerJobWebhook) ContinueOnStop() bool {
 // Run sends the configured webhooks based on job success/failure
 func (w *PerJobWebhook) Run(ctx *core.Context) error {
 	// Execute the job first
+	stop := watchRunning(ctx, w.referencedWebhooks()...)
 	err := ctx.Next()
+	stop()
 	ctx.Stop(err)
+	recordExecution(ctx)
 
-	// Determine which webhooks to fire based on job result
-	var webhooks []*WebhookDefinition
-	if ctx.Execution.Failed {
-		webhooks = w.errorWebhooks
-	} else {
-		webhooks = w.infoWebhooks
+	// A success cancels delayed failure sends of the error webhooks
+	if !ctx.Execution.Failed {
+		for _, def := range w.errorWebhooks {
+			if webhook, err := w.registry.webhook(def.Name, w.logger); err == nil {
+				webhook.cancelDelayed(ctx)
+			}
+		}
 	}
 
 	// Fire webhooks
-	for _, def := range webhooks {
+	for _, def := range w.firing(ctx) {
 		if !def.Active {
 			ctx.Logger.Debugf("Webhook %q skipped (inactive)", def.Name)
 			continue
 		}
 
 		// Create and send webhook
-		go w.sendWebhook(ctx, def)
+		w.sendWebhook(ctx, def)
 	}
 
 	return err
 }
 
-// sendWebhook sends a single webhook based on the definition
-func (w *PerJobWebhook) sendWebhook(ctx *core.Context, def *WebhookDefinition) {
-	// Create a webhook instance from the definition
-	webhook, err := NewWebhookFromDefinition(*def, w.logger)
-	if err != nil {
-		ctx.Logger.Errorf("Per-job webhook %q: failed to create webhook: %v", def.Name, err)
-		return
+// firing returns the webhooks to fire for the execution result, in the same
+// priority order as the global webhooks
+func (w *PerJobWebhook) firing(ctx *core.Context) []*WebhookDefinition {
+	var webhooks []*WebhookDefinition
+	var templates []string
+	if ctx.Execution.Failed {
+		webhooks = w.errorWebhooks
+		templates = w.errorTemplates
+	} else {
+		webhooks = w.infoWebhooks
+		templates = w.infoTemplates
+
+		// Error webhooks with failOnStderr also fire for successes that
+		// wrote to stderr
+		if !ctx.Execution.Skipped && wroteStderr(ctx) {
+			webhooks = append([]*WebhookDefinition{}, webhooks...)
+			for _, def := range w.errorWebhooks {
+				if def.FailOnStderr {
+					webhooks = append(webhooks, def)
+				}
+			}
+		}
 	}
 
-	// The webhook.Run will handle template execution and HTTP sending
-	// We need to create a mock context that won't execute Next() again
-	// Instead, we'll directly call the sendWebhook method from the Webhook struct
+	var resolved []*WebhookDefinition
+	if len(templates) > 0 {
+		resolved = w.resolveTemplates(ctx, templates)
+	}
 
-	// Build template data
-	templateData := buildTemplateData(ctx)
+	// Sort a copy, the referenced slices are shared by every execution
+	webhooks = append(append(make([]*WebhookDefinition, 0, len(webhooks)+len(resolved)), webhooks...), resolved...)
+	sort.SliceStable(webhooks, func(i, j int) bool {
+		return webhookRunsBefore(webhooks[i], webhooks[j])
+	})
+	return webhooks
+}
 
-	// Execute templates for URL
-	url, err := executeTemplate(def.URL, templateData)
-	if err != nil {
-		ctx.Logger.Errorf("Per-job webhook %q: failed to execute URL template: %v", def.Name, err)
-		return
+// referencedWebhooks returns the webhooks referenced by name, a webhook
+// listed both as error and info webhook once
+func (w *PerJobWebhook) referencedWebhooks() []*Webhook {
+	seen := make(map[string]bool)
+	var webhooks []*Webhook
+	for _, def := range append(append([]*WebhookDefinition{}, w.errorWebhooks...), w.infoWebhooks...) {
+		if seen[def.Name] {
+			continue
+		}
+		seen[def.Name] = true
+		if webhook, err := w.registry.webhook(def.Name, w.logger); err == nil {
+			webhooks = append(webhooks, webhook)
+		}
 	}
+	return webhooks
+}
+
+// resolveTemplates renders templated webhook names for the current execution
+// and looks them up in the registry. Names that fail to render, are unknown or
+// have an incompatible type are logged and skipped.
+func (w *PerJobWebhook) resolveTemplates(ctx *core.Context, templates []string) []*WebhookDefinition {
+	templateData := buildTemplateData(ctx, true, 0, "")
 
-	// Execute templates for body
-	var bodyBytes []byte
-	if def.Body != nil {
-		bodyBytes, err = executeTemplateForBody(def.Body, templateData)
+	webhooks := make([]*WebhookDefinition, 0, len(templates))
+	for _, tmpl := range templates {
+		name, err := executeTemplate(tmpl, templateData)
 		if err != nil {
-			ctx.Logger.Errorf("Per-job webhook %q: failed to execute body template: %v", def.Name, err)
-			return
+			ctx.Logger.Errorf("Per-job webhook %q: failed to execute name template: %v", tmpl, err)
+			continue
 		}
-	}
 
-	// Execute templates for headers
-	headers := make(map[string]string)
-	for key, value := range def.Headers {
-		templatedValue, err := executeTemplate(value, templateData)
-		if err != nil {
-			ctx.Logger.Errorf("Per-job webhook %q: failed to execute header template for %q: %v", def.Name, key, err)
-			return
+		def, ok := w.registry.Get(name)
+		if !ok {
+			ctx.Logger.Warningf("Per-job webhook %q resolved to unknown webhook %q, skipping", tmpl, name)
+			continue
 		}
-		headers[key] = templatedValue
-	}
 
-	// Send with retry logic using the webhook's sendWithRetry
-	if wh, ok := webhook.(*Webhook); ok {
-		err = wh.sendWithRetry(url, headers, bodyBytes)
-		if err != nil {
-			ctx.Logger.Errorf("Per-job webhook %q: failed after retries: %v", def.Name, err)
-		} else {
-			ctx.Logger.Debugf("Per-job webhook %q: sent successfully to %s", def.Name, url)
+		if err := checkWebhookReference(def, ctx.Execution.Failed); err != nil {
+			ctx.Logger.Warningf("Per-job webhook %q: %v, skipping", tmpl, err)
+			continue
 		}
+
+		webhooks = append(webhooks, def)
 	}
+
+	return webhooks
+}
+
+// sendWebhook sends a single webhook based on the definition
+func (w *PerJobWebhook) sendWebhook(ctx *core.Context, def *WebhookDefinition) {
+	// Get the shared webhook instance for the definition
+	webhook, err := w.registry.webhook(def.Name, w.logger)
+	if err != nil {
+		ctx.Logger.Errorf("Per-job webhook %q: failed to create webhook: %v", def.Name, err)
+		return
+	}
+
+	// The job has already run, so skip Webhook.Run and go straight to
+	// dispatching, which sends in the background
+	webhook.dispatch(ctx)
 }
@@ -0,0 +1,48 @@
+package middlewares
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// validateRedactFields checks that every redacted field is a field of the
+// template data, a misspelled name would silently redact nothing
+func validateRedactFields(fields []string) error {
+	t := reflect.TypeOf(WebhookTemplateData{})
+	for _, name := range fields {
+		if field, ok := t.FieldByName(name); !ok || !field.IsExported() {
+			return fmt.Errorf("redactFields: unknown template data field %q", name)
+		}
+	}
+	return nil
+}
+
+// redact returns a copy of the template data with the redacted fields set to
+// their zero value, leaving the data shared with other webhooks untouched
+func (w *Webhook) redact(templateData interface{}) interface{} {
+	if len(w.redactFields) == 0 {
+		return templateData
+	}
+
+	switch data := templateData.(type) {
+	case *WebhookTemplateData:
+		return w.redactExecution(data)
+	case *WebhookBatchData:
+		batch := *data
+		batch.Jobs = make([]*WebhookTemplateData, len(data.Jobs))
+		for i, job := range data.Jobs {
+			batch.Jobs[i] = w.redactExecution(job)
+		}
+		return &batch
+	}
+	return templateData
+}
+
+func (w *Webhook) redactExecution(data *WebhookTemplateData) *WebhookTemplateData {
+	redacted := *data
+	value := reflect.ValueOf(&redacted).Elem()
+	for _, name := range w.redactFields {
+		value.FieldByName(name).SetZero()
+	}
+	return &redacted
+}
@@ -0,0 +1,62 @@
+package middlewares
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookRedact struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookRedact{})
+
+func (s *SuiteWebhookRedact) TestRedactFields(c *C) {
+	def := WebhookDefinition{
+		Name:         "audit",
+		Type:         WebhookTypeAll,
+		URL:          "https://example.com/hook",
+		RedactFields: []string{"Stdout", "JobCommand"},
+		Body:         `{"job": "{{.JobName}}", "command": "{{.JobCommand}}", "output": {{.Stdout | json}}}`,
+	}
+	data := &WebhookTemplateData{JobName: "backup", JobCommand: "pg_dump --password=hunter2", Stdout: "token=abc"}
+
+	_, _, _, body, err := RenderWebhook(def, data)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, `{"job": "backup", "command": "", "output": ""}`)
+
+	// The data shared with other webhooks is left alone
+	c.Assert(data.Stdout, Equals, "token=abc")
+
+	def.RedactFields = []string{"Stdot"}
+	_, _, _, _, err = RenderWebhook(def, data)
+	c.Assert(err, ErrorMatches, `webhook "audit": redactFields: unknown template data field "Stdot"`)
+}
+
+func (s *SuiteWebhookRedact) TestRedactBatch(c *C) {
+	w := &Webhook{redactFields: []string{"Stderr"}}
+	batch := &WebhookBatchData{Jobs: []*WebhookTemplateData{{JobName: "a", Stderr: "secret"}}}
+
+	redacted := w.redact(batch).(*WebhookBatchData)
+	c.Assert(redacted.Jobs[0].JobName, Equals, "a")
+	c.Assert(redacted.Jobs[0].Stderr, Equals, "")
+	c.Assert(batch.Jobs[0].Stderr, Equals, "secret")
+}
+
+func (s *SuiteWebhookRedact) TestDefaults(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"defaults": {"redactFields": ["Stdout"]},
+		"webhooks": [
+			{"name": "a", "type": "all", "url": "https://example.com/a"},
+			{"name": "b", "type": "all", "url": "https://example.com/b", "redactFields": ["Stderr"]}
+		]
+	}`)
+	defer os.Remove(path)
+
+	config, err := readWebhooksFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(config.Webhooks[0].RedactFields, DeepEquals, []string{"Stdout"})
+	// A webhook adds to the global fields rather than replacing them
+	c.Assert(config.Webhooks[1].RedactFields, DeepEquals, []string{"Stderr", "Stdout"})
+}
@@ -0,0 +1,36 @@
+package middlewares
+
+// RenderWebhook renders the request a webhook would send for the given
+// execution, without sending it, so payloads can be checked against golden
+// files. Signing, the timestamp header and PreSendHook are applied at send
+// time and are not part of the result.
+func RenderWebhook(def WebhookDefinition, data *WebhookTemplateData) (method, url string, headers map[string]string, body []byte, err error) {
+	if err := prepareWebhookDefinition(&def); err != nil {
+		return "", "", nil, nil, err
+	}
+	// A batched webhook would be registered and flushed on its own, and a
+	// spooled one would deliver what earlier runs left in its spool
+	def.Batch, def.Spool = nil, nil
+
+	middleware, err := NewWebhookFromDefinition(def, discardLogger{})
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	w := middleware.(*Webhook)
+	defer w.Cancel()
+
+	req, err := w.render(discardLogger{}, data)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	return req.Method, req.URL, req.Headers, req.Body, nil
+}
+
+// discardLogger drops every message
+type discardLogger struct{}
+
+func (discardLogger) Criticalf(format string, args ...interface{}) {}
+func (discardLogger) Debugf(format string, args ...interface{})    {}
+func (discardLogger) Errorf(format string, args ...interface{})    {}
+func (discardLogger) Noticef(format string, args ...interface{})   {}
+func (discardLogger) Warningf(format string, args ...interface{})  {}
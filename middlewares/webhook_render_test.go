@@ -0,0 +1,63 @@
+package middlewares
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookRender struct{}
+
+var _ = Suite(&SuiteWebhookRender{})
+
+func (s *SuiteWebhookRender) TestRenderWebhook(c *C) {
+	def := WebhookDefinition{
+		Name:    "slack",
+		Type:    WebhookTypeError,
+		URL:     "https://hooks.example.com/{{.JobName}}",
+		Query:   map[string]string{"host": "{{.Hostname}}"},
+		Headers: map[string]string{"X-Job": "{{.JobName}}", "X-Retry": "{{if .PrevFailed}}yes{{end}}"},
+		Body:    map[string]interface{}{"text": "{{.JobName}} failed after {{.Duration}}: {{.Error}}"},
+		Trace:   &TraceConfig{},
+		Signature: &SignatureConfig{
+			Secret:    "secret",
+			Timestamp: true,
+		},
+	}
+	data := &WebhookTemplateData{
+		JobName:     "backup",
+		ExecutionID: "abc123",
+		Duration:    (90 * time.Second).String(),
+		Failed:      true,
+		Error:       "disk full",
+		Hostname:    "server-01",
+	}
+
+	method, url, headers, body, err := RenderWebhook(def, data)
+	c.Assert(err, IsNil)
+	c.Assert(method, Equals, "POST")
+	c.Assert(url, Equals, "https://hooks.example.com/backup?host=server-01")
+	c.Assert(string(body), Equals, `{"text":"backup failed after 1m30s: disk full"}`)
+
+	// Signature and timestamp depend on the send time and are left out
+	c.Assert(headers, DeepEquals, map[string]string{
+		"X-Job":            "backup",
+		"X-Correlation-ID": "abc123",
+		"Content-Type":     "application/json",
+	})
+
+	// Rendering twice gives the same payload
+	_, _, _, again, err := RenderWebhook(def, data)
+	c.Assert(err, IsNil)
+	c.Assert(again, DeepEquals, body)
+}
+
+func (s *SuiteWebhookRender) TestRenderErrors(c *C) {
+	def := WebhookDefinition{Name: "broken", Type: WebhookTypeAll, URL: "https://example.com", Body: "{{.Missing}}"}
+	_, _, _, _, err := RenderWebhook(def, &WebhookTemplateData{})
+	c.Assert(err, ErrorMatches, `failed to execute body template: .*Missing.*`)
+
+	def = WebhookDefinition{Name: "untyped", URL: "https://example.com"}
+	_, _, _, _, err = RenderWebhook(def, &WebhookTemplateData{})
+	c.Assert(err, ErrorMatches, `webhook "untyped" is missing required 'type' field`)
+}
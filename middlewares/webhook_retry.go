@@ -0,0 +1,97 @@
+package middlewares
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mcuadros/ofelia/core"
+)
+
+// retryPolicy bounds the attempts of a send
+type retryPolicy struct {
+	maxAttempts int           // first attempt plus retries, 0 for no limit but maxElapsed
+	maxElapsed  time.Duration // no retry starts past this long after the first attempt, 0 for no limit
+	backoff     time.Duration // base backoff, doubled on each retry of a send
+}
+
+// newRetryPolicy parses the retry config found under field. Count is the
+// number of retries after the first attempt so Count 0 (or no retry block at
+// all) means a single attempt.
+func newRetryPolicy(name, field string, config *RetryConfig, logger core.Logger) (retryPolicy, error) {
+	policy := retryPolicy{maxAttempts: defaultRetryCount + 1, backoff: defaultRetryBackoff}
+	if config == nil {
+		return policy, nil
+	}
+
+	if config.Count < 0 {
+		return policy, fmt.Errorf("invalid %s count %d, must be 0 (no retries) or more", field, config.Count)
+	}
+	policy.maxAttempts = config.Count + 1
+	if config.MaxElapsed != "" {
+		duration, err := time.ParseDuration(config.MaxElapsed)
+		if err != nil {
+			return policy, fmt.Errorf("invalid %s maxElapsed duration %q: %w", field, config.MaxElapsed, err)
+		}
+		policy.maxElapsed = duration
+	}
+	if config.Count == 0 && policy.maxElapsed == 0 {
+		logger.Debugf("Webhook %q: %s.count is 0, retries are disabled", name, field)
+	}
+	if config.Backoff != "" {
+		duration, err := time.ParseDuration(config.Backoff)
+		if err != nil {
+			return policy, fmt.Errorf("invalid %s backoff duration %q: %w", field, config.Backoff, err)
+		}
+		policy.backoff = duration
+	}
+
+	// A time budget without a count retries until the budget is spent
+	if policy.maxElapsed > 0 && config.Count == 0 {
+		policy.maxAttempts = 0
+	}
+	return policy, nil
+}
+
+// Outcomes of a send with their own retry policy
+const (
+	retryOutcomeError   = "error"
+	retryOutcomeSuccess = "success"
+)
+
+// retryOutcome returns the outcome of a send when it has its own retry
+// policy, "" when the default one applies. Executions the webhook counts as
+// failed, as when routing them, and digests holding one use retryOnError;
+// running alerts, successful and skipped executions use retryOnSuccess.
+func (w *Webhook) retryOutcome(templateData interface{}) string {
+	var failed bool
+	switch data := templateData.(type) {
+	case *WebhookTemplateData:
+		failed = data.Failed || data.routedFailed
+	case *WebhookBatchData:
+		failed = data.Failed > 0
+		for _, job := range data.Jobs {
+			failed = failed || job.routedFailed
+		}
+	default:
+		return ""
+	}
+
+	switch {
+	case failed && w.retryOnError != nil:
+		return retryOutcomeError
+	case !failed && w.retryOnSuccess != nil:
+		return retryOutcomeSuccess
+	}
+	return ""
+}
+
+// retryFor returns the retry policy of a send with the given outcome
+func (w *Webhook) retryFor(outcome string) retryPolicy {
+	switch {
+	case outcome == retryOutcomeError && w.retryOnError != nil:
+		return *w.retryOnError
+	case outcome == retryOutcomeSuccess && w.retryOnSuccess != nil:
+		return *w.retryOnSuccess
+	}
+	return w.retry
+}
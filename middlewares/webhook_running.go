@@ -0,0 +1,97 @@
+package middlewares
+
+import (
+	"time"
+
+	"github.com/mcuadros/ofelia/core"
+)
+
+// watchRunning starts the running alerts and heartbeats of the webhooks for
+// an execution about to run and returns a function cancelling those that have
+// not fired, to be called once the job is done
+func watchRunning(ctx *core.Context, webhooks ...*Webhook) func() {
+	if !ctx.Execution.IsRunning {
+		return func() {}
+	}
+
+	// The template data is taken before the job runs, the output streams and
+	// execution fields are written concurrently while it does
+	var data *WebhookTemplateData
+	var timers []*time.Timer
+	done := make(chan struct{})
+	for _, w := range webhooks {
+		if (w.alertAfter == 0 && w.heartbeat == 0) || !w.active {
+			continue
+		}
+		w.captureHooks()
+		if data == nil {
+			data = buildTemplateData(ctx, false, 0, "")
+		}
+		if w.alertAfter > 0 {
+			running := *data
+			timers = append(timers, time.AfterFunc(w.alertAfter, func() {
+				w.alertRunning(ctx.Logger, &running)
+			}))
+		}
+		if w.heartbeat > 0 {
+			go w.sendHeartbeats(ctx.Logger, data, done)
+		}
+	}
+
+	return func() {
+		for _, timer := range timers {
+			timer.Stop()
+		}
+		close(done)
+	}
+}
+
+// sendHeartbeats sends a running alert every heartbeat interval until done
+// is closed
+func (w *Webhook) sendHeartbeats(logger core.Logger, data *WebhookTemplateData, done <-chan struct{}) {
+	ticker := time.NewTicker(w.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		// A tick racing the end of the job is dropped
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		running := *data
+		w.alertRunning(logger, &running)
+	}
+}
+
+// alertRunning sends the webhook for an execution still running, after the
+// alertAfter threshold or on a heartbeat
+func (w *Webhook) alertRunning(logger core.Logger, data *WebhookTemplateData) {
+	now := time.Now()
+	if w.activeHours != nil && !w.activeHours.contains(now) {
+		logger.Debugf("Webhook %q: running alert skipped (outside active hours)", w.name)
+		return
+	}
+	if w.snoozed(now) {
+		logger.Debugf("Webhook %q: running alert skipped (snoozed until %s)", w.name, w.snoozeUntil.Format(time.RFC3339))
+		return
+	}
+
+	elapsed := now.Sub(data.StartTime).Round(time.Second)
+	data.Duration = elapsed.String()
+	data.DurationRaw = elapsed
+	data.DurationSeconds = elapsed.Seconds()
+	data.EndTime = now
+	data.EndTimeUnix = now.Unix()
+	data.EndTimeISO = now.Format(time.RFC3339)
+
+	logger.Noticef("Webhook %q: job %q still running after %v, sending running alert", w.name, data.JobName, elapsed)
+	w.send(logger, data)
+}
@@ -0,0 +1,157 @@
+package middlewares
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mcuadros/ofelia/core"
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookRunning struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookRunning{})
+
+// sleepJob is a job taking a while to run
+type sleepJob struct {
+	TestJob
+	duration time.Duration
+}
+
+func (j *sleepJob) Run(ctx *core.Context) error {
+	time.Sleep(j.duration)
+	return nil
+}
+
+func (s *SuiteWebhookRunning) runJob(c *C, webhook core.Middleware, duration time.Duration) {
+	job := &sleepJob{duration: duration}
+	job.Name = "backup"
+	job.Use(webhook)
+
+	ctx := core.NewContext(core.NewScheduler(&TestLogger{}), job, core.NewExecution())
+	ctx.Start()
+	c.Assert(ctx.Next(), IsNil)
+}
+
+func (s *SuiteWebhookRunning) TestAlertAfter(c *C) {
+	received := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:         "test",
+		Type:         WebhookTypeAll,
+		Active:       true,
+		URL:          ts.URL,
+		Method:       "POST",
+		Timeout:      5,
+		AlertAfter:   "50ms",
+		BodyByStatus: true,
+		Body: map[string]interface{}{
+			"running": "{{.JobName}} still running",
+			"default": "{{.JobName}} done",
+		},
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	// A slow job gets the running alert before the usual one
+	s.runJob(c, webhook, 200*time.Millisecond)
+	c.Assert(<-received, Equals, "backup still running")
+	c.Assert(<-received, Equals, "backup done")
+
+	// A fast job only gets the usual one
+	s.runJob(c, webhook, 0)
+	c.Assert(<-received, Equals, "backup done")
+	select {
+	case body := <-received:
+		c.Fatalf("unexpected send %q", body)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func (s *SuiteWebhookRunning) TestHeartbeat(c *C) {
+	received := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:              "test",
+		Type:              WebhookTypeAll,
+		Active:            true,
+		URL:               ts.URL,
+		Method:            "POST",
+		Timeout:           5,
+		HeartbeatInterval: "50ms",
+		Body:              "{{.JobName}} running={{.IsRunning}}",
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	// A heartbeat every interval while the job runs, then the usual send
+	s.runJob(c, webhook, 180*time.Millisecond)
+	counts := map[string]int{}
+	for counts["backup running=false"] == 0 {
+		select {
+		case body := <-received:
+			counts[body]++
+		case <-time.After(2 * time.Second):
+			c.Fatalf("final send not received, got %v", counts)
+		}
+	}
+	c.Assert(counts["backup running=true"] >= 2, Equals, true, Commentf("%v", counts))
+
+	// Heartbeats stop with the job
+	select {
+	case body := <-received:
+		c.Fatalf("unexpected send %q", body)
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	def.HeartbeatInterval = "0s"
+	_, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, `heartbeatInterval must be positive, got "0s"`)
+}
+
+func (s *SuiteWebhookRunning) TestTemplateData(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:       "test",
+		Type:       WebhookTypeError,
+		Active:     true,
+		URL:        ts.URL,
+		Method:     "POST",
+		Timeout:    5,
+		AlertAfter: "1s",
+		Body:       "{{.IsRunning}} {{.Failed}} {{.Duration}}",
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	// Error webhooks get running alerts too, the job has not failed yet
+	s.runJob(c, webhook, 1100*time.Millisecond)
+	c.Assert(<-received, Equals, "true false 1s")
+
+	def.AlertAfter = "soon"
+	_, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, `invalid alertAfter duration "soon".*`)
+}
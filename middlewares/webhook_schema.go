@@ -0,0 +1,99 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+const webhookSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// webhookSchemaRequired lists the required properties of each config object
+var webhookSchemaRequired = map[reflect.Type][]string{
+	reflect.TypeOf(WebhookDefinition{}): {"type"}, // url is optional for the sns and exec transports
+	reflect.TypeOf(MultipartFile{}):     {"field", "filename"},
+}
+
+// webhookSchemaEnums lists the accepted values of enumerated properties
+var webhookSchemaEnums = map[reflect.Type]map[string][]string{
+	reflect.TypeOf(WebhookDefinition{}): {
+		"type":            {WebhookTypeError, WebhookTypeInfo, WebhookTypeAll},
+		"format":          {"", WebhookFormatMultipart, WebhookFormatXML, WebhookFormatRaw, WebhookFormatHealthcheck, WebhookFormatNDJSON},
+		"minTLSVersion":   {"", "1.0", "1.1", "1.2", "1.3"},
+		"overflowPolicy":  {"", OverflowBuffer, OverflowDrop, OverflowBlock},
+		"missingBodyFile": {"", MissingBodyFileSkip, MissingBodyFileError},
+		"transport":       {"", TransportHTTP, TransportNATS, TransportSNS, TransportExec},
+		"loadBalance":     {"", LoadBalanceRoundRobin, LoadBalanceRandom},
+	},
+	reflect.TypeOf(SignatureConfig{}): {
+		"algorithm": {"", SignatureHMACSHA256, SignatureEd25519},
+	},
+}
+
+// WebhookConfigSchema returns a JSON Schema describing the webhook config
+// file, so editors and CI can validate it before Ofelia loads it. Unknown
+// properties are rejected to catch misspelled field names.
+func WebhookConfigSchema() []byte {
+	schema := schemaForType(reflect.TypeOf(WebhooksFile{}))
+	schema["$schema"] = webhookSchemaDraft
+	schema["title"] = "Ofelia webhook configuration"
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		// The schema only holds maps, slices and strings
+		panic(err)
+	}
+	return data
+}
+
+// schemaForType builds the JSON Schema of a config type from its JSON tags
+func schemaForType(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaForType(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaForType(t.Elem())}
+	case reflect.Struct:
+		return schemaForStruct(t)
+	default:
+		// interface{} fields such as the body accept any JSON value
+		return map[string]interface{}{}
+	}
+}
+
+func schemaForStruct(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+
+		property := schemaForType(field.Type)
+		if enum, ok := webhookSchemaEnums[t][name]; ok {
+			property["enum"] = enum
+		}
+		properties[name] = property
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if required, ok := webhookSchemaRequired[t]; ok {
+		schema["required"] = required
+	}
+	return schema
+}
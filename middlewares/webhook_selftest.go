@@ -0,0 +1,68 @@
+package middlewares
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mcuadros/ofelia/core"
+)
+
+// SelfTest pings the endpoint of every active webhook with Ping, so DNS, TLS
+// and connection problems show in the startup log rather than when a job
+// first fails. Nothing is sent and unreachable endpoints are only warned
+// about. Webhooks with templated URLs or queue transports are skipped, they
+// cannot be checked without an execution.
+func (r *WebhookRegistry) SelfTest(logger core.Logger) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.webhooks))
+	for name, def := range r.webhooks {
+		if def.Active && !r.disabled {
+			names = append(names, name)
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wh, err := r.webhook(name, logger)
+		if err != nil {
+			continue // already reported when the middlewares were created
+		}
+		if !wh.usesHTTP() {
+			logger.Debugf("Webhook %q self-test skipped: not an http webhook", name)
+			continue
+		}
+		if wh.templatedURL() {
+			logger.Debugf("Webhook %q self-test skipped: templated URL", name)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := wh.Ping(); err != nil {
+				logger.Warningf("Webhook %q self-test failed: %v", name, err)
+				return
+			}
+			logger.Noticef("Webhook %q self-test passed", name)
+		}()
+	}
+	wg.Wait()
+}
+
+// templatedURL reports whether any URL of the webhook is a template, only
+// known once an execution renders it
+func (w *Webhook) templatedURL() bool {
+	urls := []string{w.url}
+	if w.balancer != nil {
+		urls = w.balancer.urls
+	}
+	for _, url := range urls {
+		if strings.Contains(url, "{{") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookSelfTest struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookSelfTest{})
+
+func (s *SuiteWebhookSelfTest) TestStartup(c *C) {
+	methods := make(chan string, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer ts.Close()
+
+	// A closed server refuses connections
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "up", "type": "all", "active": true, "url": "`+ts.URL+`"},
+			{"name": "down", "type": "all", "active": true, "url": "`+down.URL+`", "timeout": 1},
+			{"name": "dynamic", "type": "all", "active": true, "url": "`+ts.URL+`/{{.JobName}}"},
+			{"name": "inactive", "type": "all", "url": "`+down.URL+`"}
+		]
+	}`)
+	defer os.Remove(path)
+
+	logger := &recordingLogger{}
+	LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path, WebhookSelfTest: true}, nil, logger)
+	c.Assert(logger.warnings, HasLen, 1)
+	c.Assert(strings.HasPrefix(logger.warnings[0], `Webhook "down" self-test failed: `), Equals, true, Commentf("%s", logger.warnings[0]))
+	c.Assert(strings.Join(logger.notices, "\n"), Matches, `(?s).*Webhook "up" self-test passed.*`)
+	c.Assert(logger.errors, HasLen, 0)
+
+	// Only the reachable webhook was pinged, with a HEAD request
+	c.Assert(<-methods, Equals, http.MethodHead)
+	c.Assert(methods, HasLen, 0)
+
+	// Nothing is pinged unless enabled
+	logger = &recordingLogger{}
+	LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path}, nil, logger)
+	c.Assert(logger.warnings, HasLen, 0)
+	c.Assert(methods, HasLen, 0)
+}
@@ -0,0 +1,146 @@
+package middlewares
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	SignatureHMACSHA256 = "hmac-sha256"
+	SignatureEd25519    = "ed25519"
+
+	defaultSignatureHeader = "X-Ofelia-Signature"
+)
+
+// SignatureConfig signs every request body so receivers can check it comes
+// from Ofelia. The signed bytes are the final body, or "<timestamp>.<body>"
+// when the timestamp header is sent and signed.
+type SignatureConfig struct {
+	Algorithm  string `json:"algorithm"`  // "hmac-sha256" (default) | "ed25519"
+	Secret     string `json:"secret"`     // HMAC secret
+	SecretFile string `json:"secretFile"` // file holding the HMAC secret, e.g. a mounted secret
+	KeyFile    string `json:"keyFile"`    // PEM encoded PKCS #8 Ed25519 private key
+	Header     string `json:"header"`     // defaults to "X-Ofelia-Signature"
+	Timestamp  bool   `json:"timestamp"`  // shorthand for a timestamp block with its defaults
+}
+
+// webhookSigner signs request bodies with the configured algorithm
+type webhookSigner struct {
+	header     string
+	secretFile string // re-read by reload, empty for an inline secret
+	keyFile    string
+
+	mu         sync.Mutex
+	secret     []byte
+	privateKey ed25519.PrivateKey
+}
+
+func newWebhookSigner(config *SignatureConfig) (*webhookSigner, error) {
+	s := &webhookSigner{header: config.Header}
+	if s.header == "" {
+		s.header = defaultSignatureHeader
+	}
+
+	switch config.Algorithm {
+	case "", SignatureHMACSHA256:
+		if config.SecretFile != "" {
+			s.secretFile = config.SecretFile
+			return s, s.reload()
+		}
+		if config.Secret == "" {
+			return nil, fmt.Errorf("signature algorithm %q needs a secret or secretFile", SignatureHMACSHA256)
+		}
+		s.secret = []byte(config.Secret)
+	case SignatureEd25519:
+		if config.KeyFile == "" {
+			return nil, fmt.Errorf("signature algorithm %q needs a keyFile", SignatureEd25519)
+		}
+		s.keyFile = config.KeyFile
+		return s, s.reload()
+	default:
+		return nil, fmt.Errorf("invalid signature algorithm %q, must be one of: %q, %q",
+			config.Algorithm, SignatureHMACSHA256, SignatureEd25519)
+	}
+
+	return s, nil
+}
+
+// reload reads the secret or key file again. On error the signer keeps the
+// secret or key it had.
+func (s *webhookSigner) reload() error {
+	switch {
+	case s.secretFile != "":
+		secret, err := readSecretFile(s.secretFile)
+		if err != nil {
+			return fmt.Errorf("failed to read signature secret file: %w", err)
+		}
+		if secret == "" {
+			return fmt.Errorf("signature secret file %q is empty", s.secretFile)
+		}
+		s.mu.Lock()
+		s.secret = []byte(secret)
+		s.mu.Unlock()
+	case s.keyFile != "":
+		key, err := readEd25519Key(s.keyFile)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.privateKey = key
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// sign adds the signature header for the given body, prefixed with the
+// timestamp when one is given
+func (s *webhookSigner) sign(headers map[string]string, body []byte, timestamp string) {
+	payload := body
+	if timestamp != "" {
+		payload = append([]byte(timestamp+"."), body...)
+	}
+
+	s.mu.Lock()
+	secret, privateKey := s.secret, s.privateKey
+	s.mu.Unlock()
+
+	if privateKey != nil {
+		headers[s.header] = "ed25519=" + base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, payload))
+		return
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	headers[s.header] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// readEd25519Key reads a PEM encoded PKCS #8 Ed25519 private key, as written
+// by "openssl genpkey -algorithm ed25519"
+func readEd25519Key(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signature key file %q is not PEM encoded", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature key file %q: %w", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signature key file %q holds a %T, not an Ed25519 key", path, key)
+	}
+	return privateKey, nil
+}
@@ -0,0 +1,190 @@
+package middlewares
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookSignature struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookSignature{})
+
+func (s *SuiteWebhookSignature) TestHMAC(c *C) {
+	signer, err := newWebhookSigner(&SignatureConfig{Secret: "s3cret"})
+	c.Assert(err, IsNil)
+
+	expected := func(payload string) string {
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(payload))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	headers := map[string]string{}
+	signer.sign(headers, []byte(`{"job":"backup"}`), "")
+	c.Assert(headers, DeepEquals, map[string]string{"X-Ofelia-Signature": expected(`{"job":"backup"}`)})
+
+	signer.sign(headers, []byte(`{"job":"backup"}`), "1700000000")
+	c.Assert(headers["X-Ofelia-Signature"], Equals, expected(`1700000000.{"job":"backup"}`))
+}
+
+// Test the timestamp header, with and without signing
+func (s *SuiteWebhookSignature) TestTimestamp(c *C) {
+	received := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	send := func(signature *SignatureConfig, timestamp *TimestampConfig) http.Header {
+		def := WebhookDefinition{
+			Name: "test", URL: ts.URL, Method: "POST", Body: "body", Timeout: 5,
+			Signature: signature, Timestamp: timestamp,
+		}
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+		webhook.(*Webhook).send(&TestLogger{}, &WebhookTemplateData{})
+		return <-received
+	}
+	sign := func(payload string) string {
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(payload))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	// Timestamp only, for receiver-side logging
+	headers := send(nil, &TimestampConfig{Header: "X-Sent-At"})
+	c.Assert(headers.Get("X-Sent-At"), Matches, `\d+`)
+	c.Assert(headers.Get("X-Ofelia-Signature"), Equals, "")
+
+	// Signed along with the body by default
+	headers = send(&SignatureConfig{Secret: "s3cret"}, &TimestampConfig{})
+	timestamp := headers.Get("X-Ofelia-Timestamp")
+	c.Assert(headers.Get("X-Ofelia-Signature"), Equals, sign(timestamp+".body"))
+
+	// Sent but left out of the signature
+	noSign := false
+	headers = send(&SignatureConfig{Secret: "s3cret"}, &TimestampConfig{Sign: &noSign})
+	c.Assert(headers.Get("X-Ofelia-Timestamp"), Not(Equals), "")
+	c.Assert(headers.Get("X-Ofelia-Signature"), Equals, sign("body"))
+}
+
+func (s *SuiteWebhookSignature) TestEd25519WithTimestamp(c *C) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	c.Assert(err, IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	c.Assert(err, IsNil)
+	keyFile := filepath.Join(c.MkDir(), "ed25519.pem")
+	c.Assert(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600), IsNil)
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:    "partner",
+		URL:     ts.URL,
+		Method:  "POST",
+		Body:    "{{.JobName}} done",
+		Timeout: 5,
+		Signature: &SignatureConfig{
+			Algorithm: SignatureEd25519,
+			KeyFile:   keyFile,
+			Header:    "X-Signature",
+			Timestamp: true,
+		},
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	webhook.(*Webhook).send(&TestLogger{}, &WebhookTemplateData{JobName: "backup"})
+
+	r := <-received
+	body := <-bodies
+	timestamp := r.Header.Get("X-Ofelia-Timestamp")
+	c.Assert(timestamp, Matches, `\d+`)
+
+	encoded, ok := strings.CutPrefix(r.Header.Get("X-Signature"), "ed25519=")
+	c.Assert(ok, Equals, true)
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	c.Assert(err, IsNil)
+	c.Assert(ed25519.Verify(publicKey, []byte(timestamp+"."+string(body)), signature), Equals, true)
+}
+
+func (s *SuiteWebhookSignature) TestInvalidConfig(c *C) {
+	_, err := newWebhookSigner(&SignatureConfig{})
+	c.Assert(err, ErrorMatches, ".*needs a secret or secretFile.*")
+
+	_, err = newWebhookSigner(&SignatureConfig{Algorithm: SignatureEd25519})
+	c.Assert(err, ErrorMatches, ".*needs a keyFile.*")
+
+	_, err = newWebhookSigner(&SignatureConfig{Algorithm: "rsa"})
+	c.Assert(err, ErrorMatches, `invalid signature algorithm "rsa".*`)
+
+	keyFile := filepath.Join(c.MkDir(), "key.pem")
+	c.Assert(os.WriteFile(keyFile, []byte("not a key"), 0600), IsNil)
+	_, err = newWebhookSigner(&SignatureConfig{Algorithm: SignatureEd25519, KeyFile: keyFile})
+	c.Assert(err, ErrorMatches, ".*not PEM encoded.*")
+}
+
+// Test rotated secret files are picked up with reloadSecrets
+func (s *SuiteWebhookSignature) TestReloadSecretFile(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Ofelia-Signature")
+	}))
+	defer ts.Close()
+
+	secretFile := filepath.Join(c.MkDir(), "secret")
+	c.Assert(os.WriteFile(secretFile, []byte("first\n"), 0600), IsNil)
+
+	def := WebhookDefinition{
+		Name: "test", URL: ts.URL, Method: "POST", Body: "body", Timeout: 5,
+		Signature:     &SignatureConfig{SecretFile: secretFile},
+		ReloadSecrets: true,
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	signed := func(secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("body"))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	wh.send(&TestLogger{}, &WebhookTemplateData{})
+	c.Assert(<-received, Equals, signed("first"))
+
+	c.Assert(os.WriteFile(secretFile, []byte("second\n"), 0600), IsNil)
+	wh.send(&TestLogger{}, &WebhookTemplateData{})
+	c.Assert(<-received, Equals, signed("second"))
+
+	// A failed reload keeps the last good secret
+	c.Assert(os.Remove(secretFile), IsNil)
+	logger := &recordingLogger{}
+	wh.send(logger, &WebhookTemplateData{})
+	c.Assert(<-received, Equals, signed("second"))
+	c.Assert(logger.warnings, HasLen, 1)
+	c.Assert(logger.warnings[0], Matches, `Webhook "test": failed to read signature secret file: .*, signing with the previous one`)
+}
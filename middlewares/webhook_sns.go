@@ -0,0 +1,320 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TransportSNS = "sns"
+
+	snsAPIVersion      = "2010-03-31"
+	awsSigningAlgo     = "AWS4-HMAC-SHA256"
+	awsMetadataURL     = "http://169.254.169.254"
+	awsContainerURL    = "http://169.254.170.2"
+	awsMetadataTimeout = 2 * time.Second
+	awsCredentialsSkew = 5 * time.Minute
+)
+
+// snsTransport publishes the body as the message of an AWS SNS topic. Requests
+// are signed with Signature Version 4 and sent through the HTTP transport, so
+// status handling and TLS settings match plain webhooks. The request URL, when
+// set, overrides the regional SNS endpoint.
+type snsTransport struct {
+	http        *httpTransport
+	topicARN    string
+	region      string
+	credentials *awsCredentialsProvider
+	now         func() time.Time
+}
+
+func (t *snsTransport) send(ctx context.Context, r *WebhookRequest) (*webhookResponse, error) {
+	endpoint := r.URL
+	if endpoint == "" {
+		endpoint = snsEndpoint(t.region)
+	}
+	u, err := neturl.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+
+	creds, err := t.credentials.retrieve()
+	if err != nil {
+		return nil, &TransportError{Err: err}
+	}
+
+	// Headers become string message attributes, so subscribers can filter on them
+	form := neturl.Values{}
+	form.Set("Action", "Publish")
+	form.Set("Version", snsAPIVersion)
+	form.Set("TopicArn", t.topicARN)
+	form.Set("Message", string(r.Body))
+	if r.Subject != "" {
+		form.Set("Subject", r.Subject)
+	}
+	names := make([]string, 0, len(r.Headers))
+	for name := range r.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		prefix := "MessageAttributes.entry." + strconv.Itoa(i+1)
+		form.Set(prefix+".Name", name)
+		form.Set(prefix+".Value.DataType", "String")
+		form.Set(prefix+".Value.StringValue", r.Headers[name])
+	}
+	body := []byte(form.Encode())
+
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded; charset=utf-8",
+	}
+	signAWSRequest(http.MethodPost, u, headers, body, creds, t.region, "sns", t.now())
+
+	return t.http.send(ctx, &WebhookRequest{
+		Method:  http.MethodPost,
+		URL:     u.String(),
+		Headers: headers,
+		Body:    body,
+	})
+}
+
+// snsEndpoint is the regional endpoint of webhooks that set no url
+func snsEndpoint(region string) string {
+	return fmt.Sprintf("https://sns.%s.amazonaws.com/", region)
+}
+
+// snsRegion returns the region of an SNS topic ARN
+// (arn:aws:sns:<region>:<account>:<topic>)
+func snsRegion(topicARN string) string {
+	parts := strings.Split(topicARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" {
+		return ""
+	}
+	return parts[3]
+}
+
+// awsCredentials holds a set of AWS credentials
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsCredentialsProvider loads AWS credentials from the environment, the ECS
+// container endpoint or the EC2 instance metadata service, in that order.
+// Credentials of the container and instance roles are cached until shortly
+// before they expire.
+type awsCredentialsProvider struct {
+	client       *http.Client
+	metadataURL  string
+	containerURL string
+	now          func() time.Time
+
+	mu     sync.Mutex
+	cached *awsCredentials
+}
+
+func newAWSCredentialsProvider() *awsCredentialsProvider {
+	return &awsCredentialsProvider{
+		client:       &http.Client{Timeout: awsMetadataTimeout},
+		metadataURL:  awsMetadataURL,
+		containerURL: awsContainerURL,
+		now:          time.Now,
+	}
+}
+
+func (p *awsCredentialsProvider) retrieve() (awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cached != nil && p.now().Add(awsCredentialsSkew).Before(p.cached.Expiration) {
+		return *p.cached, nil
+	}
+
+	var creds *awsCredentials
+	var err error
+	if path := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); path != "" {
+		creds, err = p.containerCredentials(p.containerURL + path)
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		creds, err = p.containerCredentials(uri)
+	} else {
+		creds, err = p.instanceCredentials()
+	}
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to load AWS credentials: %w", err)
+	}
+
+	p.cached = creds
+	return *creds, nil
+}
+
+// containerCredentials fetches the credentials of an ECS task role
+func (p *awsCredentialsProvider) containerCredentials(uri string) (*awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return p.fetchCredentials(req)
+}
+
+// instanceCredentials fetches the credentials of the EC2 instance role using
+// an IMDSv2 session token
+func (p *awsCredentialsProvider) instanceCredentials() (*awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodPut, p.metadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := p.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+
+	const credentialsPath = "/latest/meta-data/iam/security-credentials/"
+	req, err = http.NewRequest(http.MethodGet, p.metadataURL+credentialsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	roles, err := p.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(roles), "\n")
+	if role == "" {
+		return nil, fmt.Errorf("no instance role found")
+	}
+
+	req, err = http.NewRequest(http.MethodGet, p.metadataURL+credentialsPath+role, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return p.fetchCredentials(req)
+}
+
+func (p *awsCredentialsProvider) fetchCredentials(req *http.Request) (*awsCredentials, error) {
+	data, err := p.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &awsCredentials{}
+	if err := json.Unmarshal([]byte(data), creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials response: %w", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("credentials response has no access key")
+	}
+	return creds, nil
+}
+
+func (p *awsCredentialsProvider) fetch(req *http.Request) (string, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: status code %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+// signAWSRequest signs a request with AWS Signature Version 4. It adds the
+// X-Amz-Date, X-Amz-Security-Token and Authorization headers to headers. The
+// host and every given header are signed.
+func signAWSRequest(method string, u *neturl.URL, headers map[string]string, body []byte,
+	creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	headers["X-Amz-Date"] = amzDate
+	if creds.SessionToken != "" {
+		headers["X-Amz-Security-Token"] = creds.SessionToken
+	}
+
+	// Canonical headers are lower-case, sorted and include the host
+	canonical := map[string]string{"host": u.Host}
+	for name, value := range headers {
+		canonical[strings.ToLower(name)] = strings.Join(strings.Fields(value), " ")
+	}
+	names := make([]string, 0, len(canonical))
+	for name := range canonical {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + canonical[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		awsCanonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{awsSigningAlgo, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	headers["Authorization"] = fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgo, creds.AccessKeyID, scope, signedHeaders, signature)
+}
+
+// awsCanonicalQuery encodes the query sorted by key, with spaces as %20
+func awsCanonicalQuery(query neturl.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,210 @@
+package middlewares
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookSNS struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookSNS{})
+
+// setEnv sets or, for an empty value, unsets environment variables and
+// returns a function restoring them
+func setEnv(vars map[string]string) func() {
+	previous := make(map[string]*string)
+	for name, value := range vars {
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+
+	return func() {
+		for name, value := range previous {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+func (s *SuiteWebhookSNS) TestPublish(c *C) {
+	defer setEnv(map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "session",
+	})()
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan neturl.Values, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		form, _ := neturl.ParseQuery(string(data))
+		received <- r
+		bodies <- form
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:      "sns",
+		Type:      WebhookTypeAll,
+		Active:    true,
+		URL:       ts.URL,
+		Method:    "POST",
+		Transport: TransportSNS,
+		TopicARN:  "arn:aws:sns:eu-west-1:123456789012:alerts",
+		Subject:   "{{.JobName}} finished",
+		Headers:   map[string]string{"Job": "{{.JobName}}"},
+		Body:      "{{.JobName}} failed={{.Failed}}",
+		Timeout:   5,
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case r := <-received:
+		form := <-bodies
+		c.Assert(form.Get("Action"), Equals, "Publish")
+		c.Assert(form.Get("TopicArn"), Equals, def.TopicARN)
+		c.Assert(form.Get("Subject"), Equals, "backup finished")
+		c.Assert(form.Get("Message"), Equals, "backup failed=false")
+		c.Assert(form.Get("MessageAttributes.entry.1.Name"), Equals, "Job")
+		c.Assert(form.Get("MessageAttributes.entry.1.Value.StringValue"), Equals, "backup")
+
+		c.Assert(r.Header.Get("X-Amz-Security-Token"), Equals, "session")
+		c.Assert(r.Header.Get("Authorization"), Matches,
+			`AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/\d{8}/eu-west-1/sns/aws4_request, `+
+				`SignedHeaders=content-type;host;x-amz-date;x-amz-security-token, Signature=[0-9a-f]{64}`)
+	case <-time.After(2 * time.Second):
+		c.Fatal("message not received")
+	}
+}
+
+func (s *SuiteWebhookSNS) TestInstanceCredentials(c *C) {
+	defer setEnv(map[string]string{
+		"AWS_ACCESS_KEY_ID":                      "",
+		"AWS_SECRET_ACCESS_KEY":                  "",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     "",
+	})()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			io.WriteString(w, "imds-token")
+		case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			io.WriteString(w, "ofelia-role\n")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/ofelia-role":
+			io.WriteString(w, `{"AccessKeyId":"ASIA","SecretAccessKey":"secret","Token":"session","Expiration":"2030-01-01T00:00:00Z"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	provider := newAWSCredentialsProvider()
+	provider.metadataURL = ts.URL
+
+	creds, err := provider.retrieve()
+	c.Assert(err, IsNil)
+	c.Assert(creds.AccessKeyID, Equals, "ASIA")
+	c.Assert(creds.SessionToken, Equals, "session")
+	c.Assert(requests, Equals, 3)
+
+	// Cached until shortly before they expire
+	_, err = provider.retrieve()
+	c.Assert(err, IsNil)
+	c.Assert(requests, Equals, 3)
+
+	provider.now = func() time.Time { return time.Date(2029, 12, 31, 23, 58, 0, 0, time.UTC) }
+	_, err = provider.retrieve()
+	c.Assert(err, IsNil)
+	c.Assert(requests, Equals, 6)
+}
+
+func (s *SuiteWebhookSNS) TestValidation(c *C) {
+	def := WebhookDefinition{Name: "test", Type: WebhookTypeAll, Transport: TransportSNS}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*needs a topicArn.*")
+
+	def = WebhookDefinition{Name: "test", Type: WebhookTypeAll, Transport: TransportSNS, TopicARN: "alerts"}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*set region.*")
+
+	def.Region = "us-east-1"
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+
+	c.Assert(snsRegion("arn:aws:sns:eu-west-1:123456789012:alerts"), Equals, "eu-west-1")
+}
+
+// Test signing against the examples of the AWS Signature Version 4 test suite
+func (s *SuiteWebhookSNS) TestSignatureTestSuite(c *C) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	cases := []struct {
+		name, method, url string
+		headers           map[string]string
+		body              string
+		signedHeaders     string
+		signature         string
+	}{
+		{
+			name: "get-vanilla", method: "GET", url: "https://example.amazonaws.com/",
+			signedHeaders: "host;x-amz-date",
+			signature:     "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "get-vanilla-query-order-key-case", method: "GET", url: "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			signedHeaders: "host;x-amz-date",
+			signature:     "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name: "post-x-www-form-urlencoded", method: "POST", url: "https://example.amazonaws.com/",
+			headers:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:          "Param1=value1",
+			signedHeaders: "content-type;host;x-amz-date",
+			signature:     "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	}
+
+	for _, tc := range cases {
+		u, err := neturl.Parse(tc.url)
+		c.Assert(err, IsNil)
+		headers := map[string]string{}
+		for name, value := range tc.headers {
+			headers[name] = value
+		}
+
+		signAWSRequest(tc.method, u, headers, []byte(tc.body), creds, "us-east-1", "service", now)
+		c.Assert(headers["X-Amz-Date"], Equals, "20150830T123600Z")
+		c.Assert(headers["Authorization"], Equals, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders="+tc.signedHeaders+", Signature="+tc.signature, Commentf(tc.name))
+	}
+}
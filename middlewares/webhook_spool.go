@@ -0,0 +1,340 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpoolMaxEntries    = 1000
+	defaultSpoolRetryInterval = 30 * time.Second
+	defaultSpoolMaxAge        = 24 * time.Hour
+
+	// spoolFailedDir holds the requests the worker gave up on, kept for
+	// inspection and never retried
+	spoolFailedDir = "failed"
+)
+
+// SpoolConfig queues the rendered requests of a webhook on disk, delivered in
+// order by a background worker, so bursts are smoothed out and a restart does
+// not lose pending notifications
+type SpoolConfig struct {
+	Dir           string `json:"dir"`           // directory holding the pending requests, shared webhooks get a subdirectory each
+	MaxEntries    int    `json:"maxEntries"`    // pending requests kept, new ones are dropped beyond it, defaults to 1000
+	RetryInterval string `json:"retryInterval"` // wait after a failed delivery before trying again, defaults to 30s
+	MaxAge        string `json:"maxAge"`        // give up on requests still failing this long after they were queued, defaults to 24h
+}
+
+// spoolSecretHeaders are left out of spooled requests, so credentials are not
+// written to disk, and added back when the request is sent. Signature and
+// timestamp headers are only added when sending, so they are never spooled.
+var spoolSecretHeaders = []string{"Authorization", "Proxy-Authorization"}
+
+// spoolEntry is a spooled request as written to disk. The outcome and the
+// exec environment are not part of the request fields, so they are stored
+// next to them.
+type spoolEntry struct {
+	WebhookRequest
+	Outcome string   `json:"outcome,omitempty"` // picks the retry policy, see WebhookRequest
+	Env     []string `json:"env,omitempty"`
+}
+
+// webhookSpool is the on-disk queue of a webhook. Each pending request is a
+// JSON file named after its enqueue time, so the files sort in send order.
+type webhookSpool struct {
+	dir           string
+	maxEntries    int
+	retryInterval time.Duration
+	maxAge        time.Duration
+
+	mu     sync.Mutex // serializes enqueues, keeping the bound exact
+	seq    int
+	notify chan struct{} // wakes the worker up after an enqueue
+}
+
+// spoolDirName returns the subdirectory of the spool dir used by a webhook
+func spoolDirName(name string) (string, error) {
+	escaped := url.PathEscape(name)
+	if escaped == "" || escaped == "." || escaped == ".." {
+		return "", fmt.Errorf("webhook name %q cannot be used as a spool directory", name)
+	}
+	return escaped, nil
+}
+
+func newWebhookSpool(name string, config *SpoolConfig) (*webhookSpool, error) {
+	dirName, err := spoolDirName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	spool := &webhookSpool{
+		dir:           filepath.Join(config.Dir, dirName),
+		maxEntries:    config.MaxEntries,
+		retryInterval: defaultSpoolRetryInterval,
+		maxAge:        defaultSpoolMaxAge,
+		notify:        make(chan struct{}, 1),
+	}
+	if spool.maxEntries == 0 {
+		spool.maxEntries = defaultSpoolMaxEntries
+	}
+
+	if config.RetryInterval != "" {
+		duration, err := time.ParseDuration(config.RetryInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool retryInterval duration %q: %w", config.RetryInterval, err)
+		}
+		spool.retryInterval = duration
+	}
+
+	if config.MaxAge != "" {
+		duration, err := time.ParseDuration(config.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool maxAge duration %q: %w", config.MaxAge, err)
+		}
+		spool.maxAge = duration
+	}
+
+	if err := os.MkdirAll(spool.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return spool, nil
+}
+
+// enqueue writes a request to the spool and wakes the worker up
+func (s *webhookSpool) enqueue(req *WebhookRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, err := s.pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) >= s.maxEntries {
+		return fmt.Errorf("spool is full (%d pending requests), dropping the request", len(pending))
+	}
+
+	entry := spoolEntry{WebhookRequest: *req, Outcome: req.outcome, Env: req.env}
+	entry.Headers = make(map[string]string, len(req.Headers))
+	for key, value := range req.Headers {
+		if !isSpoolSecretHeader(key) {
+			entry.Headers[key] = value
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	// Write to a temporary name first, the worker must never see a partial file
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), s.seq%1000000)
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pending returns the spool files waiting for delivery, oldest first
+func (s *webhookSpool) pending() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if name := entry.Name(); entry.Type().IsRegular() && strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") {
+			files = append(files, filepath.Join(s.dir, name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// run delivers the spooled requests of the webhook until it is cancelled.
+// Requests left over by a previous run are sent first.
+func (s *webhookSpool) run(w *Webhook) {
+	for {
+		wait := s.drain(w)
+		if wait == 0 {
+			select {
+			case <-s.notify:
+			case <-w.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-w.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// drain sends the pending requests in order, deleting each once delivered.
+// Requests that can never be delivered, and those still failing after maxAge,
+// are moved to the failed subdirectory so they do not hold up the rest. It
+// stops at any other failure and returns how long to wait before trying
+// again, or 0 once the spool is empty.
+func (s *webhookSpool) drain(w *Webhook) time.Duration {
+	files, err := s.pending()
+	if err != nil {
+		w.logger.Errorf("Webhook %q: %v", w.name, err)
+		return s.retryInterval
+	}
+
+	for i, file := range files {
+		if w.ctx.Err() != nil {
+			return s.retryInterval
+		}
+
+		req, err := readSpoolFile(file)
+		if err != nil {
+			// A corrupt file would block the spool forever
+			w.logger.Errorf("Webhook %q: dropping unreadable spool file %q: %v", w.name, file, err)
+			os.Remove(file)
+			continue
+		}
+
+		w.addSpoolSecrets(req)
+
+		// The allowlist may have changed since the request was queued
+		if host, ok := w.checkEndpoints(req); !ok {
+			s.giveUp(w, file, fmt.Errorf("host %q is not in webhook-allowed-hosts", host))
+			continue
+		}
+
+		if err := w.sendRendered(w.logger, req); err != nil {
+			if w.ctx.Err() != nil {
+				return s.retryInterval
+			}
+			if permanentFailure(err) {
+				s.giveUp(w, file, err)
+				continue
+			}
+			if age := time.Since(spoolFileTime(file)); age > s.maxAge {
+				s.giveUp(w, file, fmt.Errorf("still failing after %v: %w", age.Round(time.Second), err))
+				continue
+			}
+			w.logger.Warningf("Webhook %q: delivery failed, %d spooled requests kept for retry in %v", w.name, len(files)-i, s.retryInterval)
+			return s.retryInterval
+		}
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			w.logger.Errorf("Webhook %q: failed to remove delivered spool file: %v", w.name, err)
+		}
+	}
+	return 0
+}
+
+// isSpoolSecretHeader reports whether a header is left out of spool files
+func isSpoolSecretHeader(name string) bool {
+	for _, secret := range spoolSecretHeaders {
+		if strings.EqualFold(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// addSpoolSecrets adds back the credentials left out of a spooled request:
+// the webhook's own secret headers, static as checked at load, and the token
+// file
+func (w *Webhook) addSpoolSecrets(req *WebhookRequest) {
+	for key, value := range w.headers {
+		if isSpoolSecretHeader(key) && value != "" {
+			req.Headers[key] = value
+		}
+	}
+	w.addToken(w.logger, req.Headers)
+}
+
+// giveUp moves a request the worker will not retry to the failed
+// subdirectory, removing it when that is not possible
+func (s *webhookSpool) giveUp(w *Webhook, file string, cause error) {
+	failed := filepath.Join(s.dir, spoolFailedDir)
+	err := os.MkdirAll(failed, 0700)
+	if err == nil {
+		err = os.Rename(file, filepath.Join(failed, filepath.Base(file)))
+	}
+	if err != nil {
+		w.logger.Errorf("Webhook %q: dropping spooled request %q: %v (failed to keep it: %v)", w.name, filepath.Base(file), cause, err)
+		os.Remove(file)
+		return
+	}
+	w.logger.Errorf("Webhook %q: giving up on spooled request, moved to %s: %v", w.name, filepath.Join(failed, filepath.Base(file)), cause)
+}
+
+// permanentFailure reports whether a failed delivery cannot succeed on a
+// later try: the request could not be built, or the endpoint refused it with
+// a client error other than a timeout or rate limit
+func permanentFailure(err error) bool {
+	if errors.Is(err, errInvalidRequest) {
+		return true
+	}
+
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.Rejected {
+		return false
+	}
+	switch code := statusErr.StatusCode; {
+	case code == http.StatusRequestTimeout, code == http.StatusTooEarly, code == http.StatusTooManyRequests:
+		return false
+	default:
+		return code >= 400 && code < 500
+	}
+}
+
+// spoolFileTime returns when a spool file was queued, from its name
+func spoolFileTime(file string) time.Time {
+	stamp, _, _ := strings.Cut(filepath.Base(file), "-")
+	nanos, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// readSpoolFile decodes a spooled request
+func readSpoolFile(path string) (*WebhookRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry spoolEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	req := &entry.WebhookRequest
+	req.outcome = entry.Outcome
+	req.env = entry.Env
+	if req.Headers == nil {
+		req.Headers = make(map[string]string)
+	}
+	return req, nil
+}
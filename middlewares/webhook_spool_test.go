@@ -0,0 +1,373 @@
+package middlewares
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookSpool struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookSpool{})
+
+// spoolFiles returns the pending requests of a webhook spool
+func spoolFiles(c *C, dir, name string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, name, "*.json"))
+	c.Assert(err, IsNil)
+	return files
+}
+
+func (s *SuiteWebhookSpool) TestDeliverAfterFailure(c *C) {
+	var up atomic.Bool
+	received := make(chan string, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	dir := c.MkDir()
+	def := WebhookDefinition{
+		Name:  "alerts",
+		Type:  WebhookTypeAll,
+		URL:   ts.URL,
+		Body:  "{{.JobName}}",
+		Spool: &SpoolConfig{Dir: dir, RetryInterval: "10ms"},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	defer wh.Cancel()
+
+	// Sends return at once, the requests wait in the spool while failing
+	wh.send(&TestLogger{}, &WebhookTemplateData{JobName: "first"})
+	wh.send(&TestLogger{}, &WebhookTemplateData{JobName: "second"})
+	c.Assert(spoolFiles(c, dir, "alerts"), HasLen, 2)
+
+	// Once the endpoint recovers they are delivered in order and removed
+	up.Store(true)
+	c.Assert(<-received, Equals, "first")
+	c.Assert(<-received, Equals, "second")
+	for i := 0; i < 100 && len(spoolFiles(c, dir, "alerts")) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(spoolFiles(c, dir, "alerts"), HasLen, 0)
+}
+
+func (s *SuiteWebhookSpool) TestRestart(c *C) {
+	received := make(chan string, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	dir := c.MkDir()
+	def := WebhookDefinition{
+		Name:  "alerts",
+		Type:  WebhookTypeAll,
+		URL:   ts.URL,
+		Body:  "{{.JobName}}",
+		Spool: &SpoolConfig{Dir: dir, MaxEntries: 2},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+
+	// A stopped worker leaves the requests in the spool, up to maxEntries
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	webhook.(*Webhook).Cancel()
+	logger := &recordingLogger{}
+	for _, name := range []string{"first", "second", "third"} {
+		webhook.(*Webhook).send(logger, &WebhookTemplateData{JobName: name})
+	}
+	c.Assert(logger.errors, DeepEquals, []string{`Webhook "alerts": spool is full (2 pending requests), dropping the request`})
+	c.Assert(spoolFiles(c, dir, "alerts"), HasLen, 2)
+	c.Assert(received, HasLen, 0)
+
+	// The next start delivers them
+	webhook, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	defer webhook.(*Webhook).Cancel()
+	c.Assert(<-received, Equals, "first")
+	c.Assert(<-received, Equals, "second")
+}
+
+func (s *SuiteWebhookSpool) TestCancel(c *C) {
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	dir := c.MkDir()
+	def := WebhookDefinition{Name: "alerts", Type: WebhookTypeAll, URL: ts.URL, Spool: &SpoolConfig{Dir: dir, RetryInterval: "10ms"}}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	wh.send(&TestLogger{}, &WebhookTemplateData{JobName: "backup"})
+	for i := 0; i < 100 && attempts.Load() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Cancel returns once the worker has stopped, the request stays spooled.
+	// A request already on the wire may still reach the server, so let it
+	// land before counting.
+	wh.Cancel()
+	time.Sleep(20 * time.Millisecond)
+	stopped := attempts.Load()
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(attempts.Load(), Equals, stopped)
+	c.Assert(spoolFiles(c, dir, "alerts"), HasLen, 1)
+}
+
+// Test spooled requests keep the retry policy of their outcome
+func (s *SuiteWebhookSpool) TestRetryPerOutcome(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	results := make(chan SendResult, 2)
+	OnSendResult = func(r SendResult) { results <- r }
+	defer func() { OnSendResult = nil }()
+
+	def := WebhookDefinition{
+		Name:         "alerts",
+		Type:         WebhookTypeAll,
+		URL:          ts.URL,
+		RetryOnError: &RetryConfig{Count: 2, Backoff: "1ms"},
+		Spool:        &SpoolConfig{Dir: c.MkDir(), RetryInterval: "1h"},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	defer wh.Cancel()
+
+	wh.send(&TestLogger{}, &WebhookTemplateData{JobName: "backup", Failed: true})
+
+	select {
+	case r := <-results:
+		c.Assert(r.Attempts, Equals, 3)
+	case <-time.After(2 * time.Second):
+		c.Fatal("spooled request not sent")
+	}
+}
+
+func (s *SuiteWebhookSpool) TestCorruptFile(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "alerts"), 0700), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "alerts", "00000000000000000001-000001.json"), []byte("{"), 0600), IsNil)
+
+	def := WebhookDefinition{Name: "alerts", Type: WebhookTypeAll, URL: "http://127.0.0.1:1", Spool: &SpoolConfig{Dir: dir}}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	logger := &recordingLogger{}
+	webhook, err := NewWebhookFromDefinition(def, logger)
+	c.Assert(err, IsNil)
+	defer webhook.(*Webhook).Cancel()
+
+	for i := 0; i < 100 && len(spoolFiles(c, dir, "alerts")) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(spoolFiles(c, dir, "alerts"), HasLen, 0)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	c.Assert(logger.errors, HasLen, 1)
+	c.Assert(logger.errors[0], Matches, `Webhook "alerts": dropping unreadable spool file .*`)
+}
+
+func (s *SuiteWebhookSpool) TestInvalidConfig(c *C) {
+	def := WebhookDefinition{Name: "n", Type: "all", URL: "http://a", Spool: &SpoolConfig{}}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*spool requires a dir")
+
+	def = WebhookDefinition{Name: "n", Type: "all", URL: "http://a", Spool: &SpoolConfig{Dir: c.MkDir(), MaxEntries: -1}}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*invalid spool maxEntries -1.*")
+
+	def = WebhookDefinition{Name: "n", Type: "all", URL: "http://a", Spool: &SpoolConfig{Dir: c.MkDir(), RetryInterval: "soon"}}
+	_, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, `invalid spool retryInterval duration "soon".*`)
+}
+
+// Test spooled requests keep the execution data of exec webhooks
+func (s *SuiteWebhookSpool) TestKeepsExecEnv(c *C) {
+	dir := c.MkDir()
+	spool, err := newWebhookSpool("script", &SpoolConfig{Dir: dir})
+	c.Assert(err, IsNil)
+
+	env := []string{"OFELIA_JOB_NAME=backup", "OFELIA_STATUS=error"}
+	c.Assert(spool.enqueue(&WebhookRequest{Webhook: "script", Body: []byte("x"), env: env}), IsNil)
+
+	files := spoolFiles(c, dir, "script")
+	c.Assert(files, HasLen, 1)
+	req, err := readSpoolFile(files[0])
+	c.Assert(err, IsNil)
+	c.Assert(req.env, DeepEquals, env)
+}
+
+// Test a request the endpoint refuses does not hold up the ones behind it
+func (s *SuiteWebhookSpool) TestPermanentFailure(c *C) {
+	received := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- string(body)
+	}))
+	defer ts.Close()
+
+	dir := c.MkDir()
+	def := WebhookDefinition{
+		Name:  "alerts",
+		Type:  WebhookTypeAll,
+		URL:   ts.URL,
+		Body:  "{{.JobName}}",
+		Retry: &RetryConfig{Count: 0},
+		Spool: &SpoolConfig{Dir: dir, RetryInterval: "1h"},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	defer wh.Cancel()
+
+	wh.send(&TestLogger{}, &WebhookTemplateData{JobName: "bad"})
+	wh.send(&TestLogger{}, &WebhookTemplateData{JobName: "good"})
+
+	select {
+	case body := <-received:
+		c.Assert(body, Equals, "good")
+	case <-time.After(2 * time.Second):
+		c.Fatal("request behind the refused one not delivered")
+	}
+
+	// The refused request is kept aside, out of the queue
+	for i := 0; i < 100 && len(spoolFiles(c, dir, "alerts")) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(spoolFiles(c, dir, "alerts"), HasLen, 0)
+	c.Assert(spoolFiles(c, dir, filepath.Join("alerts", spoolFailedDir)), HasLen, 1)
+}
+
+// Test requests still failing after maxAge are given up on
+func (s *SuiteWebhookSpool) TestMaxAge(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	dir := c.MkDir()
+	spool, err := newWebhookSpool("alerts", &SpoolConfig{Dir: dir, MaxAge: "1h"})
+	c.Assert(err, IsNil)
+	c.Assert(spool.enqueue(&WebhookRequest{Webhook: "alerts", Method: "POST", URL: ts.URL}), IsNil)
+
+	def := WebhookDefinition{Name: "alerts", Type: WebhookTypeAll, URL: ts.URL, Retry: &RetryConfig{Count: 0}}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	// Still young, kept for the next try
+	c.Assert(spool.drain(webhook.(*Webhook)), Equals, spool.retryInterval)
+	c.Assert(spoolFiles(c, dir, "alerts"), HasLen, 1)
+
+	spool.maxAge = time.Nanosecond
+	c.Assert(spool.drain(webhook.(*Webhook)), Equals, time.Duration(0))
+	c.Assert(spoolFiles(c, dir, "alerts"), HasLen, 0)
+	c.Assert(spoolFiles(c, dir, filepath.Join("alerts", spoolFailedDir)), HasLen, 1)
+}
+
+func (s *SuiteWebhookSpool) TestPermanentFailureErrors(c *C) {
+	c.Assert(permanentFailure(&HTTPStatusError{StatusCode: http.StatusBadRequest}), Equals, true)
+	c.Assert(permanentFailure(fmt.Errorf("%w: bad url", errInvalidRequest)), Equals, true)
+	c.Assert(permanentFailure(&HTTPStatusError{StatusCode: http.StatusTooManyRequests}), Equals, false)
+	c.Assert(permanentFailure(&HTTPStatusError{StatusCode: http.StatusBadGateway}), Equals, false)
+	c.Assert(permanentFailure(&HTTPStatusError{StatusCode: http.StatusBadRequest, Rejected: true}), Equals, false)
+	c.Assert(permanentFailure(errCircuitOpen), Equals, false)
+}
+
+// Test credentials are not written to the spool and are sent all the same
+func (s *SuiteWebhookSpool) TestSecretHeaders(c *C) {
+	var up atomic.Bool
+	received := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- r.Header
+	}))
+	defer ts.Close()
+
+	token := filepath.Join(c.MkDir(), "token")
+	c.Assert(os.WriteFile(token, []byte("s3cr3t\n"), 0600), IsNil)
+
+	dir := c.MkDir()
+	def := WebhookDefinition{
+		Name:      "alerts",
+		Type:      WebhookTypeAll,
+		URL:       ts.URL,
+		Headers:   map[string]string{"proxy-authorization": "Basic cHJveHk=", "X-Job": "{{.JobName}}"},
+		TokenFile: token,
+		Spool:     &SpoolConfig{Dir: dir, RetryInterval: "10ms"},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	defer wh.Cancel()
+
+	wh.send(&TestLogger{}, &WebhookTemplateData{JobName: "backup"})
+	var files []string
+	for i := 0; i < 100 && len(files) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		files = spoolFiles(c, dir, "alerts")
+	}
+	c.Assert(files, HasLen, 1)
+	data, err := os.ReadFile(files[0])
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Not(Matches), "(?s).*(s3cr3t|cHJveHk=).*")
+	c.Assert(string(data), Matches, `(?s).*"X-Job":"backup".*`)
+
+	up.Store(true)
+	select {
+	case header := <-received:
+		c.Assert(header.Get("Authorization"), Equals, "Bearer s3cr3t")
+		c.Assert(header.Get("Proxy-Authorization"), Equals, "Basic cHJveHk=")
+		c.Assert(header.Get("X-Job"), Equals, "backup")
+	case <-time.After(2 * time.Second):
+		c.Fatal("spooled request not delivered")
+	}
+}
+
+func (s *SuiteWebhookSpool) TestInvalidDirName(c *C) {
+	for _, name := range []string{".", ".."} {
+		def := WebhookDefinition{Name: name, Type: WebhookTypeAll, URL: "http://example.com", Spool: &SpoolConfig{Dir: c.MkDir()}}
+		c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `webhook name ".*" cannot be used as a spool directory`)
+		_, err := newWebhookSpool(name, def.Spool)
+		c.Assert(err, NotNil)
+	}
+
+	def := WebhookDefinition{Name: "alerts", Type: WebhookTypeAll, URL: "http://example.com", Spool: &SpoolConfig{Dir: c.MkDir()}}
+	def.Headers = map[string]string{"Authorization": "Bearer {{.JobName}}"}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `webhook "alerts": header "Authorization" cannot be templated with spool, it is not written to disk`)
+}
@@ -3,12 +3,20 @@ package middlewares
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"github.com/armon/circbuf"
 	"github.com/mcuadros/ofelia/core"
 )
 
@@ -25,6 +33,21 @@ type WebhookTemplateData struct {
 	EndTime     time.Time
 	Duration    string
 
+	// Duration as a value, for helpers and methods such as .DurationRaw.Minutes,
+	// and as a number of seconds, for comparisons in templates
+	DurationRaw     time.Duration
+	DurationSeconds float64
+
+	// Start and end times preformatted, Unix seconds and RFC3339
+	StartTimeUnix int64
+	EndTimeUnix   int64
+	StartTimeISO  string
+	EndTimeISO    string
+
+	// What started the execution, "schedule" or "manual"
+	TriggeredBy string
+	Manual      bool
+
 	// Status flags
 	IsRunning bool
 	Failed    bool
@@ -39,13 +62,95 @@ type WebhookTemplateData struct {
 	Stdout string
 	Stderr string
 
+	// Output summaries
+	StdoutLines    int
+	StderrLines    int
+	LastStderrLine string
+
+	// Previous execution of the same job, zero values on the first run
+	HasPrevious     bool
+	PrevExecutionID string
+	PrevDuration    time.Duration
+	PrevFailed      bool
+	PrevSkipped     bool
+
 	// Metadata
 	Hostname  string
 	Timestamp string
+
+	// routedFailed is set when the webhook counted the execution as failed,
+	// which includes successes with stderr output under failOnStderr
+	routedFailed bool
+}
+
+// executionSummary is the part of an execution kept in memory for the next run
+type executionSummary struct {
+	ID       string
+	Duration time.Duration
+	Failed   bool
+	Skipped  bool
+}
+
+// jobHistory holds the two most recent executions of a job
+type jobHistory struct {
+	last     *executionSummary
+	previous *executionSummary
+}
+
+var (
+	executionHistoryMu sync.Mutex
+	executionHistory   = make(map[string]*jobHistory)
+)
+
+// recordExecution stores the finished execution as the latest of its job.
+// Recording the same execution again only refreshes it, so it is safe to call
+// from every webhook middleware in the chain.
+func recordExecution(ctx *core.Context) {
+	summary := &executionSummary{
+		ID:       ctx.Execution.ID,
+		Duration: ctx.Execution.Duration,
+		Failed:   ctx.Execution.Failed,
+		Skipped:  ctx.Execution.Skipped,
+	}
+
+	executionHistoryMu.Lock()
+	defer executionHistoryMu.Unlock()
+
+	name := ctx.Job.GetName()
+	history, ok := executionHistory[name]
+	if !ok {
+		history = &jobHistory{}
+		executionHistory[name] = history
+	}
+
+	if history.last != nil && history.last.ID == summary.ID {
+		history.last = summary
+		return
+	}
+
+	history.previous = history.last
+	history.last = summary
+}
+
+// previousExecution returns the execution of the job that ran before the
+// given one, or nil on the first run
+func previousExecution(jobName, executionID string) *executionSummary {
+	executionHistoryMu.Lock()
+	defer executionHistoryMu.Unlock()
+
+	history, ok := executionHistory[jobName]
+	if !ok {
+		return nil
+	}
+
+	if history.last != nil && history.last.ID == executionID {
+		return history.previous
+	}
+	return history.last
 }
 
 // buildTemplateData creates template data from execution context
-func buildTemplateData(ctx *core.Context) *WebhookTemplateData {
+func buildTemplateData(ctx *core.Context, includeOutput bool, maxOutput int, delimiter string) *WebhookTemplateData {
 	hostname, _ := os.Hostname()
 
 	data := &WebhookTemplateData{
@@ -60,6 +165,13 @@ func buildTemplateData(ctx *core.Context) *WebhookTemplateData {
 		EndTime:     ctx.Execution.Date.Add(ctx.Execution.Duration),
 		Duration:    ctx.Execution.Duration.String(),
 
+		DurationRaw:     ctx.Execution.Duration,
+		DurationSeconds: ctx.Execution.Duration.Seconds(),
+
+		// Trigger
+		TriggeredBy: ctx.Execution.TriggeredBy,
+		Manual:      ctx.Execution.TriggeredBy == core.TriggerManual,
+
 		// Status
 		IsRunning: ctx.Execution.IsRunning,
 		Failed:    ctx.Execution.Failed,
@@ -71,47 +183,137 @@ func buildTemplateData(ctx *core.Context) *WebhookTemplateData {
 		Timestamp: ctx.Execution.Date.Format(time.RFC3339),
 	}
 
+	data.StartTimeUnix = data.StartTime.Unix()
+	data.EndTimeUnix = data.EndTime.Unix()
+	data.StartTimeISO = data.StartTime.Format(time.RFC3339)
+	data.EndTimeISO = data.EndTime.Format(time.RFC3339)
+
+	// The scheduler is the only origin that may not be recorded
+	if data.TriggeredBy == "" {
+		data.TriggeredBy = core.TriggerSchedule
+	}
+
+	// Previous execution
+	if prev := previousExecution(data.JobName, data.ExecutionID); prev != nil {
+		data.HasPrevious = true
+		data.PrevExecutionID = prev.ID
+		data.PrevDuration = prev.Duration
+		data.PrevFailed = prev.Failed
+		data.PrevSkipped = prev.Skipped
+	}
+
 	// Error handling
 	if ctx.Execution.Error != nil {
 		data.Error = ctx.Execution.Error.Error()
 		data.HasError = true
 	}
 
-	// Output streams
+	// Output streams, copying them can be skipped for webhooks that never
+	// show the output
+	if !includeOutput {
+		return data
+	}
 	if ctx.Execution.OutputStream != nil {
-		data.Stdout = ctx.Execution.OutputStream.String()
+		data.Stdout = readOutput(ctx.Execution.OutputStream, maxOutput, delimiter)
 	}
 	if ctx.Execution.ErrorStream != nil {
-		data.Stderr = ctx.Execution.ErrorStream.String()
+		data.Stderr = readOutput(ctx.Execution.ErrorStream, maxOutput, delimiter)
 	}
 
+	data.StdoutLines = countLines(data.Stdout)
+	data.StderrLines = countLines(data.Stderr)
+	data.LastStderrLine = lastLine(data.Stderr)
+
 	return data
 }
 
+// countLines returns the number of lines in s, a trailing newline does not
+// start a new line
+func countLines(s string) int {
+	if s == "" {
+		return 0
+	}
+
+	return strings.Count(strings.TrimSuffix(s, "\n"), "\n") + 1
+}
+
+// lastLine returns the last non-blank line of s
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\r\n"), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimRight(lines[i], "\r"); strings.TrimSpace(line) != "" {
+			return line
+		}
+	}
+
+	return ""
+}
+
 // webhookFuncMap provides template helper functions
 var webhookFuncMap = template.FuncMap{
 	// String manipulation
-	"upper":    strings.ToUpper,
-	"lower":    strings.ToLower,
-	"trim":     strings.TrimSpace,
-	"truncate": truncateString,
+	"upper":        strings.ToUpper,
+	"lower":        strings.ToLower,
+	"trim":         strings.TrimSpace,
+	"truncate":     truncateString,
+	"regexReplace": regexReplace,
+	"mask":         maskString,
+	"maskN":        maskStringN,
 
 	// JSON encoding
 	"json":       jsonEncode,
 	"jsonEscape": jsonEscapeString,
+	"quote":      jsonQuoteString,
+
+	// URL encoding, text/template also provides the urlquery builtin
+	"urlEncode": url.QueryEscape,
+	"urlQuery":  urlQuery,
+	"urlpath":   url.PathEscape,
 
 	// Time formatting
-	"formatTime": formatTime,
-	"unixTime":   unixTimestamp,
+	"formatTime":  formatTime,
+	"unixTime":    unixTimestamp,
+	"now":         currentTime,
+	"addDuration": addDuration,
+
+	// Duration arithmetic
+	"durationSeconds": durationSeconds,
+	"subDuration":     subDuration,
 
 	// Conditionals
-	"default": defaultValue,
+	"default":  defaultValue,
+	"coalesce": coalesce,
+	"skip":     skipValue,
 
 	// Status helpers
 	"statusCode": statusCode,
 	"colorHex":   statusColorHex,
 }
 
+// readOutput returns at most max bytes from the end of a stream, its most
+// recent output. A max of 0 returns everything. With a delimiter only the
+// output after its last occurrence is kept, without the line break that may
+// follow it. circbuf cannot read just the tail, so once the buffer has
+// wrapped, Bytes copies all of it before max is applied; the size of the
+// stream, not max, bounds that copy.
+func readOutput(stream *circbuf.Buffer, max int, delimiter string) string {
+	data := stream.Bytes()
+	if delimiter != "" {
+		if i := bytes.LastIndex(data, []byte(delimiter)); i >= 0 {
+			data = data[i+len(delimiter):]
+			data = bytes.TrimPrefix(bytes.TrimPrefix(data, []byte("\r")), []byte("\n"))
+		}
+	}
+	if max > 0 && len(data) > max {
+		data = data[len(data)-max:]
+		// Do not start in the middle of a UTF-8 sequence
+		for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.RuneStart(data[0]); i++ {
+			data = data[1:]
+		}
+	}
+	return string(data)
+}
+
 // truncateString truncates a string to a maximum length
 func truncateString(maxLen int, s string) string {
 	if len(s) <= maxLen {
@@ -123,6 +325,49 @@ func truncateString(maxLen int, s string) string {
 	return s[:maxLen-3] + "..."
 }
 
+// defaultMaskVisible is how many characters mask keeps at each end
+const defaultMaskVisible = 4
+
+// maskString hides the middle of a secret, keeping the first and last 4
+// characters, e.g. abcd****wxyz
+func maskString(s string) string {
+	return maskStringN(defaultMaskVisible, s)
+}
+
+// maskStringN hides the middle of a secret, keeping the first and last n
+// characters. The hidden part is always 4 asterisks so the length of the
+// secret does not leak, and a string too short to keep 2n characters and
+// still hide some is masked entirely.
+func maskStringN(n int, s string) string {
+	if s == "" {
+		return ""
+	}
+	runes := []rune(s)
+	if n <= 0 || len(runes) <= 2*n {
+		return "****"
+	}
+	return string(runes[:n]) + "****" + string(runes[len(runes)-n:])
+}
+
+// regexps caches the patterns of regexReplace by their text, like the
+// templates using them they come from the config
+var regexps sync.Map
+
+// regexReplace replaces the matches of pattern in s, e.g. to mask secrets in
+// {{.Stdout | regexReplace "sk-[A-Za-z0-9]+" "sk-***"}}. The replacement
+// may refer to groups as $1. An invalid pattern fails the template.
+func regexReplace(pattern, replacement, s string) (string, error) {
+	re, ok := regexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", fmt.Errorf("invalid regexReplace pattern: %w", err)
+		}
+		re, _ = regexps.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).ReplaceAllString(s, replacement), nil
+}
+
 // jsonEncode encodes a value as JSON
 func jsonEncode(v interface{}) (string, error) {
 	data, err := json.Marshal(v)
@@ -143,11 +388,89 @@ func jsonEscapeString(s string) string {
 	return result
 }
 
+// jsonQuoteString returns s as a quoted JSON string literal
+func jsonQuoteString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
 // formatTime formats a time value with a custom layout
 func formatTime(layout string, t time.Time) string {
 	return t.Format(layout)
 }
 
+// templateNow is the clock used by the now helper, replaceable in tests
+var templateNow = time.Now
+
+// currentTime returns the current time
+func currentTime() time.Time {
+	return templateNow()
+}
+
+// addDuration adds a duration such as "-1h" or "30m" to a time value
+func addDuration(t time.Time, duration string) (time.Time, error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Add(d), nil
+}
+
+// toDuration accepts a duration string such as "1m30s", as in .Duration, or a
+// time.Duration, as in .PrevDuration
+func toDuration(v interface{}) (time.Duration, error) {
+	switch d := v.(type) {
+	case time.Duration:
+		return d, nil
+	case string:
+		return time.ParseDuration(d)
+	default:
+		return 0, fmt.Errorf("expected a duration, got %T", v)
+	}
+}
+
+// durationSeconds converts a duration to seconds, so it can be compared with
+// gt or lt, e.g. {{if gt (durationSeconds .Duration) 300.0}}
+func durationSeconds(v interface{}) (float64, error) {
+	d, err := toDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	return d.Seconds(), nil
+}
+
+// subDuration returns a minus b, e.g. how long a job overran its budget with
+// {{subDuration .Duration "5m"}}
+func subDuration(a, b interface{}) (time.Duration, error) {
+	x, err := toDuration(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toDuration(b)
+	if err != nil {
+		return 0, err
+	}
+	return x - y, nil
+}
+
+// urlQuery builds an encoded query string from alternating keys and values
+func urlQuery(pairs ...interface{}) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("urlQuery expects key/value pairs, got %d arguments", len(pairs))
+	}
+
+	values := url.Values{}
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return "", fmt.Errorf("urlQuery key at position %d must be a string, got %T", i, pairs[i])
+		}
+		values.Add(key, fmt.Sprint(pairs[i+1]))
+	}
+
+	return values.Encode(), nil
+}
+
 // unixTimestamp returns the Unix timestamp for a time value
 func unixTimestamp(t time.Time) int64 {
 	return t.Unix()
@@ -161,6 +484,26 @@ func defaultValue(defaultVal, value string) string {
 	return value
 }
 
+// coalesce returns the first non-empty of its arguments, e.g.
+// {{coalesce .Error .LastStderrLine "unknown"}}
+func coalesce(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// skipSentinel marks a header value that must be dropped
+const skipSentinel = "\x00ofelia:skip\x00"
+
+// skipValue drops the header whose value it is rendered into, e.g.
+// {{if not .Failed}}{{skip}}{{end}}high
+func skipValue() string {
+	return skipSentinel
+}
+
 // statusCode returns a numeric status code (0=success, 1=failure, 2=skipped)
 func statusCode(data *WebhookTemplateData) int {
 	if data.Skipped {
@@ -183,11 +526,168 @@ func statusColorHex(data *WebhookTemplateData) string {
 	return "#00FF00" // Green
 }
 
-// executeTemplate executes a template string with the given data
-func executeTemplate(templateStr string, data *WebhookTemplateData) (string, error) {
-	tmpl, err := template.New("webhook").Funcs(webhookFuncMap).Parse(templateStr)
+var (
+	webhookPartialsMu sync.RWMutex
+	webhookPartials   *template.Template
+)
+
+// loadWebhookPartials parses every *.tmpl file of dir, and the inline
+// partials keyed by name, into the shared set of partials webhook templates
+// can invoke with {{template "name" .}}. Files are named after their file, or
+// with {{define "name"}} blocks. No dir and no inline partials clears them.
+func loadWebhookPartials(dir string, inline map[string]string) error {
+	var partials *template.Template
+	if dir != "" {
+		var err error
+		partials, err = template.New("partials").Funcs(webhookFuncMap).ParseGlob(filepath.Join(dir, "*.tmpl"))
+		if err != nil {
+			return fmt.Errorf("failed to load templates from %q: %w", dir, err)
+		}
+	}
+
+	names := make([]string, 0, len(inline))
+	for name := range inline {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if partials == nil {
+			partials = template.New("partials").Funcs(webhookFuncMap)
+		}
+		if partials.Lookup(name) != nil {
+			return fmt.Errorf("partial %q is defined both inline and in %q", name, dir)
+		}
+		if _, err := partials.New(name).Parse(inline[name]); err != nil {
+			return fmt.Errorf("failed to parse partial %q: %w", name, err)
+		}
+	}
+
+	webhookPartialsMu.Lock()
+	defer webhookPartialsMu.Unlock()
+	webhookPartials = partials
+
+	// Webhooks parse their templates when they are built, so only those built
+	// from now on see the new partials
+	return nil
+}
+
+// newWebhookTemplate returns an empty template that can invoke the partials
+func newWebhookTemplate() (*template.Template, error) {
+	webhookPartialsMu.RLock()
+	partials := webhookPartials
+	webhookPartialsMu.RUnlock()
+
+	if partials == nil {
+		return template.New("webhook").Funcs(webhookFuncMap), nil
+	}
+
+	set, err := partials.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return set.New("webhook"), nil
+}
+
+// parseTemplate parses the given text into a template that can invoke the
+// partials
+func parseTemplate(templateStr string) (*template.Template, error) {
+	tmpl, err := newWebhookTemplate()
 	if err != nil {
-		return "", fmt.Errorf("template parse error: %w", err)
+		return nil, err
+	}
+	return tmpl.Parse(templateStr)
+}
+
+// webhookTemplates holds the parsed templates of a webhook keyed by their
+// text. It is filled when the webhook is built and only read afterwards, so
+// sends share it without locking and it goes away with the webhook. Texts it
+// does not hold are parsed on every use.
+type webhookTemplates map[string]*template.Template
+
+// add parses a template text unless it is already held
+func (t webhookTemplates) add(text string) error {
+	if _, ok := t[text]; ok {
+		return nil
+	}
+	tmpl, err := parseTemplate(text)
+	if err != nil {
+		return err
+	}
+	t[text] = tmpl
+	return nil
+}
+
+// bodyTemplates returns the template texts executeTemplateForBody renders for
+// a body, or the leaves executeLeafBody renders, including every status of a
+// body keyed by status
+func bodyTemplates(body interface{}, byStatus, leaves bool) ([]string, error) {
+	if bodies, ok := body.(map[string]interface{}); ok && byStatus {
+		var templates []string
+		for _, status := range []string{"success", "error", "skipped", "running", "default"} {
+			statusTemplates, err := bodyTemplates(bodies[status], false, leaves)
+			if err != nil {
+				return nil, err
+			}
+			templates = append(templates, statusTemplates...)
+		}
+		return templates, nil
+	}
+
+	if leaves {
+		return leafTemplates(body), nil
+	}
+
+	switch v := body.(type) {
+	case string:
+		return []string{v}, nil
+	case map[string]interface{}, []interface{}:
+		jsonBytes, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JSON body: %w", err)
+		}
+		return []string{string(jsonBytes)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// leafTemplates returns every string leaf of a body
+func leafTemplates(body interface{}) []string {
+	switch v := body.(type) {
+	case string:
+		return []string{v}
+	case map[string]interface{}:
+		var templates []string
+		for _, value := range v {
+			templates = append(templates, leafTemplates(value)...)
+		}
+		return templates
+	case []interface{}:
+		var templates []string
+		for _, value := range v {
+			templates = append(templates, leafTemplates(value)...)
+		}
+		return templates
+	default:
+		return nil
+	}
+}
+
+// executeTemplate executes a template string with the given data, parsing it
+// first
+func executeTemplate(templateStr string, data interface{}) (string, error) {
+	return webhookTemplates(nil).execute(templateStr, data)
+}
+
+// execute executes a template string with the given data, with the parsed
+// template when it is held
+func (t webhookTemplates) execute(templateStr string, data interface{}) (string, error) {
+	tmpl, ok := t[templateStr]
+	if !ok {
+		var err error
+		if tmpl, err = parseTemplate(templateStr); err != nil {
+			return "", fmt.Errorf("template parse error: %w", err)
+		}
 	}
 
 	var buf bytes.Buffer
@@ -198,12 +698,108 @@ func executeTemplate(templateStr string, data *WebhookTemplateData) (string, err
 	return buf.String(), nil
 }
 
+// selectBodyByStatus picks the sub-body matching the execution status from a
+// body keyed by "success", "error" or "skipped", falling back to "default".
+// Nil is returned when nothing matches, so the request is sent without body.
+func selectBodyByStatus(body interface{}, data interface{}) interface{} {
+	bodies, ok := body.(map[string]interface{})
+	if !ok {
+		return body
+	}
+
+	if td, ok := data.(*WebhookTemplateData); ok {
+		if selected, ok := bodies[executionStatus(td)]; ok {
+			return selected
+		}
+	}
+
+	return bodies["default"]
+}
+
+// executionStatus names the outcome of an execution: "success", "error",
+// "skipped" or "running"
+func executionStatus(td *WebhookTemplateData) string {
+	switch {
+	case td.Failed:
+		return "error"
+	case td.Skipped:
+		return "skipped"
+	case td.IsRunning:
+		return "running"
+	}
+	return "success"
+}
+
+// executeLeafBody renders an object body by templating each string leaf on
+// its own and encoding the result, so rendered values never need escaping and
+// template actions are not mangled by JSON quoting. Rendered leaves stay
+// strings; numbers, booleans and null are kept as-is.
+func executeLeafBody(body interface{}, data interface{}) ([]byte, error) {
+	return webhookTemplates(nil).executeLeafBody(body, data)
+}
+
+func (t webhookTemplates) executeLeafBody(body interface{}, data interface{}) ([]byte, error) {
+	if text, ok := body.(string); ok {
+		return t.executeTextBody(text, data)
+	}
+	if body == nil {
+		return nil, nil
+	}
+
+	rendered, err := t.renderLeaves(body, data)
+	if err != nil {
+		return nil, err
+	}
+	result, err := json.Marshal(rendered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON body: %w", err)
+	}
+	return result, nil
+}
+
+// renderLeaves returns a copy of value with every string templated
+func (t webhookTemplates) renderLeaves(value interface{}, data interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return t.execute(v, data)
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			r, err := t.renderLeaves(item, data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			rendered[key] = r
+		}
+		return rendered, nil
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, item := range v {
+			r, err := t.renderLeaves(item, data)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			rendered[i] = r
+		}
+		return rendered, nil
+	default:
+		return v, nil
+	}
+}
+
 // executeTemplateForBody handles both string and object body templates
-func executeTemplateForBody(body interface{}, data *WebhookTemplateData) ([]byte, error) {
+func executeTemplateForBody(body interface{}, data interface{}) ([]byte, error) {
+	return webhookTemplates(nil).executeBody(body, data)
+}
+
+func (t webhookTemplates) executeBody(body interface{}, data interface{}) ([]byte, error) {
 	switch v := body.(type) {
+	case nil:
+		return nil, nil
+
 	case string:
 		// Simple string template
-		result, err := executeTemplate(v, data)
+		result, err := t.execute(v, data)
 		if err != nil {
 			return nil, err
 		}
@@ -217,7 +813,7 @@ func executeTemplateForBody(body interface{}, data *WebhookTemplateData) ([]byte
 		}
 
 		// Execute template on the JSON string
-		result, err := executeTemplate(string(jsonBytes), data)
+		result, err := t.execute(string(jsonBytes), data)
 		if err != nil {
 			return nil, err
 		}
@@ -225,6 +821,11 @@ func executeTemplateForBody(body interface{}, data *WebhookTemplateData) ([]byte
 		// Validate it's still valid JSON
 		var test interface{}
 		if err := json.Unmarshal([]byte(result), &test); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				return nil, fmt.Errorf("template resulted in invalid JSON at offset %d near %s (use jsonEscape or quote for values that may contain quotes): %w",
+					syntaxErr.Offset, jsonErrorSnippet(result, syntaxErr.Offset), err)
+			}
 			return nil, fmt.Errorf("template resulted in invalid JSON: %w", err)
 		}
 
@@ -234,3 +835,29 @@ func executeTemplateForBody(body interface{}, data *WebhookTemplateData) ([]byte
 		return nil, fmt.Errorf("unsupported body type: %T", v)
 	}
 }
+
+// jsonErrorSnippet returns the rendered text around offset, marking the
+// offending position with >>>
+func jsonErrorSnippet(rendered string, offset int64) string {
+	const context = 30
+
+	pos := int(offset)
+	if pos > len(rendered) {
+		pos = len(rendered)
+	}
+	if pos > 0 {
+		// The syntax error offset points just past the offending byte
+		pos--
+	}
+
+	start := pos - context
+	if start < 0 {
+		start = 0
+	}
+	end := pos + context
+	if end > len(rendered) {
+		end = len(rendered)
+	}
+
+	return fmt.Sprintf("%q", rendered[start:pos]+">>>"+rendered[pos:end])
+}
@@ -1,15 +1,27 @@
 package middlewares
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
+	"github.com/mcuadros/ofelia/core"
 	. "gopkg.in/check.v1"
 )
 
@@ -29,11 +41,524 @@ func (s *SuiteWebhook) TestTemplateHelpers(c *C) {
 	c.Assert(jsonEscapeString("hello\"world"), Equals, "hello\\\"world")
 	c.Assert(jsonEscapeString("line1\nline2"), Equals, "line1\\nline2")
 
+	// Test quote
+	c.Assert(jsonQuoteString(`say "hi"`), Equals, `"say \"hi\""`)
+
+	// Test urlQuery
+	query, err := urlQuery("job", "backup & restore", "q", "a=b/c?", "limit", 10)
+	c.Assert(err, IsNil)
+	c.Assert(query, Equals, "job=backup+%26+restore&limit=10&q=a%3Db%2Fc%3F")
+	_, err = urlQuery("job")
+	c.Assert(err, ErrorMatches, ".*key/value pairs.*")
+	_, err = urlQuery(1, "value")
+	c.Assert(err, ErrorMatches, ".*must be a string.*")
+
+	// Test urlEncode in a template
+	rendered, err := executeTemplate(`https://logs.example.com/?job={{urlEncode .JobName}}`, &WebhookTemplateData{JobName: "a b#c"})
+	c.Assert(err, IsNil)
+	c.Assert(rendered, Equals, "https://logs.example.com/?job=a+b%23c")
+
+	// Test urlquery and urlpath with reserved characters
+	rendered, err = executeTemplate(`https://example.com/jobs/{{urlpath .JobName}}?q={{urlquery .Error}}`,
+		&WebhookTemplateData{JobName: "db/backup nightly", Error: "exit 1 & retry?"})
+	c.Assert(err, IsNil)
+	c.Assert(rendered, Equals, "https://example.com/jobs/db%2Fbackup%20nightly?q=exit+1+%26+retry%3F")
+
 	// Test defaultValue
 	c.Assert(defaultValue("fallback", ""), Equals, "fallback")
 	c.Assert(defaultValue("fallback", "value"), Equals, "value")
 }
 
+// Test templates are parsed once, when the webhook is built, and reused
+func (s *SuiteWebhook) TestTemplateCache(c *C) {
+	text := "{{.JobName}} cached"
+	webhook, err := NewWebhookFromDefinition(WebhookDefinition{
+		Name:    "cached",
+		URL:     "https://example.com",
+		Method:  "POST",
+		Headers: map[string]string{"X-Job": text},
+	}, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	c.Assert(wh.templates[text], NotNil)
+
+	// Sends execute the held template rather than parsing the text again
+	swapped, err := parseTemplate("swapped")
+	c.Assert(err, IsNil)
+	wh.templates[text] = swapped
+	req, err := wh.render(&TestLogger{}, &WebhookTemplateData{JobName: "backup"})
+	c.Assert(err, IsNil)
+	c.Assert(req.Headers["X-Job"], Equals, "swapped")
+
+	// Templates of other webhooks are not kept
+	other, err := NewWebhookFromDefinition(WebhookDefinition{
+		Name:    "other",
+		URL:     "https://example.com",
+		Headers: map[string]string{"X-Job": text},
+	}, &TestLogger{})
+	c.Assert(err, IsNil)
+	c.Assert(other.(*Webhook).templates[text], Not(Equals), swapped)
+
+	// Invalid templates are reported when the webhook is created
+	_, err = NewWebhookFromDefinition(WebhookDefinition{
+		Name:    "invalid",
+		URL:     "https://example.com",
+		Headers: map[string]string{"X-Job": "{{.JobName"},
+	}, &TestLogger{})
+	c.Assert(err, ErrorMatches, "template parse error: .*")
+
+	_, err = NewWebhookFromDefinition(WebhookDefinition{
+		Name:         "invalid-status-body",
+		URL:          "https://example.com",
+		Body:         map[string]interface{}{"error": "{{if .Failed}}"},
+		BodyByStatus: true,
+	}, &TestLogger{})
+	c.Assert(err, ErrorMatches, "template parse error: .*")
+}
+
+// discardTransport accepts every request
+type discardTransport struct{}
+
+func (discardTransport) Send(WebhookRequest) error { return nil }
+
+// BenchmarkSendWebhook sends through a webhook with templates parsed once,
+// and with the templates parsed on every send as before they were kept
+func BenchmarkSendWebhook(b *testing.B) {
+	def := WebhookDefinition{
+		Name:    "bench",
+		Type:    WebhookTypeAll,
+		URL:     "https://example.com/{{.JobName}}",
+		Headers: map[string]string{"X-Job": "{{.JobName}}", "X-Status": "{{if .Failed}}failed{{else}}ok{{end}}"},
+		Body:    map[string]interface{}{"text": "{{.JobName}} {{if .Failed}}failed: {{.Error}}{{else}}succeeded{{end}} in {{.Duration}}"},
+	}
+	if err := prepareWebhookDefinition(&def); err != nil {
+		b.Fatal(err)
+	}
+	data := &WebhookTemplateData{JobName: "backup", Failed: true, Error: "exit status 1", Duration: "1m2s"}
+
+	for _, parsed := range []bool{true, false} {
+		name := "parsed-once"
+		if !parsed {
+			name = "parsed-per-send"
+		}
+		b.Run(name, func(b *testing.B) {
+			webhook, err := NewWebhookFromDefinition(def, &TestLogger{}, discardTransport{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			wh := webhook.(*Webhook)
+			defer wh.Cancel()
+			if !parsed {
+				wh.templates = nil
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				wh.send(&TestLogger{}, data)
+			}
+		})
+	}
+}
+
+// Test output line summaries
+func (s *SuiteWebhook) TestOutputLineSummaries(c *C) {
+	s.ctx.Start()
+	s.ctx.Execution.OutputStream.Write([]byte("one\ntwo\nthree\n"))
+	s.ctx.Execution.ErrorStream.Write([]byte("warning: disk\nerror: boom\n\n"))
+	s.ctx.Stop(nil)
+
+	data := buildTemplateData(s.ctx, true, 0, "")
+	c.Assert(data.StdoutLines, Equals, 3)
+	c.Assert(data.StderrLines, Equals, 3)
+	c.Assert(data.LastStderrLine, Equals, "error: boom")
+
+	// Empty streams
+	s.SetUpTest(c)
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	data = buildTemplateData(s.ctx, true, 0, "")
+	c.Assert(data.StdoutLines, Equals, 0)
+	c.Assert(data.StderrLines, Equals, 0)
+	c.Assert(data.LastStderrLine, Equals, "")
+}
+
+func (s *SuiteWebhook) TestMaxOutputBytes(c *C) {
+	s.ctx.Start()
+	line := []byte("verbose job output line\n")
+	for written := 0; written < 8*1024*1024; written += len(line) {
+		s.ctx.Execution.OutputStream.Write(line)
+	}
+	s.ctx.Execution.OutputStream.Write([]byte("done ✓"))
+	s.ctx.Execution.ErrorStream.Write([]byte("short"))
+	s.ctx.Stop(nil)
+
+	data := buildTemplateData(s.ctx, true, 1024, "")
+	c.Assert(len(data.Stdout), Equals, 1024)
+	c.Assert(data.Stdout[1000:], Equals, "job output line\ndone ✓")
+	c.Assert(data.Stderr, Equals, "short")
+
+	// A cut never starts inside a multi-byte character
+	data = buildTemplateData(s.ctx, true, 2, "")
+	c.Assert(data.Stdout, Equals, "")
+	data = buildTemplateData(s.ctx, true, 3, "")
+	c.Assert(data.Stdout, Equals, "✓")
+
+	def := WebhookDefinition{Name: "test", Type: WebhookTypeAll, MaxOutputBytes: -1}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*invalid maxOutputBytes.*")
+}
+
+// Test only the output after the last delimiter is copied
+func (s *SuiteWebhook) TestOutputDelimiter(c *C) {
+	s.ctx.Start()
+	s.ctx.Execution.OutputStream.Write([]byte("--- attempt 1\nconnection reset\n--- attempt 2\nimported 42 rows\n"))
+	s.ctx.Execution.ErrorStream.Write([]byte("no marker here\n"))
+	s.ctx.Stop(nil)
+
+	data := buildTemplateData(s.ctx, true, 0, "--- attempt")
+	c.Assert(data.Stdout, Equals, " 2\nimported 42 rows\n")
+	c.Assert(data.StdoutLines, Equals, 2)
+	c.Assert(data.Stderr, Equals, "no marker here\n")
+
+	// A delimiter line is dropped along with its line break
+	data = buildTemplateData(s.ctx, true, 0, "--- attempt 2")
+	c.Assert(data.Stdout, Equals, "imported 42 rows\n")
+
+	// maxOutputBytes applies to what follows the delimiter
+	data = buildTemplateData(s.ctx, true, 5, "--- attempt 2")
+	c.Assert(data.Stdout, Equals, "rows\n")
+}
+
+// Test output is only copied for webhooks that include it
+func (s *SuiteWebhook) TestIncludeOutput(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s.ctx.Start()
+	s.ctx.Execution.OutputStream.Write([]byte("done\n"))
+	s.ctx.Stop(nil)
+
+	for _, include := range []*bool{nil, new(bool)} {
+		def := WebhookDefinition{
+			Name:          "test",
+			URL:           ts.URL,
+			Method:        "POST",
+			Body:          "[{{.Stdout}}] {{.StdoutLines}}",
+			Timeout:       5,
+			IncludeOutput: include,
+		}
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+		webhook.(*Webhook).sendWebhook(s.ctx)
+
+		expected := "[done\n] 1"
+		if include != nil {
+			expected = "[] 0"
+		}
+		c.Assert(<-received, Equals, expected)
+	}
+}
+
+// Test time helpers
+func (s *SuiteWebhook) TestTimeHelpers(c *C) {
+	fixed := time.Date(2024, 1, 15, 14, 30, 0, 0, time.UTC)
+	templateNow = func() time.Time { return fixed }
+	defer func() { templateNow = time.Now }()
+
+	c.Assert(currentTime(), Equals, fixed)
+
+	earlier, err := addDuration(fixed, "-1h")
+	c.Assert(err, IsNil)
+	c.Assert(earlier, Equals, fixed.Add(-time.Hour))
+
+	_, err = addDuration(fixed, "an hour")
+	c.Assert(err, NotNil)
+
+	c.Assert(formatTime("15:04", fixed), Equals, "14:30")
+
+	result, err := executeTemplate(`{{formatTime "15:04" (addDuration now "-1h")}}-{{formatTime "15:04" now}}`, &WebhookTemplateData{})
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "13:30-14:30")
+}
+
+// Test duration helpers
+func (s *SuiteWebhook) TestDurationHelpers(c *C) {
+	seconds, err := durationSeconds("1m30s")
+	c.Assert(err, IsNil)
+	c.Assert(seconds, Equals, 90.0)
+
+	seconds, err = durationSeconds(2 * time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(seconds, Equals, 2.0)
+
+	_, err = durationSeconds("slow")
+	c.Assert(err, NotNil)
+	_, err = durationSeconds(3)
+	c.Assert(err, ErrorMatches, "expected a duration, got int")
+
+	data := &WebhookTemplateData{Duration: "7m30s", DurationSeconds: 450, PrevDuration: 5 * time.Minute}
+	for template, expected := range map[string]string{
+		`{{if gt (durationSeconds .Duration) 300.0}}overran by {{subDuration .Duration "5m"}}{{end}}`: "overran by 2m30s",
+		`{{if gt .DurationSeconds 600.0}}overran{{end}}`:                                              "",
+		`{{subDuration .Duration .PrevDuration}} slower than last time`:                               "2m30s slower than last time",
+	} {
+		result, err := executeTemplate(template, data)
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, expected)
+	}
+}
+
+// Test coalesce picks the first non-empty value
+func (s *SuiteWebhook) TestCoalesce(c *C) {
+	c.Assert(coalesce("", "", "unknown"), Equals, "unknown")
+	c.Assert(coalesce("", "disk full", "unknown"), Equals, "disk full")
+	c.Assert(coalesce("", ""), Equals, "")
+	c.Assert(coalesce(), Equals, "")
+
+	result, err := executeTemplate(`{{coalesce .Error .Stderr "unknown"}}`, &WebhookTemplateData{})
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "unknown")
+
+	result, err = executeTemplate(`{{coalesce .Error .Stderr "unknown"}}`, &WebhookTemplateData{Stderr: "disk full"})
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "disk full")
+}
+
+func (s *SuiteWebhook) TestRegexReplace(c *C) {
+	stdout := "calling api with key sk-live-4f9a8b7c6d5e and sk-test-0a1b2c\ndone"
+	result, err := executeTemplate(`{{.Stdout | regexReplace "sk-(live|test)-[0-9a-f]+" "sk-$1-***"}}`, &WebhookTemplateData{Stdout: stdout})
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "calling api with key sk-live-*** and sk-test-***\ndone")
+
+	// An invalid pattern fails the template instead of panicking
+	_, err = executeTemplate(`{{.Stdout | regexReplace "sk-[0-9" "***"}}`, &WebhookTemplateData{Stdout: stdout})
+	c.Assert(err, ErrorMatches, "template execution error: .*invalid regexReplace pattern: .*")
+}
+
+func (s *SuiteWebhook) TestMask(c *C) {
+	data := &WebhookTemplateData{Error: "abcd1234567890wxyz"}
+	result, err := executeTemplate(`{{mask .Error}} {{.Error | maskN 2}}`, data)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "abcd****wxyz ab****yz")
+
+	// Short secrets are hidden entirely, multi-byte characters are kept whole
+	c.Assert(maskString("secret"), Equals, "****")
+	c.Assert(maskString(""), Equals, "")
+	c.Assert(maskStringN(0, "abcdef"), Equals, "****")
+	c.Assert(maskStringN(1, "ébcdé"), Equals, "é****é")
+}
+
+// Test invalid JSON diagnostics for object bodies
+func (s *SuiteWebhook) TestInvalidJSONBodyDiagnostics(c *C) {
+	body := map[string]interface{}{
+		"error": "{{.Error}}",
+	}
+
+	_, err := executeTemplateForBody(body, &WebhookTemplateData{Error: `unexpected "EOF"`})
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, `template resulted in invalid JSON at offset 23 near .*>>>EOF.*`)
+
+	// jsonEscape keeps the body valid
+	body["error"] = "{{.Error | jsonEscape}}"
+	result, err := executeTemplateForBody(body, &WebhookTemplateData{Error: `unexpected "EOF"`})
+	c.Assert(err, IsNil)
+	c.Assert(string(result), Equals, `{"error":"unexpected \"EOF\""}`)
+}
+
+// Test object bodies templated leaf by leaf
+func (s *SuiteWebhook) TestTemplateLeaves(c *C) {
+	body := map[string]interface{}{
+		"job": "{{.JobName}}",
+		"details": map[string]interface{}{
+			"error": `{{default "none" .Error}}`,
+			"lines": []interface{}{"{{.StdoutLines}}", 3.0, true, nil},
+		},
+	}
+	data := &WebhookTemplateData{JobName: "backup", Error: `unexpected "EOF"`, StdoutLines: 2}
+
+	// Quotes inside the actions would be escaped, and break the template, if
+	// the JSON text was templated as a whole
+	_, err := executeTemplateForBody(body, data)
+	c.Assert(err, ErrorMatches, "template parse error.*")
+
+	result, err := executeLeafBody(body, data)
+	c.Assert(err, IsNil)
+	c.Assert(string(result), Equals,
+		`{"details":{"error":"unexpected \"EOF\"","lines":["2",3,true,null]},"job":"backup"}`)
+
+	templates, err := bodyTemplates(body, false, true)
+	c.Assert(err, IsNil)
+	c.Assert(templates, HasLen, 3)
+
+	def := WebhookDefinition{Name: "test", URL: "https://example.com", Body: map[string]interface{}{"a": "{{.Bad"}, TemplateLeaves: true}
+	_, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, "template parse error.*")
+}
+
+// Test preformatted start and end times
+func (s *SuiteWebhook) TestTimeFormats(c *C) {
+	s.ctx.Start()
+	s.ctx.Execution.Date = time.Date(2024, 1, 15, 14, 30, 0, 0, time.UTC)
+	s.ctx.Stop(nil)
+	s.ctx.Execution.Duration = 90 * time.Second
+
+	data := buildTemplateData(s.ctx, true, 0, "")
+	c.Assert(data.StartTimeUnix, Equals, data.StartTime.Unix())
+	c.Assert(data.StartTimeUnix, Equals, int64(1705329000))
+	c.Assert(data.EndTimeUnix, Equals, int64(1705329090))
+	c.Assert(data.StartTimeISO, Equals, "2024-01-15T14:30:00Z")
+	c.Assert(data.EndTimeISO, Equals, "2024-01-15T14:31:30Z")
+	c.Assert(data.DurationSeconds, Equals, 90.0)
+	c.Assert(data.DurationRaw, Equals, 90*time.Second)
+	c.Assert(data.Duration, Equals, "1m30s")
+
+	minutes, err := executeTemplate(`{{.DurationRaw.Minutes}} {{.DurationRaw.Milliseconds}} {{subDuration .DurationRaw "1m"}}`, data)
+	c.Assert(err, IsNil)
+	c.Assert(minutes, Equals, "1.5 90000 30s")
+
+	body, err := executeTemplateForBody(`{"started": {{.StartTimeUnix}}, "ended": "{{.EndTimeISO}}"}`, data)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, `{"started": 1705329000, "ended": "2024-01-15T14:31:30Z"}`)
+}
+
+// Test the trigger of an execution
+func (s *SuiteWebhook) TestTriggeredBy(c *C) {
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	// Executions of unknown origin are scheduled ones
+	data := buildTemplateData(s.ctx, false, 0, "")
+	c.Assert(data.TriggeredBy, Equals, core.TriggerSchedule)
+	c.Assert(data.Manual, Equals, false)
+
+	s.ctx.Execution.TriggeredBy = core.TriggerSchedule
+	data = buildTemplateData(s.ctx, false, 0, "")
+	c.Assert(data.TriggeredBy, Equals, "schedule")
+	c.Assert(data.Manual, Equals, false)
+
+	s.ctx.Execution.TriggeredBy = core.TriggerManual
+	data = buildTemplateData(s.ctx, false, 0, "")
+	c.Assert(data.TriggeredBy, Equals, "manual")
+	c.Assert(data.Manual, Equals, true)
+
+	result, err := executeTemplate(`{{if .Manual}}manual {{end}}{{.JobName}} failed`, data)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "manual "+s.job.Name+" failed")
+}
+
+// Test the trigger of manual and scheduled runs through the scheduler
+func (s *SuiteWebhook) TestTriggeredByScheduler(c *C) {
+	received := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer ts.Close()
+
+	webhook, err := NewWebhookFromDefinition(WebhookDefinition{
+		Name:    "trigger",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "POST",
+		Body:    "{{.TriggeredBy}} {{.Manual}}",
+		Timeout: 5,
+	}, &TestLogger{})
+	c.Assert(err, IsNil)
+	defer webhook.(*Webhook).Cancel()
+
+	sh := core.NewScheduler(&TestLogger{})
+	sh.Use(webhook)
+
+	job := &TestJob{}
+	job.Name = "backup"
+	job.Schedule = "@hourly"
+	c.Assert(sh.AddJob(job), IsNil)
+
+	expect := func(body string) {
+		select {
+		case got := <-received:
+			c.Assert(got, Equals, body)
+		case <-time.After(2 * time.Second):
+			c.Fatal("webhook not received")
+		}
+	}
+
+	sh.CronJobs()[0].Job.Run()
+	expect("schedule false")
+
+	sh.RunJobManually(job)
+	expect("manual true")
+}
+
+func (s *SuiteWebhook) TestWaitSends(c *C) {
+	var received atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		received.Add(1)
+	}))
+	defer ts.Close()
+
+	registry := NewWebhookRegistry()
+	registry.Register(WebhookDefinition{
+		Name:    "slow",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "POST",
+		Timeout: 5,
+	})
+	webhook, err := registry.webhook("slow", &TestLogger{})
+	c.Assert(err, IsNil)
+	defer registry.CancelSends()
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	registry.WaitSends()
+	c.Assert(received.Load(), Equals, int32(1))
+}
+
+// Test previous execution data
+func (s *SuiteWebhook) TestPreviousExecution(c *C) {
+	run := func(err error, duration time.Duration) *WebhookTemplateData {
+		s.SetUpTest(c)
+		s.job.Name = "previous-execution"
+		s.ctx.Start()
+		s.ctx.Stop(err)
+		s.ctx.Execution.Duration = duration
+		recordExecution(s.ctx)
+		return buildTemplateData(s.ctx, true, 0, "")
+	}
+
+	first := run(errors.New("test error"), time.Second)
+	c.Assert(first.HasPrevious, Equals, false)
+	c.Assert(first.PrevDuration, Equals, time.Duration(0))
+	c.Assert(first.PrevFailed, Equals, false)
+
+	second := run(nil, 3*time.Second)
+	c.Assert(second.HasPrevious, Equals, true)
+	c.Assert(second.PrevExecutionID, Equals, first.ExecutionID)
+	c.Assert(second.PrevDuration, Equals, time.Second)
+	c.Assert(second.PrevFailed, Equals, true)
+
+	// Recording and building again for the same execution is stable
+	recordExecution(s.ctx)
+	c.Assert(buildTemplateData(s.ctx, true, 0, "").PrevExecutionID, Equals, first.ExecutionID)
+
+	third := run(nil, time.Second)
+	c.Assert(third.PrevExecutionID, Equals, second.ExecutionID)
+	c.Assert(third.PrevDuration, Equals, 3*time.Second)
+	c.Assert(third.PrevFailed, Equals, false)
+}
+
 // Test simple text webhook
 func (s *SuiteWebhook) TestSimpleTextWebhook(c *C) {
 	received := make(chan string, 1)
@@ -49,6 +574,8 @@ func (s *SuiteWebhook) TestSimpleTextWebhook(c *C) {
 
 	def := WebhookDefinition{
 		Name:    "test",
+		Type:    WebhookTypeAll,
+		Active:  true,
 		URL:     ts.URL,
 		Method:  "POST",
 		Body:    "Job {{.JobName}} completed in {{.Duration}}",
@@ -89,6 +616,8 @@ func (s *SuiteWebhook) TestJSONWebhook(c *C) {
 
 	def := WebhookDefinition{
 		Name:   "test",
+		Type:   WebhookTypeAll,
+		Active: true,
 		URL:    ts.URL,
 		Method: "POST",
 		Headers: map[string]string{
@@ -118,6 +647,203 @@ func (s *SuiteWebhook) TestJSONWebhook(c *C) {
 	}
 }
 
+// Test status keyed bodies
+func (s *SuiteWebhook) TestBodyByStatus(c *C) {
+	received := make(chan map[string]interface{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		received <- data
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:         "test",
+		URL:          ts.URL,
+		Method:       "POST",
+		Timeout:      5,
+		BodyByStatus: true,
+		Body: map[string]interface{}{
+			"success": map[string]interface{}{"text": "{{.JobName}} ok"},
+			"error": map[string]interface{}{
+				"incident": map[string]interface{}{"title": "{{.JobName}} failed", "detail": "{{.Error}}"},
+			},
+		},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	wh.sendWebhook(s.ctx)
+	c.Assert(<-received, DeepEquals, map[string]interface{}{"text": "backup ok"})
+
+	s.SetUpTest(c)
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(errors.New("disk full"))
+	wh.sendWebhook(s.ctx)
+	c.Assert(<-received, DeepEquals, map[string]interface{}{
+		"incident": map[string]interface{}{"title": "backup failed", "detail": "disk full"},
+	})
+
+	// Skipped falls back to default, or to no body at all
+	c.Assert(selectBodyByStatus(def.Body, &WebhookTemplateData{Skipped: true}), IsNil)
+
+	def.Body = map[string]interface{}{"succes": "typo"}
+	c.Assert(validateBodyByStatus(def), ErrorMatches, ".*invalid body status.*")
+}
+
+// Test per-outcome bodies fall back to the shared body
+func (s *SuiteWebhook) TestOutcomeBodies(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:          "test",
+		Type:          WebhookTypeAll,
+		URL:           ts.URL,
+		Method:        "POST",
+		Timeout:       5,
+		Body:          "{{.JobName}} skipped",
+		BodyOnError:   map[string]interface{}{"text": "{{.JobName}} failed: {{.Error}}", "host": "{{.Hostname}}"},
+		BodyOnSuccess: "{{.JobName}} ok",
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(errors.New("disk full"))
+	wh.sendWebhook(s.ctx)
+	c.Assert(<-received, Matches, `\{"host":".*","text":"backup failed: disk full"\}`)
+
+	s.SetUpTest(c)
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	wh.sendWebhook(s.ctx)
+	c.Assert(<-received, Equals, "backup ok")
+
+	s.SetUpTest(c)
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(core.ErrSkippedExecution)
+	wh.sendWebhook(s.ctx)
+	c.Assert(<-received, Equals, "backup skipped")
+
+	def = WebhookDefinition{Name: "test", Type: WebhookTypeAll, BodyByStatus: true, BodyOnError: "x"}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*cannot be combined with 'bodyByStatus'.*")
+}
+
+// Test successful runs that wrote to stderr fire error webhooks with failOnStderr
+func (s *SuiteWebhook) TestFailOnStderr(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	run := func(failOnStderr bool, stderr string) bool {
+		def := WebhookDefinition{
+			Name:         "test",
+			Type:         WebhookTypeError,
+			Active:       true,
+			URL:          ts.URL,
+			Method:       "POST",
+			Body:         "{{.Failed}} {{.LastStderrLine}}",
+			FailOnStderr: failOnStderr,
+			Timeout:      5,
+		}
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+
+		s.SetUpTest(c)
+		s.ctx.Start()
+		s.ctx.Execution.ErrorStream.Write([]byte(stderr))
+		s.ctx.Stop(nil)
+		c.Assert(webhook.Run(s.ctx), IsNil)
+
+		select {
+		case body := <-received:
+			// The job status itself is unchanged
+			c.Assert(body, Equals, "false "+strings.TrimSpace(stderr))
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	c.Assert(run(true, "warning: disk almost full\n"), Equals, true)
+	c.Assert(run(false, "warning: disk almost full\n"), Equals, false)
+	c.Assert(run(true, "\n"), Equals, false)
+	c.Assert(s.ctx.Execution.Failed, Equals, false)
+
+	// Per-job error webhooks too
+	path := writeTempWebhookConfig(c, `{"webhooks": [
+		{"name": "warnings", "type": "error", "active": true, "url": "`+ts.URL+`", "method": "POST", "body": "stderr", "failOnStderr": true},
+		{"name": "errors", "type": "error", "active": true, "url": "`+ts.URL+`", "method": "POST", "body": "error"}
+	]}`)
+	defer os.Remove(path)
+	_, registry := LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path}, nil, &TestLogger{})
+	perJob, err := NewWebhookFromConfig(&WebhookConfig{WebhookErrorNames: "warnings,errors"}, registry, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.SetUpTest(c)
+	s.ctx.Start()
+	s.ctx.Execution.ErrorStream.Write([]byte("deprecated flag"))
+	s.ctx.Stop(nil)
+	c.Assert(perJob.Run(s.ctx), IsNil)
+	c.Assert(<-received, Equals, "stderr")
+	select {
+	case body := <-received:
+		c.Fatalf("unexpected send %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// Test per-job webhooks fire in priority order, like the global ones
+func (s *SuiteWebhook) TestPerJobPriority(c *C) {
+	path := writeTempWebhookConfig(c, `{"webhooks": [
+		{"name": "ticket", "type": "error", "priority": 50, "url": "https://example.com/ticket"},
+		{"name": "chat", "type": "all", "priority": 10, "url": "https://example.com/chat"},
+		{"name": "page", "type": "error", "priority": 10, "url": "https://example.com/page"},
+		{"name": "backup-oncall", "type": "error", "priority": 1, "url": "https://example.com/oncall"}
+	]}`)
+	defer os.Remove(path)
+	_, registry := LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path}, nil, &TestLogger{})
+
+	perJob, err := NewWebhookFromConfig(&WebhookConfig{WebhookErrorNames: "ticket,chat,page,{{.JobName}}-oncall"}, registry, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(errors.New("exit 1"))
+
+	var names []string
+	for _, def := range perJob.(*PerJobWebhook).firing(s.ctx) {
+		names = append(names, def.Name)
+	}
+	// Equal priorities put "error" webhooks before "all" ones
+	c.Assert(names, DeepEquals, []string{"backup-oncall", "page", "chat", "ticket"})
+
+	// The configured order is left alone for the next execution
+	c.Assert(perJob.(*PerJobWebhook).errorWebhooks[0].Name, Equals, "ticket")
+}
+
 // Test onlyOnError flag
 func (s *SuiteWebhook) TestOnlyOnError(c *C) {
 	called := false
@@ -137,6 +863,8 @@ func (s *SuiteWebhook) TestOnlyOnError(c *C) {
 
 	def := WebhookDefinition{
 		Name:        "test",
+		Type:        WebhookTypeAll,
+		Active:      true,
 		URL:         ts.URL,
 		Method:      "POST",
 		Body:        "test",
@@ -193,6 +921,8 @@ func (s *SuiteWebhook) TestTemplatedURL(c *C) {
 
 	def := WebhookDefinition{
 		Name:    "test",
+		Type:    WebhookTypeAll,
+		Active:  true,
 		URL:     ts.URL + "/{{if .Failed}}fail{{else}}success{{end}}",
 		Method:  "GET",
 		Timeout: 5,
@@ -214,22 +944,377 @@ func (s *SuiteWebhook) TestTemplatedURL(c *C) {
 	}
 }
 
-// Test templated headers
-func (s *SuiteWebhook) TestTemplatedHeaders(c *C) {
-	received := make(chan http.Header, 1)
+// Test templated query parameters
+func (s *SuiteWebhook) TestQueryParameters(c *C) {
+	received := make(chan *http.Request, 1)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		received <- r.Header
+		received <- r
 		w.WriteHeader(200)
 	}))
 	defer ts.Close()
 
+	s.job.Name = "a b&c=d"
 	s.ctx.Start()
 	s.ctx.Stop(nil)
 
 	def := WebhookDefinition{
 		Name:   "test",
-		URL:    ts.URL,
-		Method: "POST",
+		URL:    ts.URL + "/hook?token=abc",
+		Method: "GET",
+		Query: map[string]string{
+			"job":    "{{.JobName}}",
+			"status": "{{if .Failed}}failed{{else}}success{{end}}",
+		},
+		Timeout: 5,
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	webhook.(*Webhook).sendWebhook(s.ctx)
+
+	r := <-received
+	c.Assert(r.URL.Path, Equals, "/hook")
+	c.Assert(r.URL.RawQuery, Equals, "job=a+b%26c%3Dd&status=success&token=abc")
+	c.Assert(r.URL.Query().Get("job"), Equals, "a b&c=d")
+}
+
+// Test multipart body with log attachments
+func (s *SuiteWebhook) TestMultipartBody(c *C) {
+	received := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		received <- r
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Execution.OutputStream.Write([]byte("line1\nline2\n"))
+	s.ctx.Stop(nil)
+
+	def := WebhookDefinition{
+		Name:   "test",
+		URL:    ts.URL,
+		Method: "POST",
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+		},
+		Format: WebhookFormatMultipart,
+		Multipart: &MultipartConfig{
+			Fields: map[string]string{
+				"title": "{{.JobName}} log",
+			},
+			Files: []MultipartFile{
+				{Field: "file", Filename: "{{.JobName}}-stdout.log", Content: "{{.Stdout}}", ContentType: "text/plain"},
+				{Field: "raw", Filename: `"quoted".bin`, Content: "{{.Stderr}}"},
+			},
+		},
+		Timeout: 5,
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	webhook.(*Webhook).sendWebhook(s.ctx)
+
+	r := <-received
+	c.Assert(r.Header.Get("Content-Type"), Matches, "multipart/form-data; boundary=.*")
+	c.Assert(r.MultipartForm.Value["title"], DeepEquals, []string{"backup log"})
+
+	files := r.MultipartForm.File["file"]
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Filename, Equals, "backup-stdout.log")
+	c.Assert(files[0].Header.Get("Content-Type"), Equals, "text/plain")
+
+	raw := r.MultipartForm.File["raw"]
+	c.Assert(raw, HasLen, 1)
+	c.Assert(raw[0].Filename, Equals, `"quoted".bin`)
+	c.Assert(raw[0].Header.Get("Content-Type"), Equals, "application/octet-stream")
+
+	f, err := files[0].Open()
+	c.Assert(err, IsNil)
+	content, _ := io.ReadAll(f)
+	c.Assert(string(content), Equals, "line1\nline2\n")
+}
+
+// Test XML and raw bodies
+func (s *SuiteWebhook) TestXMLBody(c *C) {
+	type request struct {
+		contentType string
+		body        string
+	}
+	received := make(chan request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.Header.Get("Content-Type"), string(body)}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	newWebhook := func(format string, body interface{}, headers map[string]string) *Webhook {
+		def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Format: format, Body: body, Headers: headers, Timeout: 5}
+		c.Assert(validateWebhookFormat(def), IsNil)
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+		return webhook.(*Webhook)
+	}
+	data := &WebhookTemplateData{JobName: "backup & restore", Failed: true}
+
+	xmlBody := "<job><name>{{html .JobName}}</name><failed>{{.Failed}}</failed></job>"
+	newWebhook(WebhookFormatXML, xmlBody, nil).send(&TestLogger{}, data)
+	r := <-received
+	c.Assert(r.contentType, Equals, "application/xml")
+	c.Assert(r.body, Equals, "<job><name>backup &amp; restore</name><failed>true</failed></job>")
+
+	// An explicit Content-Type is kept
+	newWebhook(WebhookFormatXML, xmlBody, map[string]string{"content-type": "text/xml"}).send(&TestLogger{}, data)
+	c.Assert((<-received).contentType, Equals, "text/xml")
+
+	// Malformed XML is not sent
+	logger := &recordingLogger{}
+	newWebhook(WebhookFormatXML, "<job>{{.JobName}}</job>", nil).send(logger, data)
+	c.Assert(logger.errors, HasLen, 1)
+	c.Assert(logger.errors[0], Matches, ".*invalid XML.*")
+
+	// Raw bodies skip validation
+	newWebhook(WebhookFormatRaw, "<job>{{.JobName}}", nil).send(&TestLogger{}, data)
+	c.Assert((<-received).body, Equals, "<job>backup & restore")
+
+	def := WebhookDefinition{Format: WebhookFormatXML, Body: map[string]interface{}{"job": "x"}}
+	c.Assert(validateWebhookFormat(def), ErrorMatches, ".*requires a string body.*")
+}
+
+// Test NDJSON bodies, with one line per element of a digest array
+func (s *SuiteWebhook) TestNDJSONBody(c *C) {
+	type request struct {
+		contentType string
+		body        string
+	}
+	received := make(chan request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.Header.Get("Content-Type"), string(body)}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	newWebhook := func(body interface{}) *Webhook {
+		def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Format: WebhookFormatNDJSON, Body: body, Timeout: 5}
+		c.Assert(validateWebhookFormat(def), IsNil)
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+		return webhook.(*Webhook)
+	}
+
+	// A single send is one line
+	newWebhook(map[string]interface{}{"job": "{{.JobName}}", "failed": "{{.Failed}}"}).send(&TestLogger{}, &WebhookTemplateData{JobName: "backup"})
+	r := <-received
+	c.Assert(r.contentType, Equals, "application/x-ndjson")
+	c.Assert(r.body, Equals, `{"failed":"false","job":"backup"}`+"\n")
+
+	// A digest array has each element on its own line
+	body := "[{{range $i, $job := .Jobs}}{{if $i}},{{end}}\n  {\"job\": {{quote $job.JobName}}}{{end}}\n]"
+	newWebhook(body).send(&TestLogger{}, &WebhookBatchData{Jobs: []*WebhookTemplateData{{JobName: "backup"}, {JobName: "cleanup"}}})
+	c.Assert((<-received).body, Equals, `{"job":"backup"}`+"\n"+`{"job":"cleanup"}`+"\n")
+
+	// Invalid JSON is not sent
+	logger := &recordingLogger{}
+	newWebhook(`{"job": {{.JobName}}}`).send(logger, &WebhookTemplateData{JobName: "backup"})
+	c.Assert(logger.errors, HasLen, 1)
+	c.Assert(logger.errors[0], Matches, ".*invalid JSON.*")
+}
+
+// Test the Content-Type sent by default for each format
+func (s *SuiteWebhook) TestFormatContentType(c *C) {
+	cases := []struct {
+		format, body, expected string
+	}{
+		{"", `{"text": "backup failed"}`, "application/json"},
+		{"", ` [{"job": "backup"}]`, "application/json"},
+		{"", "backup failed", ""},
+		{"", "42", ""},
+		{"", `"ok"`, ""},
+		{"", "true", ""},
+		{"", "", ""},
+		{WebhookFormatXML, "<job/>", "application/xml"},
+		{WebhookFormatNDJSON, "{}\n", "application/x-ndjson"},
+		{WebhookFormatHealthcheck, "disk full", "text/plain; charset=utf-8"},
+		{WebhookFormatRaw, `{"text": "backup failed"}`, ""},
+	}
+	for _, tc := range cases {
+		c.Assert(formatContentType(tc.format, []byte(tc.body)), Equals, tc.expected, Commentf("format %q, body %q", tc.format, tc.body))
+	}
+
+	// A configured Content-Type wins
+	def := WebhookDefinition{Name: "test", Type: WebhookTypeAll, URL: "https://example.com", Body: map[string]interface{}{"text": "{{.JobName}}"}, Headers: map[string]string{"content-type": "application/vnd.api+json"}}
+	_, _, headers, _, err := RenderWebhook(def, &WebhookTemplateData{JobName: "backup"})
+	c.Assert(err, IsNil)
+	c.Assert(headers, DeepEquals, map[string]string{"content-type": "application/vnd.api+json"})
+
+	// Other transports get no default, only the configured headers
+	def = WebhookDefinition{Name: "script", Type: WebhookTypeAll, Transport: TransportExec, Command: []string{"/bin/true"}, Format: WebhookFormatXML, Body: "<job/>"}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	req, err := webhook.(*Webhook).render(&TestLogger{}, &WebhookTemplateData{JobName: "backup"})
+	c.Assert(err, IsNil)
+	c.Assert(req.Headers, HasLen, 0)
+}
+
+func (s *SuiteWebhook) TestMergeStdout(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:        "test",
+		Type:        WebhookTypeAll,
+		URL:         ts.URL,
+		Method:      "POST",
+		Body:        map[string]interface{}{"job": "{{.JobName}}", "status": "ofelia"},
+		MergeStdout: true,
+		Timeout:     5,
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	// Body fields win over stdout fields of the same name
+	webhook.(*Webhook).send(&TestLogger{}, &WebhookTemplateData{
+		JobName: "backup",
+		Stdout:  `{"rows": 42, "status": "partial", "tables": ["a", "b"]}` + "\n",
+	})
+	c.Assert(<-received, Equals, `{"job":"backup","rows":42,"status":"ofelia","tables":["a","b"]}`)
+
+	logger := &recordingLogger{}
+	webhook.(*Webhook).send(logger, &WebhookTemplateData{JobName: "backup", Stdout: "panic: connection refused"})
+	c.Assert(<-received, Equals, `{"job":"backup","status":"ofelia"}`)
+	c.Assert(logger.warnings, DeepEquals, []string{
+		`Webhook "test": stdout is not a JSON object: "panic: connection refused", sending the body without it`,
+	})
+
+	def.Body = "{{.JobName}}"
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*mergeStdout requires an object body.*")
+}
+
+func (s *SuiteWebhook) TestBodyFromFile(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "backup.json"), []byte(`{"rows": 42}`), 0o600), IsNil)
+
+	def := WebhookDefinition{
+		Name:         "test",
+		Type:         WebhookTypeAll,
+		URL:          ts.URL,
+		Method:       "POST",
+		BodyFromFile: dir + "/{{.JobName}}.json",
+		Timeout:      5,
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	// The file is sent as-is
+	webhook.(*Webhook).send(&TestLogger{}, &WebhookTemplateData{JobName: "backup"})
+	c.Assert(<-received, Equals, `{"rows": 42}`)
+
+	// A missing file skips the send
+	logger := &recordingLogger{}
+	webhook.(*Webhook).send(logger, &WebhookTemplateData{JobName: "restore"})
+	c.Assert(logger.notices, HasLen, 1)
+	c.Assert(logger.notices[0], Matches, `Webhook "test" skipped \(body file ".*restore.json" does not exist\)`)
+	c.Assert(logger.errors, HasLen, 0)
+
+	def.MissingBodyFile = MissingBodyFileError
+	webhook, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	logger = &recordingLogger{}
+	webhook.(*Webhook).send(logger, &WebhookTemplateData{JobName: "restore"})
+	c.Assert(logger.errors, HasLen, 1)
+	c.Assert(logger.errors[0], Matches, `Webhook "test": failed to read body file: .*no such file or directory`)
+
+	select {
+	case body := <-received:
+		c.Fatalf("unexpected send %q", body)
+	default:
+	}
+
+	def.MissingBodyFile = "ignore"
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `.*invalid missingBodyFile "ignore".*`)
+	def.MissingBodyFile = ""
+	def.BodyOnError = "{{.JobName}} failed"
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*bodyFromFile cannot be used with body.*")
+}
+
+func (s *SuiteWebhook) TestEnvelope(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	path := writeTempWebhookConfig(c, `{
+		"defaults": {"envelope": {"version": "1"}},
+		"webhooks": [
+			{"name": "object", "type": "all", "url": "`+ts.URL+`", "method": "POST", "body": {"job": "{{.JobName}}", "failed": "{{.Failed}}"}},
+			{"name": "text", "type": "all", "url": "`+ts.URL+`", "method": "POST", "body": "{{.JobName}} failed",
+				"envelope": {"version": "2", "field": "payload"}}
+		]
+	}`)
+	defer os.Remove(path)
+
+	defs, err := parseWebhookConfigFile(path)
+	c.Assert(err, IsNil)
+	data := &WebhookTemplateData{JobName: "backup", Failed: true}
+
+	webhook, err := NewWebhookFromDefinition(defs[0], &TestLogger{})
+	c.Assert(err, IsNil)
+	webhook.(*Webhook).send(&TestLogger{}, data)
+	c.Assert(<-received, Equals, `{"version":"1","event":{"failed":"true","job":"backup"}}`)
+
+	// Text bodies are nested as a string
+	webhook, err = NewWebhookFromDefinition(defs[1], &TestLogger{})
+	c.Assert(err, IsNil)
+	webhook.(*Webhook).send(&TestLogger{}, data)
+	c.Assert(<-received, Equals, `{"version":"2","payload":"backup failed"}`)
+
+	def := WebhookDefinition{Format: WebhookFormatXML, Body: "<job/>", Envelope: &EnvelopeConfig{Version: "1"}}
+	c.Assert(validateWebhookFormat(def), ErrorMatches, ".*only applies to JSON bodies.*")
+	def = WebhookDefinition{Envelope: &EnvelopeConfig{}}
+	c.Assert(validateWebhookFormat(def), ErrorMatches, ".*requires a version.*")
+}
+
+// Test templated headers
+func (s *SuiteWebhook) TestTemplatedHeaders(c *C) {
+	received := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	def := WebhookDefinition{
+		Name:   "test",
+		Type:   WebhookTypeAll,
+		Active: true,
+		URL:    ts.URL,
+		Method: "POST",
 		Headers: map[string]string{
 			"X-Job-Name":   "{{.JobName}}",
 			"X-Job-Status": "{{if .Failed}}failed{{else}}success{{end}}",
@@ -238,39 +1323,1314 @@ func (s *SuiteWebhook) TestTemplatedHeaders(c *C) {
 		Timeout: 5,
 	}
 
-	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
-	c.Assert(err, IsNil)
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	err = webhook.Run(s.ctx)
+	c.Assert(err, IsNil)
+
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case headers := <-received:
+		c.Assert(headers.Get("X-Job-Status"), Equals, "success")
+	case <-time.After(2 * time.Second):
+		c.Fatal("webhook not received")
+	}
+}
+
+// Test headers rendering to an empty string are omitted
+func (s *SuiteWebhook) TestEmptyHeaders(c *C) {
+	received := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	def := WebhookDefinition{
+		Name:   "test",
+		Type:   WebhookTypeAll,
+		Active: true,
+		URL:    ts.URL,
+		Method: "POST",
+		Headers: map[string]string{
+			"X-Job-Name": "{{.JobName}}",
+			"X-Error":    "{{.Error}}",
+			"X-Priority": "{{if not .Failed}}{{skip}}{{end}}high",
+			"X-Status":   "{{if .Failed}}{{skip}}{{end}}ok",
+		},
+		Body:    "test",
+		Timeout: 5,
+	}
+
+	for _, keep := range []bool{false, true} {
+		def.KeepEmptyHeaders = keep
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+
+		webhook.(*Webhook).sendWebhook(s.ctx)
+
+		select {
+		case headers := <-received:
+			c.Assert(headers.Get("X-Job-Name"), Equals, "backup")
+			_, sent := headers["X-Error"]
+			c.Assert(sent, Equals, keep)
+			// skip drops the header even when empty headers are kept
+			_, sent = headers["X-Priority"]
+			c.Assert(sent, Equals, false)
+			c.Assert(headers.Get("X-Status"), Equals, "ok")
+		case <-time.After(2 * time.Second):
+			c.Fatal("webhook not received")
+		}
+	}
+}
+
+// Test the overflow policies of the concurrency limit
+func (s *SuiteWebhook) TestOverflowPolicy(c *C) {
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	setup := func(policy string) (*Webhook, chan struct{}, chan struct{}, func()) {
+		received := make(chan struct{}, 2)
+		release := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- struct{}{}
+			<-release
+			w.WriteHeader(200)
+		}))
+
+		def := WebhookDefinition{
+			Name:           "test",
+			URL:            ts.URL,
+			Method:         "POST",
+			Body:           "test",
+			Timeout:        5,
+			MaxConcurrent:  1,
+			OverflowPolicy: policy,
+		}
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+
+		wh := webhook.(*Webhook)
+		wh.dispatch(s.ctx)
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			c.Fatal("webhook not received")
+		}
+
+		return wh, received, release, ts.Close
+	}
+
+	expectSend := func(received chan struct{}, sent bool) {
+		select {
+		case <-received:
+			c.Assert(sent, Equals, true)
+		case <-time.After(200 * time.Millisecond):
+			c.Assert(sent, Equals, false)
+		}
+	}
+
+	// buffer queues the send until a slot frees up
+	wh, received, release, done := setup(OverflowBuffer)
+	wh.dispatch(s.ctx)
+	expectSend(received, false)
+	close(release)
+	expectSend(received, true)
+	done()
+
+	// drop discards the send right away
+	wh, received, release, done = setup(OverflowDrop)
+	wh.dispatch(s.ctx)
+	close(release)
+	expectSend(received, false)
+	done()
+
+	// block holds the job until a slot frees up...
+	wh, received, release, done = setup(OverflowBlock)
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	wh.dispatch(s.ctx)
+	expectSend(received, true)
+	done()
+
+	// ...but never longer than blockWait
+	wh, received, release, done = setup(OverflowBlock)
+	wh.blockWait = 50 * time.Millisecond
+	start := time.Now()
+	wh.dispatch(s.ctx)
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+	close(release)
+	expectSend(received, false)
+	done()
+
+	c.Assert(prepareWebhookDefinition(&WebhookDefinition{Type: WebhookTypeAll, OverflowPolicy: "queue"}), ErrorMatches, ".*invalid overflow policy.*")
+}
+
+// Test failure sends are delayed and cancelled by a quick recovery
+func (s *SuiteWebhook) TestDelay(c *C) {
+	received := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:    "test",
+		Type:    WebhookTypeError,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "POST",
+		Body:    "{{.JobName}} failed",
+		Timeout: 5,
+		Delay:   "100ms",
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	run := func(name string, err error) {
+		s.SetUpTest(c)
+		s.job.Name = name
+		s.ctx.Start()
+		s.ctx.Stop(err)
+		c.Assert(webhook.Run(s.ctx), IsNil)
+	}
+
+	// A failure followed by a quick success never alerts
+	run("flaky", errors.New("test error"))
+	run("flaky", nil)
+	select {
+	case body := <-received:
+		c.Fatalf("unexpected webhook %q", body)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// A sustained failure alerts once the delay has passed
+	start := time.Now()
+	run("broken", errors.New("test error"))
+	select {
+	case body := <-received:
+		c.Assert(body, Equals, "broken failed")
+		c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+	case <-time.After(2 * time.Second):
+		c.Fatal("webhook not received")
+	}
+
+	_, err = NewWebhookFromDefinition(WebhookDefinition{Delay: "later"}, &TestLogger{})
+	c.Assert(err, ErrorMatches, ".*invalid delay duration.*")
+}
+
+// Test reachability checks
+func (s *SuiteWebhook) TestPing(c *C) {
+	status := 200
+	var method, path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		w.WriteHeader(status)
+	}))
+
+	def := WebhookDefinition{Name: "test", URL: ts.URL + "/hooks/{{.JobName}}", Method: "POST", Timeout: 5}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	c.Assert(wh.Ping(), IsNil)
+	c.Assert(method, Equals, "HEAD")
+	c.Assert(path, Equals, "/hooks/")
+
+	status = 405
+	c.Assert(wh.Ping(), IsNil)
+
+	status = 503
+	c.Assert(wh.Ping(), ErrorMatches, "server error status code: 503")
+
+	ts.Close()
+	c.Assert(wh.Ping(), ErrorMatches, "request failed: .*")
+}
+
+// Test templated method
+// Test GET and HEAD requests are sent without a body
+func (s *SuiteWebhook) TestGetDropsBody(c *C) {
+	type request struct {
+		method string
+		body   string
+	}
+	received := make(chan request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.Method, string(body)}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "GET", Body: `{"job": "{{.JobName}}"}`, Timeout: 5}
+	logger := &recordingLogger{}
+	webhook, err := NewWebhookFromDefinition(def, logger)
+	c.Assert(err, IsNil)
+	c.Assert(logger.warnings, DeepEquals, []string{`Webhook "test": GET requests are sent without a body, ignoring it`})
+
+	logger = &recordingLogger{}
+	webhook.(*Webhook).send(logger, &WebhookTemplateData{JobName: "backup"})
+	c.Assert(<-received, Equals, request{http.MethodGet, ""})
+	c.Assert(logger.warnings, HasLen, 0)
+
+	// Templated methods are checked on every send
+	def.Method = "{{if .Failed}}POST{{else}}HEAD{{end}}"
+	logger = &recordingLogger{}
+	webhook, err = NewWebhookFromDefinition(def, logger)
+	c.Assert(err, IsNil)
+	c.Assert(logger.warnings, HasLen, 0)
+
+	webhook.(*Webhook).send(logger, &WebhookTemplateData{JobName: "backup"})
+	c.Assert(<-received, Equals, request{http.MethodHead, ""})
+	c.Assert(logger.warnings, DeepEquals, []string{`Webhook "test": HEAD requests are sent without a body, ignoring it`})
+
+	webhook.(*Webhook).send(logger, &WebhookTemplateData{JobName: "backup", Failed: true})
+	c.Assert(<-received, Equals, request{http.MethodPost, `{"job": "backup"}`})
+}
+
+func (s *SuiteWebhook) TestTemplatedMethod(c *C) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Method
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:    "test",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "{{if .Failed}}POST{{else}}DELETE{{end}}",
+		Timeout: 5,
+	}
+
+	// Success resolves to DELETE
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case method := <-received:
+		c.Assert(method, Equals, http.MethodDelete)
+	case <-time.After(2 * time.Second):
+		c.Fatal("webhook not received")
+	}
+
+	// Failure resolves to POST
+	s.SetUpTest(c)
+	s.ctx.Start()
+	s.ctx.Stop(errors.New("test error"))
+
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case method := <-received:
+		c.Assert(method, Equals, http.MethodPost)
+	case <-time.After(2 * time.Second):
+		c.Fatal("webhook not received")
+	}
+}
+
+func (s *SuiteWebhook) TestNormalizeHTTPMethod(c *C) {
+	method, err := normalizeHTTPMethod(" delete ")
+	c.Assert(err, IsNil)
+	c.Assert(method, Equals, http.MethodDelete)
+
+	_, err = normalizeHTTPMethod("FETCH")
+	c.Assert(err, NotNil)
+}
+
+// Test retry logic
+func (s *SuiteWebhook) TestRetryLogic(c *C) {
+	attempts := 0
+	var mu sync.Mutex
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		current := attempts
+		mu.Unlock()
+
+		// Fail first 2 attempts, succeed on 3rd
+		if current < 3 {
+			w.WriteHeader(500)
+		} else {
+			w.WriteHeader(200)
+		}
+	}))
+	defer ts.Close()
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	def := WebhookDefinition{
+		Name:    "test",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     ts.URL,
+		Method:  "POST",
+		Body:    "test",
+		Timeout: 5,
+		Retry: &RetryConfig{
+			Count:   3,
+			Backoff: "10ms",
+		},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	err = webhook.Run(s.ctx)
+	c.Assert(err, IsNil)
+
+	// Wait for retries to complete
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	c.Assert(attempts, Equals, 3)
+	mu.Unlock()
+}
+
+// Test that retry.count is the number of retries after the first attempt
+func (s *SuiteWebhook) TestRetryCountAttempts(c *C) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(500)
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		retry    *RetryConfig
+		expected int
+	}{
+		{nil, 1},
+		{&RetryConfig{Count: 0}, 1},
+		{&RetryConfig{Count: 1}, 2},
+		{&RetryConfig{Count: 3}, 4},
+	}
+
+	for _, tc := range cases {
+		def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Timeout: 5, Retry: tc.retry}
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+
+		wh := webhook.(*Webhook)
+		wh.sleep = func(time.Duration) {}
+
+		attempts = 0
+		result := wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL})
+		c.Assert(attempts, Equals, tc.expected)
+		c.Assert(result.Attempts, Equals, tc.expected)
+	}
+
+	_, err := NewWebhookFromDefinition(WebhookDefinition{Retry: &RetryConfig{Count: -1}}, &TestLogger{})
+	c.Assert(err, ErrorMatches, ".*invalid retry count -1.*")
+}
+
+// Test retry.maxElapsed bounds the retries by time, with or without a count
+func (s *SuiteWebhook) TestRetryMaxElapsed(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		retry    *RetryConfig
+		expected int
+	}{
+		// Backoffs of 20ms, 40ms and 80ms fit in 250ms, the next 160ms does not
+		{&RetryConfig{Backoff: "20ms", MaxElapsed: "250ms"}, 4},
+		{&RetryConfig{Count: 10, Backoff: "20ms", MaxElapsed: "250ms"}, 4},
+		// The count still applies when reached first
+		{&RetryConfig{Count: 2, Backoff: "20ms", MaxElapsed: "250ms"}, 3},
+	}
+
+	for _, tc := range cases {
+		def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Timeout: 5, Retry: tc.retry}
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+
+		result := webhook.(*Webhook).sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL})
+		c.Assert(result.Attempts, Equals, tc.expected, Commentf("retry %+v", *tc.retry))
+		c.Assert(result.Duration < 250*time.Millisecond, Equals, true, Commentf("took %v", result.Duration))
+	}
+
+	_, err := NewWebhookFromDefinition(WebhookDefinition{Retry: &RetryConfig{MaxElapsed: "2 minutes"}}, &TestLogger{})
+	c.Assert(err, ErrorMatches, `invalid retry maxElapsed duration "2 minutes".*`)
+}
+
+func (s *SuiteWebhook) TestStartupJitter(c *C) {
+	sent := make(chan struct{}, 3)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent <- struct{}{}
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Timeout: 5, StartupJitter: "30s"}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	wh := webhook.(*Webhook)
+	var waits []time.Duration
+	wh.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	// Only the first send waits, for at most the configured jitter
+	for i := 0; i < 3; i++ {
+		c.Assert(wh.sendRendered(&TestLogger{}, &WebhookRequest{Method: "POST", URL: ts.URL}), IsNil)
+		<-sent
+	}
+	c.Assert(waits, HasLen, 1)
+	c.Assert(waits[0] >= 0 && waits[0] < 30*time.Second, Equals, true, Commentf("waited %v", waits[0]))
+
+	def.StartupJitter = "-1s"
+	_, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, `startupJitter must not be negative, got "-1s"`)
+}
+
+// Test the failure log reports the attempts actually made
+func (s *SuiteWebhook) TestRetryEarlyAbort(c *C) {
+	def := WebhookDefinition{
+		Name:    "test",
+		URL:     "http://example.com/%zz",
+		Method:  "POST",
+		Timeout: 5,
+		Retry:   &RetryConfig{Count: 3},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	wh := webhook.(*Webhook)
+	wh.sleep = func(time.Duration) {}
+
+	// A request that cannot be built is not retried
+	result := wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: def.URL})
+	c.Assert(result.Attempts, Equals, 1)
+	c.Assert(errors.Is(result.Err, errInvalidRequest), Equals, true)
+
+	logger := &recordingLogger{}
+	wh.send(logger, &WebhookTemplateData{})
+	c.Assert(logger.errors, HasLen, 1)
+	c.Assert(logger.errors[0], Matches, `Webhook "test": failed after 1 attempts: failed to create request.*`)
+}
+
+// Test Cancel aborts both the backoff wait and a request in flight
+func (s *SuiteWebhook) TestCancel(c *C) {
+	requests := make(chan string, 4)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+		if r.URL.Path == "/hang" {
+			<-release
+		}
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	def := WebhookDefinition{
+		Name:    "test",
+		URL:     ts.URL + "/fail",
+		Method:  "POST",
+		Timeout: 60,
+		Retry:   &RetryConfig{Count: 3, Backoff: "1h"},
+	}
+	retrying := &retryLogger{retrying: make(chan struct{}, 1)}
+	webhook, err := NewWebhookFromDefinition(def, retrying)
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	logger := &recordingLogger{}
+	done := make(chan struct{})
+	go func() {
+		wh.send(logger, &WebhookTemplateData{})
+		close(done)
+	}()
+
+	// The first attempt fails and the retry waits an hour
+	c.Assert(<-requests, Equals, "/fail")
+	<-retrying.retrying
+	wh.Cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		c.Fatal("send not cancelled")
+	}
+	c.Assert(logger.errors, HasLen, 0)
+	c.Assert(logger.warnings, HasLen, 1)
+	c.Assert(logger.warnings[0], Matches, `Webhook "test": cancelled after 1 attempts: non-2xx status code: 503.*`)
+
+	// A request waiting on the endpoint is aborted
+	webhook, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh = webhook.(*Webhook)
+	result := make(chan SendResult, 1)
+	go func() {
+		result <- wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL + "/hang"})
+	}()
+
+	c.Assert(<-requests, Equals, "/hang")
+	wh.Cancel()
+	select {
+	case r := <-result:
+		c.Assert(r.Attempts, Equals, 1)
+		c.Assert(errors.Is(r.Err, context.Canceled), Equals, true)
+	case <-time.After(2 * time.Second):
+		c.Fatal("request not cancelled")
+	}
+}
+
+// retryLogger signals when a webhook starts waiting for a retry
+type retryLogger struct {
+	TestLogger
+	retrying chan struct{}
+}
+
+func (l *retryLogger) Debugf(format string, args ...interface{}) {
+	if strings.Contains(format, "retry attempt") {
+		l.retrying <- struct{}{}
+	}
+}
+
+// Test a latency observation is recorded for every request attempt
+func (s *SuiteWebhook) TestRequestDuration(c *C) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		time.Sleep(10 * time.Millisecond)
+		if requests == 1 {
+			w.WriteHeader(502)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	type observation struct {
+		webhook    string
+		statusCode int
+		duration   time.Duration
+	}
+	var observations []observation
+	OnRequestDuration = func(webhook string, statusCode int, duration time.Duration) {
+		observations = append(observations, observation{webhook, statusCode, duration})
+	}
+	defer func() { OnRequestDuration = nil }()
+
+	def := WebhookDefinition{Name: "timed", URL: ts.URL, Method: "POST", Timeout: 5, Retry: &RetryConfig{Count: 1}}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	wh.sleep = func(time.Duration) {}
+
+	wh.send(&TestLogger{}, &WebhookTemplateData{})
+	c.Assert(observations, HasLen, 2)
+	c.Assert(observations[0].webhook, Equals, "timed")
+	c.Assert(observations[0].statusCode, Equals, 502)
+	c.Assert(observations[1].statusCode, Equals, 200)
+	for _, o := range observations {
+		c.Assert(o.duration >= 10*time.Millisecond, Equals, true)
+	}
+}
+
+// Test the pre-send hook can change the request before delivery
+func (s *SuiteWebhook) TestPreSendHook(c *C) {
+	received := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	PreSendHook = func(req *WebhookRequest) {
+		c.Assert(req.Webhook, Equals, "hooked")
+		req.Headers["X-Computed"] = fmt.Sprintf("%d", len(req.Body))
+		req.URL = ts.URL + "/rewritten"
+	}
+	defer func() { PreSendHook = nil }()
+
+	def := WebhookDefinition{Name: "hooked", URL: ts.URL + "/original", Method: "POST", Body: "test", Timeout: 5}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	webhook.(*Webhook).send(&TestLogger{}, &WebhookTemplateData{})
+
+	r := <-received
+	c.Assert(r.Header.Get("X-Computed"), Equals, "4")
+	c.Assert(r.URL.Path, Equals, "/rewritten")
+}
+
+// Test failures can be told apart with errors.As
+func (s *SuiteWebhook) TestTypedErrors(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(429)
+		w.Write([]byte("slow down"))
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Timeout: 5}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	result := wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL})
+	var statusErr *HTTPStatusError
+	c.Assert(errors.As(result.Err, &statusErr), Equals, true)
+	c.Assert(statusErr.StatusCode, Equals, 429)
+	c.Assert(statusErr.Body, Equals, "slow down")
+	c.Assert(result.Err, ErrorMatches, "non-2xx status code: 429, body: slow down")
+
+	// Nothing listens on a closed server
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	result = wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: closed.URL})
+	var transportErr *TransportError
+	c.Assert(errors.As(result.Err, &transportErr), Equals, true)
+	c.Assert(result.Err, ErrorMatches, "request failed: .*")
+
+	wh.url = "{{.Missing.Field}}"
+	var templateErr *TemplateError
+	c.Assert(errors.As(wh.Ping(), &templateErr), Equals, true)
+	c.Assert(templateErr.Which, Equals, "URL")
+}
+
+func (s *SuiteWebhook) TestMaxResponseBytes(c *C) {
+	detail := `{"error": "validation failed", "fields": [` + strings.Repeat(`{"name": "x", "reason": "bad"},`, 100) + `]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		w.Write([]byte(detail))
+	}))
+	defer ts.Close()
+
+	send := func(maxResponseBytes int) string {
+		def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Timeout: 5, MaxResponseBytes: maxResponseBytes}
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+		result := webhook.(*Webhook).sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL})
+		var statusErr *HTTPStatusError
+		c.Assert(errors.As(result.Err, &statusErr), Equals, true)
+		return statusErr.Body
+	}
+
+	c.Assert(send(0), Equals, detail[:1024])
+	c.Assert(send(8192), Equals, detail)
+	c.Assert(send(16), Equals, `{"error": "valid`)
+
+	def := WebhookDefinition{Name: "test", Type: WebhookTypeAll, MaxResponseBytes: -1}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*invalid maxResponseBytes.*")
+}
+
+// Test an error body that never ends is cut off by the timeout
+func (s *SuiteWebhook) TestSlowResponseBody(c *C) {
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+		w.Write([]byte("overloaded"))
+		w.(http.Flusher).Flush()
+		<-hang
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Timeout: 5}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	wh.client.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	result := wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL})
+	c.Assert(time.Since(start) < 2*time.Second, Equals, true)
+
+	var statusErr *HTTPStatusError
+	c.Assert(errors.As(result.Err, &statusErr), Equals, true)
+	c.Assert(statusErr.StatusCode, Equals, 503)
+	c.Assert(statusErr.Body, Equals, "overloaded")
+	c.Assert(statusErr.BodyErr, NotNil)
+	c.Assert(result.Err, ErrorMatches, "non-2xx status code: 503, body: overloaded \\(incomplete: .*\\)")
+}
+
+// Test successCodes replace the 2xx acceptance check
+func (s *SuiteWebhook) TestSuccessCodes(c *C) {
+	// The path is the status code to answer with
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if status == http.StatusFound {
+			w.Header().Set("Location", "/200")
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:              "test",
+		URL:               ts.URL,
+		Method:            "POST",
+		Timeout:           5,
+		Retry:             &RetryConfig{Count: 2, Backoff: "1ms"},
+		SuccessCodes:      []int{409},
+		SuccessCodeRanges: []string{"200-299", "300-399"},
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	// A 409 "already exists" is delivered, without retrying
+	result := wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL + "/409"})
+	c.Assert(result.Err, IsNil)
+	c.Assert(result.Attempts, Equals, 1)
+	c.Assert(result.StatusCode, Equals, 409)
+
+	// Accepted redirects are not followed
+	result = wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL + "/302"})
+	c.Assert(result.Err, IsNil)
+	c.Assert(result.StatusCode, Equals, http.StatusFound)
+
+	// Other codes are retried failures
+	result = wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL + "/410"})
+	c.Assert(result.Err, ErrorMatches, "non-2xx status code: 410.*")
+	c.Assert(result.Attempts, Equals, 3)
+
+	// By default only 2xx is accepted
+	def.SuccessCodes, def.SuccessCodeRanges = nil, nil
+	webhook, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	result = webhook.(*Webhook).sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL + "/409"})
+	c.Assert(result.Success, Equals, false)
+
+	def.SuccessCodeRanges = []string{"299-200"}
+	_, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, `invalid success code range "299-200".*`)
+	def.SuccessCodeRanges = nil
+	def.SuccessCodes = []int{1200}
+	_, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, `invalid success code 1200.*`)
+
+	def = WebhookDefinition{Name: "test", Type: WebhookTypeAll, Transport: TransportNATS, Subject: "jobs", SuccessCodes: []int{409}}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*successCodes only apply to the http transport")
+}
+
+// Test SuccessFunc decides success instead of the status code
+func (s *SuiteWebhook) TestSuccessFunc(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Result", strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("see header"))
+	}))
+	defer ts.Close()
+
+	SuccessFunc = func(resp *http.Response) bool {
+		return resp.Header.Get("X-Result") == "ok"
+	}
+	defer func() { SuccessFunc = nil }()
+
+	def := WebhookDefinition{Name: "test", URL: ts.URL, Method: "POST", Timeout: 5, Retry: &RetryConfig{Count: 1, Backoff: "1ms"}}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	result := wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL + "/ok"})
+	c.Assert(result.Err, IsNil)
+
+	// A 200 the function rejects is a failure, retried like any other
+	result = wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL + "/failed"})
+	c.Assert(result.Err, ErrorMatches, "response rejected by SuccessFunc, status code: 200, body: see header")
+	c.Assert(result.Attempts, Equals, 2)
+	var statusErr *HTTPStatusError
+	c.Assert(errors.As(result.Err, &statusErr), Equals, true)
+	c.Assert(statusErr.Rejected, Equals, true)
+}
+
+// Test response headers are captured and logged after a successful send
+func (s *SuiteWebhook) TestCaptureResponseHeaders(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ticket-ID", "INC-1234")
+		w.Header().Set("X-Other", "ignored")
+		w.WriteHeader(201)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:                   "tickets",
+		URL:                    ts.URL,
+		Method:                 "POST",
+		Timeout:                5,
+		CaptureResponseHeaders: []string{"x-ticket-id", "X-Missing"},
+	}
+
+	var results []SendResult
+	OnSendResult = func(r SendResult) { results = append(results, r) }
+	defer func() { OnSendResult = nil }()
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	logger := &recordingLogger{}
+	webhook.(*Webhook).send(logger, &WebhookTemplateData{})
+
+	c.Assert(logger.errors, HasLen, 0)
+	c.Assert(logger.notices, DeepEquals, []string{`Webhook "tickets": response headers X-Ticket-Id="INC-1234"`})
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].ResponseHeaders, DeepEquals, map[string]string{"X-Ticket-Id": "INC-1234"})
+}
+
+// Test that every send starts again from the base backoff
+func (s *SuiteWebhook) TestRetryBackoffResetPerSend(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:    "test",
+		URL:     ts.URL,
+		Method:  "POST",
+		Timeout: 5,
+		Retry: &RetryConfig{
+			Count:   2,
+			Backoff: "10ms",
+		},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	wh := webhook.(*Webhook)
+	var sleeps []time.Duration
+	wh.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	c.Assert(wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL}).Err, NotNil)
+	c.Assert(wh.sendWithRetry(&WebhookRequest{Method: "POST", URL: ts.URL}).Err, NotNil)
+
+	c.Assert(sleeps, DeepEquals, []time.Duration{
+		10 * time.Millisecond, 20 * time.Millisecond,
+		10 * time.Millisecond, 20 * time.Millisecond,
+	})
+	c.Assert(wh.retry.backoff, Equals, 10*time.Millisecond)
+}
+
+// Test retryOnError and retryOnSuccess replace retry by outcome
+func (s *SuiteWebhook) TestRetryPerOutcome(c *C) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(500)
+	}))
+	defer ts.Close()
+
+	def := WebhookDefinition{
+		Name:           "test",
+		Type:           WebhookTypeAll,
+		URL:            ts.URL,
+		Method:         "POST",
+		Timeout:        5,
+		Retry:          &RetryConfig{Count: 1},
+		RetryOnError:   &RetryConfig{Count: 3},
+		RetryOnSuccess: &RetryConfig{Count: 0},
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	wh := webhook.(*Webhook)
+	wh.sleep = func(time.Duration) {}
+
+	cases := []struct {
+		data     interface{}
+		expected int
+	}{
+		{&WebhookTemplateData{Failed: true}, 4},
+		{&WebhookTemplateData{}, 1},
+		{&WebhookBatchData{Failed: 1}, 4},
+		{&WebhookBatchData{}, 1},
+	}
+	for _, tc := range cases {
+		attempts = 0
+		wh.send(&TestLogger{}, tc.data)
+		c.Assert(attempts, Equals, tc.expected)
+	}
+
+	def.RetryOnError = &RetryConfig{Count: -1}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*invalid retryOnError count -1.*")
+}
+
+// Test a success counted as a failure through failOnStderr uses retryOnError
+func (s *SuiteWebhook) TestRetryPerOutcomeFailOnStderr(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer ts.Close()
+
+	results := make(chan SendResult, 1)
+	OnSendResult = func(r SendResult) { results <- r }
+	defer func() { OnSendResult = nil }()
+
+	def := WebhookDefinition{
+		Name:           "test",
+		Type:           WebhookTypeError,
+		Active:         true,
+		URL:            ts.URL,
+		Method:         "POST",
+		Timeout:        5,
+		FailOnStderr:   true,
+		RetryOnError:   &RetryConfig{Count: 2, Backoff: "1ms"},
+		RetryOnSuccess: &RetryConfig{Count: 0},
+	}
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.ctx.Start()
+	s.ctx.Execution.ErrorStream.Write([]byte("warning: disk almost full\n"))
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case r := <-results:
+		c.Assert(r.Attempts, Equals, 3)
+	case <-time.After(2 * time.Second):
+		c.Fatal("webhook not sent")
+	}
+}
+
+// Test minimum TLS version
+func (s *SuiteWebhook) TestMinTLSVersion(c *C) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	newWebhook := func(version string) *Webhook {
+		def := WebhookDefinition{
+			Name:          "test",
+			URL:           ts.URL,
+			Method:        "POST",
+			Timeout:       5,
+			MinTLSVersion: version,
+		}
+
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+
+		wh := webhook.(*Webhook)
+		wh.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+		return wh
+	}
+
+	// Default is TLS 1.2
+	wh := newWebhook("")
+	c.Assert(wh.client.Transport.(*http.Transport).TLSClientConfig.MinVersion, Equals, uint16(tls.VersionTLS12))
+	_, err := wh.transport.send(context.Background(), &WebhookRequest{Method: "POST", URL: ts.URL})
+	c.Assert(err, IsNil)
+
+	// A TLS 1.3 only client rejects a TLS 1.2 server
+	wh = newWebhook("1.3")
+	c.Assert(wh.client.Transport.(*http.Transport).TLSClientConfig.MinVersion, Equals, uint16(tls.VersionTLS13))
+	_, err = wh.transport.send(context.Background(), &WebhookRequest{Method: "POST", URL: ts.URL})
+	c.Assert(err, NotNil)
+
+	_, err = NewWebhookFromDefinition(WebhookDefinition{MinTLSVersion: "1.4"}, &TestLogger{})
+	c.Assert(err, ErrorMatches, ".*invalid minimum TLS version.*")
+}
+
+// Test keep-alive settings of the transport
+func (s *SuiteWebhook) TestKeepAliveSettings(c *C) {
+	transport := func(def WebhookDefinition) *http.Transport {
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+		return webhook.(*Webhook).client.Transport.(*http.Transport)
+	}
+
+	t := transport(WebhookDefinition{Name: "default"})
+	c.Assert(t.IdleConnTimeout, Equals, defaultIdleConnTimeout)
+	c.Assert(t.DisableKeepAlives, Equals, false)
+
+	t = transport(WebhookDefinition{Name: "custom", IdleConnTimeout: "5s", DisableKeepAlives: true})
+	c.Assert(t.IdleConnTimeout, Equals, 5*time.Second)
+	c.Assert(t.DisableKeepAlives, Equals, true)
+
+	_, err := NewWebhookFromDefinition(WebhookDefinition{IdleConnTimeout: "soon"}, &TestLogger{})
+	c.Assert(err, ErrorMatches, ".*invalid idle connection timeout.*")
+}
+
+// Test pinning a host to an address keeps the Host header and TLS server name
+func (s *SuiteWebhook) TestResolveHost(c *C) {
+	type request struct{ host, serverName string }
+	received := make(chan request, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- request{r.Host, r.TLS.ServerName}
+	}))
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	// The test certificate is valid for example.com, which resolves elsewhere
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	url := "https://example.com:" + port + "/hook"
+	def := WebhookDefinition{
+		Name:        "pinned",
+		Type:        WebhookTypeAll,
+		URL:         url,
+		ResolveHost: map[string]string{"Example.com:" + port: ts.Listener.Addr().String()},
+	}
+	c.Assert(prepareWebhookDefinition(&def), IsNil)
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	wh.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+
+	_, err = wh.transport.send(context.Background(), &WebhookRequest{Method: "POST", URL: url})
+	c.Assert(err, IsNil)
+	c.Assert(<-received, Equals, request{"example.com:" + port, "example.com"})
+
+	def.ResolveHost = map[string]string{"example.com:443": "gateway:443"}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `webhook "pinned": invalid resolveHost address "gateway:443" for "example.com:443", must be ip:port`)
+	def.ResolveHost = map[string]string{"example.com": "10.0.0.1:443"}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `webhook "pinned": invalid resolveHost entry "example.com", must be host:port`)
+}
+
+// Test bearer token read from a secret file
+func (s *SuiteWebhook) TestTokenFile(c *C) {
+	received := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("Authorization")
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	tmpfile, err := os.CreateTemp("", "webhook-token-*")
+	c.Assert(err, IsNil)
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.WriteString("s3cr3t\n")
+	c.Assert(err, IsNil)
+	tmpfile.Close()
+
+	def := WebhookDefinition{
+		Name:          "test",
+		URL:           ts.URL,
+		Method:        "POST",
+		Timeout:       5,
+		TokenFile:     tmpfile.Name(),
+		ReloadSecrets: true,
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+
+	wh.sendWebhook(s.ctx)
+	c.Assert(<-received, Equals, "Bearer s3cr3t")
+
+	// Rotated secrets are picked up on the next send
+	c.Assert(os.WriteFile(tmpfile.Name(), []byte("r0tated\n"), 0600), IsNil)
+	wh.sendWebhook(s.ctx)
+	c.Assert(<-received, Equals, "Bearer r0tated")
+
+	// An Authorization header of the webhook wins, whatever its case
+	def.Headers = map[string]string{"authorization": "Basic dXNlcg=="}
+	webhook, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+	req, err := webhook.(*Webhook).render(&TestLogger{}, &WebhookTemplateData{})
+	c.Assert(err, IsNil)
+	c.Assert(req.Headers, DeepEquals, map[string]string{"authorization": "Basic dXNlcg=="})
+	webhook.(*Webhook).sendWebhook(s.ctx)
+	c.Assert(<-received, Equals, "Basic dXNlcg==")
+
+	def.TokenFile = tmpfile.Name() + ".missing"
+	_, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, ErrorMatches, ".*failed to read token file.*")
+}
+
+func (s *SuiteWebhook) TestReadSecretFile(c *C) {
+	tmpfile, err := os.CreateTemp("", "webhook-secret-*")
+	c.Assert(err, IsNil)
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.WriteString("line1\nline2\r\n")
+	c.Assert(err, IsNil)
+	tmpfile.Close()
+
+	secret, err := readSecretFile(tmpfile.Name())
+	c.Assert(err, IsNil)
+	c.Assert(secret, Equals, "line1\nline2")
+}
+
+// Test dedup grouping key
+func (s *SuiteWebhook) TestDedupKey(c *C) {
+	received := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	countSends := func(def WebhookDefinition, failures ...bool) int {
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+
+		for _, failed := range failures {
+			s.SetUpTest(c)
+			s.ctx.Start()
+			if failed {
+				s.ctx.Stop(errors.New("test error"))
+			} else {
+				s.ctx.Stop(nil)
+			}
+			webhook.(*Webhook).sendWebhook(s.ctx)
+		}
+
+		count := len(received)
+		for i := 0; i < count; i++ {
+			<-received
+		}
+		return count
+	}
+
+	def := WebhookDefinition{
+		Name:        "test",
+		URL:         ts.URL,
+		Method:      "POST",
+		Timeout:     5,
+		DedupWindow: "1h",
+	}
 
-	err = webhook.Run(s.ctx)
+	// Without a key everything for the webhook is deduped
+	c.Assert(countSends(def, false, true, false), Equals, 1)
+
+	// Grouping by status sends once per status
+	def.DedupKey = "{{.JobName}}-{{.Failed}}"
+	c.Assert(countSends(def, false, true, false, true), Equals, 2)
+
+	// A per-execution key dedups nothing
+	def.DedupKey = "{{.ExecutionID}}"
+	c.Assert(countSends(def, false, false, false), Equals, 3)
+}
+
+// Test per-job webhook names resolved from templates
+func (s *SuiteWebhook) TestPerJobTemplatedNames(c *C) {
+	received := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	registry := NewWebhookRegistry()
+	for _, tenant := range []string{"acme", "globex"} {
+		registry.Register(WebhookDefinition{
+			Name:    "alerts-" + tenant,
+			Type:    WebhookTypeAll,
+			Active:  true,
+			URL:     ts.URL + "/" + tenant,
+			Method:  "POST",
+			Timeout: 5,
+		})
+	}
+
+	middleware, err := NewWebhookFromConfig(&WebhookConfig{
+		WebhookInfoNames: `["alerts-{{.JobName}}"]`,
+	}, registry, &TestLogger{})
 	c.Assert(err, IsNil)
 
-	time.Sleep(100 * time.Millisecond)
+	for _, tenant := range []string{"acme", "globex"} {
+		s.SetUpTest(c)
+		s.job.Name = tenant
+		s.ctx.Start()
+		s.ctx.Stop(nil)
+		c.Assert(middleware.Run(s.ctx), IsNil)
+
+		select {
+		case path := <-received:
+			c.Assert(path, Equals, "/"+tenant)
+		case <-time.After(2 * time.Second):
+			c.Fatal("webhook not received")
+		}
+	}
+
+	// Unknown resolved names are skipped
+	s.SetUpTest(c)
+	s.job.Name = "initech"
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(middleware.Run(s.ctx), IsNil)
 
 	select {
-	case headers := <-received:
-		c.Assert(headers.Get("X-Job-Status"), Equals, "success")
-	case <-time.After(2 * time.Second):
-		c.Fatal("webhook not received")
+	case <-received:
+		c.Fatal("unknown webhook should not fire")
+	case <-time.After(100 * time.Millisecond):
 	}
 }
 
-// Test retry logic
-func (s *SuiteWebhook) TestRetryLogic(c *C) {
+// Test the send result callback
+func (s *SuiteWebhook) TestOnSendResult(c *C) {
 	attempts := 0
-	var mu sync.Mutex
-
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		mu.Lock()
 		attempts++
-		current := attempts
-		mu.Unlock()
+		if attempts < 2 {
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(202)
+	}))
+	defer ts.Close()
 
-		// Fail first 2 attempts, succeed on 3rd
-		if current < 3 {
+	var results []SendResult
+	OnSendResult = func(result SendResult) { results = append(results, result) }
+	defer func() { OnSendResult = nil }()
+
+	def := WebhookDefinition{
+		Name:    "metrics",
+		URL:     ts.URL,
+		Method:  "POST",
+		Timeout: 5,
+		Retry:   &RetryConfig{Count: 2, Backoff: "1ms"},
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	webhook.(*Webhook).sendWebhook(s.ctx)
+
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Webhook, Equals, "metrics")
+	c.Assert(results[0].Success, Equals, true)
+	c.Assert(results[0].Err, IsNil)
+	c.Assert(results[0].StatusCode, Equals, 202)
+	c.Assert(results[0].Attempts, Equals, 2)
+	c.Assert(results[0].Duration > 0, Equals, true)
+}
+
+// Test correlation header is stable across retries
+func (s *SuiteWebhook) TestTraceHeader(c *C) {
+	var values []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values = append(values, r.Header.Get("traceparent"))
+		if len(values) < 2 {
 			w.WriteHeader(500)
-		} else {
-			w.WriteHeader(200)
+			return
 		}
+		w.WriteHeader(200)
 	}))
 	defer ts.Close()
 
@@ -281,26 +2641,26 @@ func (s *SuiteWebhook) TestRetryLogic(c *C) {
 		Name:    "test",
 		URL:     ts.URL,
 		Method:  "POST",
-		Body:    "test",
 		Timeout: 5,
-		Retry: &RetryConfig{
-			Count:   3,
-			Backoff: "10ms",
-		},
+		Retry:   &RetryConfig{Count: 2, Backoff: "1ms"},
+		Trace:   &TraceConfig{Header: "traceparent"},
 	}
 
 	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
 	c.Assert(err, IsNil)
+	webhook.(*Webhook).sendWebhook(s.ctx)
 
-	err = webhook.Run(s.ctx)
-	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{s.ctx.Execution.ID, s.ctx.Execution.ID})
 
-	// Wait for retries to complete
-	time.Sleep(200 * time.Millisecond)
+	// Custom value template and default header name
+	def.Trace = &TraceConfig{Value: "ofelia-{{.ExecutionID}}"}
+	webhook, err = NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
 
-	mu.Lock()
-	c.Assert(attempts, Equals, 3)
-	mu.Unlock()
+	name, value, err := webhook.(*Webhook).renderTraceHeader(buildTemplateData(s.ctx, true, 0, ""))
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "X-Correlation-ID")
+	c.Assert(value, Equals, "ofelia-"+s.ctx.Execution.ID)
 }
 
 // Test config file parsing
@@ -310,6 +2670,7 @@ func (s *SuiteWebhook) TestParseWebhookConfigFile(c *C) {
 		"webhooks": [
 			{
 				"name": "test1",
+				"type": "all",
 				"priority": 100,
 				"url": "https://example.com/webhook1",
 				"method": "POST",
@@ -317,6 +2678,7 @@ func (s *SuiteWebhook) TestParseWebhookConfigFile(c *C) {
 			},
 			{
 				"name": "test2",
+				"type": "info",
 				"priority": 200,
 				"url": "https://example.com/webhook2",
 				"body": "test"
@@ -342,6 +2704,504 @@ func (s *SuiteWebhook) TestParseWebhookConfigFile(c *C) {
 	c.Assert(defs[1].Method, Equals, "POST") // Default
 }
 
+// Test file level defaults
+func (s *SuiteWebhook) TestParseWebhookConfigDefaults(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"defaults": {
+			"method": "PUT",
+			"timeout": 30,
+			"headers": {"X-Source": "ofelia"},
+			"retry": {"count": 3, "backoff": "2s"}
+		},
+		"webhooks": [
+			{
+				"name": "inherits",
+				"type": "all",
+				"url": "https://example.com/webhook1"
+			},
+			{
+				"name": "overrides",
+				"type": "all",
+				"url": "https://example.com/webhook2",
+				"method": "POST",
+				"timeout": 5,
+				"headers": {"X-Other": "value"},
+				"retry": {"count": 1}
+			}
+		]
+	}`)
+	defer os.Remove(path)
+
+	defs, err := parseWebhookConfigFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(defs, HasLen, 2)
+
+	c.Assert(defs[0].Method, Equals, "PUT")
+	c.Assert(defs[0].Timeout, Equals, 30)
+	c.Assert(defs[0].Headers, DeepEquals, map[string]string{"X-Source": "ofelia"})
+	c.Assert(*defs[0].Retry, DeepEquals, RetryConfig{Count: 3, Backoff: "2s"})
+
+	c.Assert(defs[1].Method, Equals, "POST")
+	c.Assert(defs[1].Timeout, Equals, 5)
+	c.Assert(defs[1].Headers, DeepEquals, map[string]string{"X-Other": "value"})
+	c.Assert(*defs[1].Retry, DeepEquals, RetryConfig{Count: 1})
+}
+
+func (s *SuiteWebhook) TestParseDefaultHeaders(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"defaultHeaders": {"X-Source": "ofelia", "Authorization": "Bearer shared"},
+		"webhooks": [
+			{"name": "plain", "type": "all", "url": "https://example.com/plain"},
+			{
+				"name": "custom",
+				"type": "all",
+				"url": "https://example.com/custom",
+				"headers": {"authorization": "Bearer own", "X-Other": "value"}
+			}
+		]
+	}`)
+	defer os.Remove(path)
+
+	defs, err := parseWebhookConfigFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(defs, HasLen, 2)
+
+	c.Assert(defs[0].Headers, DeepEquals, map[string]string{
+		"X-Source":      "ofelia",
+		"Authorization": "Bearer shared",
+	})
+	c.Assert(defs[1].Headers, DeepEquals, map[string]string{
+		"X-Source":      "ofelia",
+		"authorization": "Bearer own",
+		"X-Other":       "value",
+	})
+}
+
+func (s *SuiteWebhook) TestTemplatePartials(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(dir, "templates"), 0755), IsNil)
+	err := os.WriteFile(filepath.Join(dir, "templates", "slack.tmpl"), []byte(
+		`{{define "status"}}{{.JobName | upper}} {{if .Failed}}failed{{else}}succeeded{{end}}{{end}}`), 0644)
+	c.Assert(err, IsNil)
+
+	path := filepath.Join(dir, "webhooks.json")
+	err = os.WriteFile(path, []byte(`{
+		"templateDir": "templates",
+		"webhooks": [
+			{"name": "slack", "type": "all", "url": "https://example.com", "body": "{{template \"status\" .}} on {{.Hostname}}"}
+		]
+	}`), 0644)
+	c.Assert(err, IsNil)
+
+	defs, err := parseWebhookConfigFile(path)
+	c.Assert(err, IsNil)
+	defer loadWebhookPartials("", nil)
+
+	body, err := executeTemplateForBody(defs[0].Body, &WebhookTemplateData{JobName: "backup", Failed: true, Hostname: "server-01"})
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "BACKUP failed on server-01")
+
+	c.Assert(loadWebhookPartials(filepath.Join(dir, "missing"), nil), ErrorMatches, ".*failed to load templates.*")
+}
+
+func (s *SuiteWebhook) TestInlinePartials(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(dir, "templates"), 0755), IsNil)
+	err := os.WriteFile(filepath.Join(dir, "templates", "host.tmpl"), []byte(`{{define "host"}}on {{.Hostname}}{{end}}`), 0644)
+	c.Assert(err, IsNil)
+
+	// Inline partials can invoke each other and the templateDir ones
+	path := filepath.Join(dir, "webhooks.json")
+	err = os.WriteFile(path, []byte(`{
+		"templateDir": "templates",
+		"partials": {
+			"statusBlock": "{{.JobName}} {{template \"outcome\" .}} {{template \"host\" .}}",
+			"outcome": "{{if .Failed}}failed{{else}}succeeded{{end}}"
+		},
+		"webhooks": [
+			{"name": "slack", "type": "all", "url": "https://example.com", "body": "{{template \"statusBlock\" .}}"}
+		]
+	}`), 0644)
+	c.Assert(err, IsNil)
+
+	defs, err := parseWebhookConfigFile(path)
+	c.Assert(err, IsNil)
+	defer loadWebhookPartials("", nil)
+
+	body, err := executeTemplateForBody(defs[0].Body, &WebhookTemplateData{JobName: "backup", Failed: true, Hostname: "server-01"})
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "backup failed on server-01")
+
+	c.Assert(loadWebhookPartials(filepath.Join(dir, "templates"), map[string]string{"host": "{{.Hostname}}"}), ErrorMatches, `partial "host" is defined both inline and in .*`)
+	c.Assert(loadWebhookPartials("", map[string]string{"broken": "{{.JobName"}), ErrorMatches, `failed to parse partial "broken".*`)
+}
+
+func (s *SuiteWebhook) TestDisableWebhookEnv(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "noisy", "type": "all", "active": true, "url": "https://example.com/noisy"},
+			{"name": "quiet", "type": "all", "active": true, "url": "https://example.com/quiet"}
+		]
+	}`)
+	defer os.Remove(path)
+
+	os.Setenv(disableWebhooksEnv, " noisy , unknown")
+	defer os.Unsetenv(disableWebhooksEnv)
+
+	_, registry := LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path}, nil, &TestLogger{})
+
+	noisy, ok := registry.Get("noisy")
+	c.Assert(ok, Equals, true)
+	c.Assert(noisy.Active, Equals, false)
+
+	quiet, ok := registry.Get("quiet")
+	c.Assert(ok, Equals, true)
+	c.Assert(quiet.Active, Equals, true)
+}
+
+func (s *SuiteWebhook) TestGlobalKillSwitch(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"enabled": false,
+		"webhooks": [{"name": "alerts", "type": "all", "active": true, "url": "https://example.com"}]
+	}`)
+	defer os.Remove(path)
+
+	config := &WebhookFileConfig{WebhookConfigFile: path}
+	middlewares, registry := LoadWebhookMiddlewares(config, nil, &TestLogger{})
+	c.Assert(middlewares, HasLen, 0)
+
+	// Per-job references still validate but build nothing
+	_, ok := registry.Get("alerts")
+	c.Assert(ok, Equals, true)
+	perJob, err := NewWebhookFromConfig(&WebhookConfig{WebhookErrorNames: "alerts"}, registry, &TestLogger{})
+	c.Assert(err, IsNil)
+	c.Assert(perJob, IsNil)
+	_, err = NewWebhookFromConfig(&WebhookConfig{WebhookErrorNames: "missing"}, registry, &TestLogger{})
+	c.Assert(err, NotNil)
+
+	// The environment overrides the file
+	os.Setenv(webhooksEnabledEnv, "true")
+	middlewares, _ = LoadWebhookMiddlewares(config, nil, &TestLogger{})
+	c.Assert(middlewares, HasLen, 1)
+
+	os.Setenv(webhooksEnabledEnv, "false")
+	defer os.Unsetenv(webhooksEnabledEnv)
+	path = writeTempWebhookConfig(c, `{
+		"webhooks": [{"name": "alerts", "type": "all", "active": true, "url": "https://example.com"}]
+	}`)
+	defer os.Remove(path)
+	middlewares, _ = LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path}, nil, &TestLogger{})
+	c.Assert(middlewares, HasLen, 0)
+}
+
+func (s *SuiteWebhook) TestAllowedHosts(c *C) {
+	allowlist := newHostAllowlist([]string{"hooks.example.com", " *.internal.example.org, "})
+	for url, expected := range map[string]bool{
+		"https://hooks.example.com/alert":        true,
+		"https://HOOKS.example.com:8443/alert":   true,
+		"https://ci.internal.example.org/x":      true,
+		"https://internal.example.org/x":         false,
+		"https://hooks.example.com.evil.com/x":   false,
+		"https://evil.com/?next=hooks.example.c": false,
+		"nats://nats.internal.example.org":       true,
+	} {
+		ok, _ := allowlist.allows(url)
+		c.Assert(ok, Equals, expected, Commentf("url %s", url))
+	}
+
+	ok, _ := hostAllowlist(nil).allows("https://anything.example.net")
+	c.Assert(ok, Equals, true)
+
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	// Static URLs are rejected at load, templated ones at send time
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "allowed", "type": "all", "url": "`+ts.URL+`/allowed"},
+			{"name": "exfiltrate", "type": "all", "url": "https://evil.example.net/collect"},
+			{"name": "dynamic", "type": "all", "url": "{{.JobName}}"}
+		]
+	}`)
+	defer os.Remove(path)
+
+	config := &WebhookFileConfig{WebhookConfigFile: path, WebhookAllowedHosts: []string{"127.0.0.1"}}
+	logger := &recordingLogger{}
+	_, registry := LoadWebhookMiddlewares(config, nil, logger)
+	c.Assert(logger.errors, DeepEquals, []string{`Webhook "exfiltrate" rejected: host "evil.example.net" is not in webhook-allowed-hosts`})
+	_, ok = registry.Get("exfiltrate")
+	c.Assert(ok, Equals, false)
+
+	dynamic, err := registry.webhook("dynamic", &TestLogger{})
+	c.Assert(err, IsNil)
+	logger = &recordingLogger{}
+	dynamic.send(logger, &WebhookTemplateData{JobName: "https://evil.example.net/collect"})
+	c.Assert(logger.errors, DeepEquals, []string{`Webhook "dynamic": host "evil.example.net" is not in webhook-allowed-hosts, not sending`})
+
+	dynamic.send(logger, &WebhookTemplateData{JobName: ts.URL + "/dynamic"})
+	c.Assert(<-received, Equals, "/dynamic")
+
+	// Endpoints reached without a url are checked too
+	path = writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "sns", "type": "all", "transport": "sns", "topicARN": "arn:aws:sns:eu-west-1:123456789012:alerts"},
+			{"name": "oauth2", "type": "all", "url": "`+ts.URL+`/oauth2", "oauth2": {"tokenURL": "https://evil.example.net/token", "clientID": "ofelia"}}
+		]
+	}`)
+	defer os.Remove(path)
+
+	config = &WebhookFileConfig{WebhookConfigFile: path, WebhookAllowedHosts: []string{"127.0.0.1"}}
+	logger = &recordingLogger{}
+	LoadWebhookMiddlewares(config, nil, logger)
+	c.Assert(logger.errors, DeepEquals, []string{
+		`Webhook "sns" rejected: host "sns.eu-west-1.amazonaws.com" is not in webhook-allowed-hosts`,
+		`Webhook "oauth2" rejected: host "evil.example.net" is not in webhook-allowed-hosts`,
+	})
+
+	// and again at send time, e.g. for webhooks defined through the registry
+	for host, def := range map[string]WebhookDefinition{
+		"sns.eu-west-1.amazonaws.com": {Name: "sns", Type: WebhookTypeAll, Transport: TransportSNS, TopicARN: "arn:aws:sns:eu-west-1:123456789012:alerts"},
+		"evil.example.net":            {Name: "oauth2", Type: WebhookTypeAll, URL: ts.URL + "/oauth2", OAuth2: &OAuth2Config{TokenURL: "https://evil.example.net/token", ClientID: "ofelia"}},
+	} {
+		c.Assert(prepareWebhookDefinition(&def), IsNil)
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+		wh := webhook.(*Webhook)
+		wh.allowedHosts = newHostAllowlist(config.WebhookAllowedHosts)
+
+		logger = &recordingLogger{}
+		wh.send(logger, &WebhookTemplateData{JobName: "backup"})
+		c.Assert(logger.errors, DeepEquals, []string{fmt.Sprintf(`Webhook %q: host %q is not in webhook-allowed-hosts, not sending`, def.Name, host)})
+	}
+}
+
+func (s *SuiteWebhook) TestExecutionOrder(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "late", "type": "error", "url": "https://example.com", "priority": 10},
+			{"name": "info", "type": "info", "url": "https://example.com"},
+			{"name": "all", "type": "all", "url": "https://example.com"},
+			{"name": "error", "type": "error", "url": "https://example.com"},
+			{"name": "info-2", "type": "info", "url": "https://example.com"},
+			{"name": "first", "type": "info", "url": "https://example.com", "priority": -1}
+		]
+	}`)
+	defer os.Remove(path)
+
+	middlewares, _ := LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path}, nil, &TestLogger{})
+	var names []string
+	for _, m := range middlewares {
+		names = append(names, m.(*Webhook).name)
+	}
+	c.Assert(names, DeepEquals, []string{"first", "error", "all", "info", "info-2", "late"})
+}
+
+// Test every global webhook runs, the scheduler keeps one middleware per type
+func (s *SuiteWebhook) TestWebhookChain(c *C) {
+	received := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	var middlewares []core.Middleware
+	for _, name := range []string{"first", "second", "third"} {
+		def := WebhookDefinition{Name: name, Type: WebhookTypeInfo, Active: true, URL: ts.URL + "/" + name, Method: "POST", Timeout: 5}
+		if name == "third" {
+			def.Type = WebhookTypeError
+		}
+		webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+		c.Assert(err, IsNil)
+		middlewares = append(middlewares, webhook)
+	}
+	c.Assert(NewWebhookChain(nil), IsNil)
+
+	s.job.Use(NewWebhookChain(middlewares))
+	c.Assert(s.job.Middlewares(), HasLen, 1)
+
+	s.ctx = core.NewContext(core.NewScheduler(&TestLogger{}), s.job, core.NewExecution())
+	s.ctx.Start()
+	c.Assert(s.ctx.Next(), IsNil)
+
+	paths := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-received:
+			paths[path] = true
+		case <-time.After(2 * time.Second):
+			c.Fatal("webhook not received")
+		}
+	}
+	c.Assert(paths, DeepEquals, map[string]bool{"/first": true, "/second": true})
+}
+
+func (s *SuiteWebhook) TestRelativeConfigFilePath(c *C) {
+	dir := c.MkDir()
+	err := os.WriteFile(filepath.Join(dir, "webhooks.json"), []byte(`{
+		"webhooks": [{"name": "relative", "type": "all", "url": "https://example.com"}]
+	}`), 0644)
+	c.Assert(err, IsNil)
+
+	config := &WebhookFileConfig{WebhookConfigFile: "webhooks.json"}
+	config.SetConfigDir(dir)
+	c.Assert(config.configFilePath(), Equals, filepath.Join(dir, "webhooks.json"))
+
+	_, registry := LoadWebhookMiddlewares(config, nil, &TestLogger{})
+	_, ok := registry.Get("relative")
+	c.Assert(ok, Equals, true)
+
+	// Absolute paths are used as-is
+	config = &WebhookFileConfig{WebhookConfigFile: "/etc/ofelia/webhooks.json"}
+	config.SetConfigDir(dir)
+	c.Assert(config.configFilePath(), Equals, "/etc/ofelia/webhooks.json")
+}
+
+func (s *SuiteWebhook) TestWebhookSections(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "from-file", "type": "all", "active": true, "url": "https://example.com/file"},
+			{"name": "shared", "type": "all", "active": true, "url": "https://example.com/file-shared"}
+		]
+	}`)
+	defer os.Remove(path)
+
+	sections := map[string]*WebhookSection{
+		"inline": {
+			Type:       WebhookTypeError,
+			Active:     true,
+			URL:        "https://example.com/inline",
+			Header:     []string{"X-Source: ofelia", "Authorization: Bearer a:b"},
+			Body:       "{{.JobName}} failed",
+			RetryCount: 2,
+		},
+		"shared": {Type: WebhookTypeAll, URL: "https://example.com/inline-shared"},
+	}
+
+	middlewares, registry := LoadWebhookMiddlewares(&WebhookFileConfig{WebhookConfigFile: path}, sections, &TestLogger{})
+	c.Assert(middlewares, HasLen, 3)
+
+	inline, ok := registry.Get("inline")
+	c.Assert(ok, Equals, true)
+	c.Assert(inline.Method, Equals, "POST")
+	c.Assert(inline.Body, Equals, "{{.JobName}} failed")
+	c.Assert(inline.Headers, DeepEquals, map[string]string{"X-Source": "ofelia", "Authorization": "Bearer a:b"})
+	c.Assert(*inline.Retry, DeepEquals, RetryConfig{Count: 2})
+
+	// Inline sections take precedence over the file
+	shared, ok := registry.Get("shared")
+	c.Assert(ok, Equals, true)
+	c.Assert(shared.URL, Equals, "https://example.com/inline-shared")
+
+	_, err := parseWebhookSections(map[string]*WebhookSection{
+		"broken": {Type: WebhookTypeAll, URL: "https://example.com", Header: []string{"no separator"}},
+	})
+	c.Assert(err, ErrorMatches, `webhook "broken": invalid header.*`)
+
+	_, err = parseWebhookSections(map[string]*WebhookSection{"untyped": {URL: "https://example.com"}})
+	c.Assert(err, ErrorMatches, ".*missing required 'type'.*")
+}
+
+func (s *SuiteWebhook) TestValidateWebhookReferences(c *C) {
+	registry := NewWebhookRegistry()
+	registry.Register(WebhookDefinition{Name: "errors", Type: WebhookTypeError})
+	registry.Register(WebhookDefinition{Name: "everything", Type: WebhookTypeAll})
+
+	jobs := map[string]*WebhookConfig{
+		"good": {
+			WebhookErrorNames: "errors, everything",
+			WebhookInfoNames:  "everything, {{.JobName}}-info",
+		},
+		"mismatched": {WebhookInfoNames: "errors"},
+		"missing":    {WebhookErrorNames: `["everything", "nope"]`},
+	}
+
+	err := ValidateWebhookReferences(jobs, registry)
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "invalid webhook references:\n"+
+		`  job mismatched: webhook "errors" has type "error" but is referenced in webhook-info-names (must be "info" or "all")`+"\n"+
+		`  job missing: webhook-error-names references unknown webhook "nope"`)
+
+	delete(jobs, "mismatched")
+	delete(jobs, "missing")
+	c.Assert(ValidateWebhookReferences(jobs, registry), IsNil)
+}
+
+func (s *SuiteWebhook) TestWebhookConfigSchema(c *C) {
+	var schema struct {
+		Properties struct {
+			Webhooks struct {
+				Items struct {
+					Properties           map[string]map[string]interface{} `json:"properties"`
+					Required             []string                          `json:"required"`
+					AdditionalProperties bool                              `json:"additionalProperties"`
+				} `json:"items"`
+			} `json:"webhooks"`
+		} `json:"properties"`
+	}
+	c.Assert(json.Unmarshal(WebhookConfigSchema(), &schema), IsNil)
+
+	definition := schema.Properties.Webhooks.Items
+	c.Assert(definition.AdditionalProperties, Equals, false)
+	c.Assert(definition.Required, DeepEquals, []string{"type"})
+
+	// Every config field is described
+	fields := reflect.TypeOf(WebhookDefinition{})
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Field(i).Tag.Get("json")
+		c.Assert(definition.Properties[name], NotNil, Commentf("missing property %q", name))
+	}
+
+	c.Assert(definition.Properties["priority"]["type"], Equals, "integer")
+	c.Assert(definition.Properties["type"]["enum"], DeepEquals, []interface{}{"error", "info", "all"})
+	c.Assert(definition.Properties["body"], HasLen, 0)
+	c.Assert(definition.Properties["retry"]["properties"], NotNil)
+}
+
+// recordingLogger keeps the error and notice messages it receives
+type recordingLogger struct {
+	TestLogger
+
+	mu       sync.Mutex
+	errors   []string
+	warnings []string
+	notices  []string
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warningf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Noticef(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notices = append(l.notices, fmt.Sprintf(format, args...))
+}
+
+// writeTempWebhookConfig writes content to a temporary file and returns its path
+func writeTempWebhookConfig(c *C, content string) string {
+	tmpfile, err := os.CreateTemp("", "webhook-test-*.json")
+	c.Assert(err, IsNil)
+
+	_, err = tmpfile.Write([]byte(content))
+	c.Assert(err, IsNil)
+	tmpfile.Close()
+
+	return tmpfile.Name()
+}
+
 // Test malformed JSON
 func (s *SuiteWebhook) TestParseMalformedJSON(c *C) {
 	tmpfile, err := os.CreateTemp("", "webhook-test-*.json")
@@ -356,6 +3216,68 @@ func (s *SuiteWebhook) TestParseMalformedJSON(c *C) {
 	c.Assert(err, NotNil)
 }
 
+func (s *SuiteWebhook) TestParseUnknownField(c *C) {
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{"name": "typo", "type": "all", "url": "https://example.com", "prioirty": 1}
+		]
+	}`)
+	defer os.Remove(path)
+
+	_, err := parseWebhookConfigFile(path)
+	c.Assert(err, ErrorMatches, `failed to parse JSON: json: unknown field "prioirty"`)
+}
+
+// Test unusable config files get an error naming the problem
+func (s *SuiteWebhook) TestParseUnreadableFile(c *C) {
+	dir := c.MkDir()
+	_, err := parseWebhookConfigFile(dir)
+	c.Assert(err, ErrorMatches, `".*" is a directory, not a file.*`)
+
+	path := writeTempWebhookConfig(c, "  \n")
+	defer os.Remove(path)
+	_, err = parseWebhookConfigFile(path)
+	c.Assert(err, ErrorMatches, `".*" is empty.*`)
+
+	if os.Geteuid() == 0 {
+		c.Skip("root can read any file")
+	}
+	c.Assert(os.Chmod(path, 0), IsNil)
+	_, err = parseWebhookConfigFile(path)
+	c.Assert(err, ErrorMatches, `permission denied reading ".*", make it readable.*`)
+}
+
+// Test environment variables are expanded in config file strings
+func (s *SuiteWebhook) TestConfigEnv(c *C) {
+	c.Assert(os.Setenv("OFELIA_TEST_ALERT_BASE", "https://alerts.example.com"), IsNil)
+	defer os.Unsetenv("OFELIA_TEST_ALERT_BASE")
+
+	path := writeTempWebhookConfig(c, `{
+		"webhooks": [
+			{
+				"name": "alerts-${OFELIA_TEST_ENV:-dev}",
+				"type": "error",
+				"url": "${OFELIA_TEST_ALERT_BASE}/hook",
+				"timeout": 5,
+				"body": {"text": "{{$job := .JobName}}{{$job}} $${literal}"}
+			}
+		]
+	}`)
+	defer os.Remove(path)
+
+	defs, err := parseWebhookConfigFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(defs[0].Name, Equals, "alerts-dev")
+	c.Assert(defs[0].URL, Equals, "https://alerts.example.com/hook")
+	c.Assert(defs[0].Timeout, Equals, 5)
+	c.Assert(defs[0].Body, DeepEquals, map[string]interface{}{"text": "{{$job := .JobName}}{{$job}} ${literal}"})
+
+	path = writeTempWebhookConfig(c, `{"webhooks": [{"name": "a", "type": "error", "url": "${OFELIA_TEST_MISSING}/hook"}]}`)
+	defer os.Remove(path)
+	_, err = parseWebhookConfigFile(path)
+	c.Assert(err, ErrorMatches, `environment variable OFELIA_TEST_MISSING is not set.*`)
+}
+
 // Test missing URL validation
 func (s *SuiteWebhook) TestMissingURL(c *C) {
 	content := `{
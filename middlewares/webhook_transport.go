@@ -0,0 +1,363 @@
+package middlewares
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TransportHTTP = "http"
+	TransportNATS = "nats"
+
+	defaultNATSPort = "4222"
+)
+
+// WebhookRequest is a rendered notification ready to be delivered
+type WebhookRequest struct {
+	Webhook string // name of the sending webhook
+	Method  string
+	URL     string
+	Subject string // message subject for queue transports
+	Headers map[string]string
+	Body    []byte
+
+	outcome string   // picks retryOnError or retryOnSuccess, empty for retry
+	env     []string // execution data for the exec transport, see execDataEnv
+}
+
+// Transport delivers rendered webhook requests. It lets programs embedding
+// the middlewares package plug in their own delivery, e.g. a local message
+// bus or a test stub, while keeping templating, retries and the circuit
+// breaker. Send is retried on error, unless the error wraps one returned by
+// the request build step; returning an *HTTPStatusError reports the status
+// code in SendResult.
+type Transport interface {
+	Send(req WebhookRequest) error
+}
+
+// customTransport adapts a Transport to the internal transport interface
+type customTransport struct {
+	transport Transport
+}
+
+func (t *customTransport) send(_ context.Context, r *WebhookRequest) (*webhookResponse, error) {
+	err := t.transport.Send(*r)
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return &webhookResponse{StatusCode: statusErr.StatusCode}, err
+	}
+	return &webhookResponse{}, err
+}
+
+// webhookResponse is what the backend answered to a delivery
+type webhookResponse struct {
+	StatusCode int         // 0 when the backend has no status codes
+	Header     http.Header // nil when the backend has no response headers
+}
+
+// webhookTransport delivers a rendered request to its backend
+type webhookTransport interface {
+	send(ctx context.Context, req *WebhookRequest) (*webhookResponse, error)
+}
+
+// defaultMaxResponseBytes bounds how much of an error response is kept
+const defaultMaxResponseBytes = 1024
+
+// httpTransport delivers requests over HTTP
+type httpTransport struct {
+	client           *http.Client
+	maxResponseBytes int                        // error response bytes kept, defaults to 1024
+	successCodes     successCodes               // accepted status codes, nil for any 2xx
+	hooks            *atomic.Pointer[sendHooks] // those of the webhook, for SuccessFunc
+}
+
+func (t *httpTransport) send(ctx context.Context, r *WebhookRequest) (*webhookResponse, error) {
+	// Create request
+	var bodyReader io.Reader
+	if r.Body != nil {
+		bodyReader = bytes.NewReader(r.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+
+	// Set headers
+	for key, value := range r.Headers {
+		req.Header.Set(key, value)
+	}
+
+	// Send request
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, &TransportError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	response := &webhookResponse{StatusCode: resp.StatusCode, Header: resp.Header}
+
+	// A SuccessFunc replaces the status code check
+	var success func(*http.Response) bool
+	if hooks := t.hooks.Load(); hooks != nil {
+		success = hooks.success
+	}
+	if success != nil {
+		if !success(resp) {
+			return response, t.statusError(resp, true)
+		}
+		return response, nil
+	}
+
+	// Check status code
+	if !t.successCodes.accepts(resp.StatusCode) {
+		return response, t.statusError(resp, false)
+	}
+
+	return response, nil
+}
+
+// statusError reads the start of the response body for error details. The
+// read is bounded by the client timeout, so a server that stops sending
+// midway leaves what arrived so far along with the read error.
+func (t *httpTransport) statusError(resp *http.Response, rejected bool) *HTTPStatusError {
+	limit := t.maxResponseBytes
+	if limit == 0 {
+		limit = defaultMaxResponseBytes
+	}
+	bodyBytes, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)))
+	return &HTTPStatusError{StatusCode: resp.StatusCode, Body: string(bodyBytes), BodyErr: err, Rejected: rejected}
+}
+
+// codeRange is an inclusive range of HTTP status codes
+type codeRange struct {
+	from, to int
+}
+
+// successCodes lists the status codes a webhook treats as delivered
+type successCodes []codeRange
+
+// newSuccessCodes merges single codes and "from-to" ranges, e.g. "200-299"
+func newSuccessCodes(codes []int, ranges []string) (successCodes, error) {
+	var s successCodes
+	for _, code := range codes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid success code %d, must be between 100 and 599", code)
+		}
+		s = append(s, codeRange{code, code})
+	}
+	for _, value := range ranges {
+		first, last, ok := strings.Cut(value, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(first))
+		to, toErr := strconv.Atoi(strings.TrimSpace(last))
+		if !ok || err != nil || toErr != nil || from > to || from < 100 || to > 599 {
+			return nil, fmt.Errorf("invalid success code range %q, must be \"from-to\" between 100 and 599", value)
+		}
+		s = append(s, codeRange{from, to})
+	}
+
+	return s, nil
+}
+
+// accepts reports whether code counts as success, any 2xx when none are set
+func (s successCodes) accepts(code int) bool {
+	if len(s) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, r := range s {
+		if code >= r.from && code <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsRedirect reports whether any 3xx code counts as success, in which
+// case redirects must be returned instead of followed
+func (s successCodes) acceptsRedirect() bool {
+	for _, r := range s {
+		if r.from < 400 && r.to >= 300 {
+			return true
+		}
+	}
+	return false
+}
+
+// natsTransport publishes the body to a NATS subject. It speaks the plain
+// text protocol on a short-lived connection per send, which is plenty for job
+// notifications and avoids pulling in a client library. Headers are sent with
+// HPUB when the server supports them.
+type natsTransport struct {
+	timeout   time.Duration
+	tlsConfig *tls.Config
+}
+
+// natsServerInfo holds the INFO fields the transport cares about
+type natsServerInfo struct {
+	Headers     bool `json:"headers"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+func (t *natsTransport) send(ctx context.Context, r *WebhookRequest) (*webhookResponse, error) {
+	u, err := neturl.Parse(r.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("%w: unsupported NATS URL scheme %q", errInvalidRequest, u.Scheme)
+	}
+	if r.Subject == "" || strings.ContainsAny(r.Subject, " \t\r\n") {
+		return nil, fmt.Errorf("%w: invalid NATS subject %q", errInvalidRequest, r.Subject)
+	}
+
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = defaultNATSPort
+	}
+
+	deadline := time.Now().Add(t.timeout)
+	dialer := &net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, &TransportError{Err: err}
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	// Closing the connection unblocks any read or write in progress
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	info, err := readNATSInfo(reader)
+	if err != nil {
+		return nil, &TransportError{Err: err}
+	}
+
+	// The server announces TLS in INFO and expects the handshake right after
+	if info.TLSRequired || u.Scheme == "tls" {
+		config := &tls.Config{}
+		if t.tlsConfig != nil {
+			config = t.tlsConfig.Clone()
+		}
+		config.ServerName = host
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(deadline)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, &TransportError{Err: err}
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+
+	var msg bytes.Buffer
+	connect, err := json.Marshal(natsConnectOptions(u))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	fmt.Fprintf(&msg, "CONNECT %s\r\n", connect)
+
+	if len(r.Headers) > 0 && info.Headers {
+		header := natsHeaderBlock(r.Headers)
+		fmt.Fprintf(&msg, "HPUB %s %d %d\r\n%s", r.Subject, len(header), len(header)+len(r.Body), header)
+	} else {
+		fmt.Fprintf(&msg, "PUB %s %d\r\n", r.Subject, len(r.Body))
+	}
+	msg.Write(r.Body)
+	msg.WriteString("\r\nPING\r\n")
+
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, &TransportError{Err: err}
+	}
+
+	// The PONG confirms the server processed everything sent before the PING
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, &TransportError{Err: err}
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil, nil
+		case line == "PING":
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return nil, &TransportError{Err: err}
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return nil, fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// readNATSInfo reads the INFO line the server sends on connect
+func readNATSInfo(reader *bufio.Reader) (*natsServerInfo, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO ")
+	if !ok {
+		return nil, fmt.Errorf("unexpected NATS greeting %q", line)
+	}
+
+	info := &natsServerInfo{}
+	if err := json.Unmarshal([]byte(payload), info); err != nil {
+		return nil, fmt.Errorf("invalid NATS INFO: %w", err)
+	}
+	return info, nil
+}
+
+// natsConnectOptions builds the CONNECT options, taking credentials from the
+// URL: user and password, or a lone user as an auth token
+func natsConnectOptions(u *neturl.URL) map[string]interface{} {
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "ofelia",
+		"lang":     "go",
+		"headers":  true,
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options["user"] = u.User.Username()
+			options["pass"] = password
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	return options
+}
+
+// natsHeaderBlock encodes headers in the NATS/1.0 format used by HPUB
+func natsHeaderBlock(headers map[string]string) string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("NATS/1.0\r\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, headers[key])
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -0,0 +1,231 @@
+package middlewares
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SuiteWebhookTransport struct {
+	BaseSuite
+}
+
+var _ = Suite(&SuiteWebhookTransport{})
+
+// natsMessage is a message received by the fake NATS server
+type natsMessage struct {
+	connect string
+	subject string
+	header  string
+	payload string
+}
+
+// newNATSServer starts a fake NATS server that accepts a single publish per
+// connection and reports it on the returned channel
+func (s *SuiteWebhookTransport) newNATSServer(c *C, info string) (net.Listener, chan natsMessage) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	received := make(chan natsMessage, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if msg, err := serveNATSConn(conn, info); err == nil {
+					received <- msg
+				}
+			}()
+		}
+	}()
+
+	return ln, received
+}
+
+func serveNATSConn(conn net.Conn, info string) (natsMessage, error) {
+	var msg natsMessage
+	fmt.Fprintf(conn, "INFO %s\r\n", info)
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return msg, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "CONNECT":
+			msg.connect = strings.TrimSpace(strings.TrimPrefix(line, "CONNECT"))
+		case "PUB", "HPUB":
+			msg.subject = fields[1]
+			total, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, total+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return msg, err
+			}
+			data = data[:total]
+			if fields[0] == "HPUB" {
+				headerSize, _ := strconv.Atoi(fields[2])
+				msg.header, data = string(data[:headerSize]), data[headerSize:]
+			}
+			msg.payload = string(data)
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+			return msg, nil
+		default:
+			return msg, errors.New("unexpected command " + fields[0])
+		}
+	}
+}
+
+func (s *SuiteWebhookTransport) TestNATSPublish(c *C) {
+	ln, received := s.newNATSServer(c, `{"server_id":"test","headers":true}`)
+	defer ln.Close()
+
+	def := WebhookDefinition{
+		Name:      "nats",
+		Type:      WebhookTypeAll,
+		Active:    true,
+		URL:       "nats://ofelia:secret@" + ln.Addr().String(),
+		Method:    "POST",
+		Transport: TransportNATS,
+		Subject:   "jobs.{{.JobName}}",
+		Headers:   map[string]string{"X-Job": "{{.JobName}}"},
+		Body:      "{{.JobName}} failed={{.Failed}}",
+		Timeout:   5,
+	}
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{})
+	c.Assert(err, IsNil)
+
+	s.job.Name = "backup"
+	s.ctx.Start()
+	s.ctx.Stop(nil)
+	c.Assert(webhook.Run(s.ctx), IsNil)
+
+	select {
+	case msg := <-received:
+		c.Assert(msg.subject, Equals, "jobs.backup")
+		c.Assert(msg.header, Equals, "NATS/1.0\r\nX-Job: backup\r\n\r\n")
+		c.Assert(msg.payload, Equals, "backup failed=false")
+		c.Assert(msg.connect, Matches, `.*"user":"ofelia".*`)
+		c.Assert(msg.connect, Matches, `.*"pass":"secret".*`)
+	case <-time.After(2 * time.Second):
+		c.Fatal("message not received")
+	}
+}
+
+// Test servers without header support get a plain PUB
+func (s *SuiteWebhookTransport) TestNATSPublishWithoutHeaders(c *C) {
+	ln, received := s.newNATSServer(c, `{"server_id":"test"}`)
+	defer ln.Close()
+
+	transport := &natsTransport{timeout: 5 * time.Second}
+	_, err := transport.send(context.Background(), &WebhookRequest{
+		URL:     "nats://token@" + ln.Addr().String(),
+		Subject: "jobs",
+		Headers: map[string]string{"X-Job": "backup"},
+		Body:    []byte("payload"),
+	})
+	c.Assert(err, IsNil)
+
+	msg := <-received
+	c.Assert(msg.header, Equals, "")
+	c.Assert(msg.payload, Equals, "payload")
+	c.Assert(msg.connect, Matches, `.*"auth_token":"token".*`)
+}
+
+func (s *SuiteWebhookTransport) TestNATSInvalidRequest(c *C) {
+	transport := &natsTransport{timeout: time.Second}
+
+	_, err := transport.send(context.Background(), &WebhookRequest{URL: "http://localhost", Subject: "jobs"})
+	c.Assert(errors.Is(err, errInvalidRequest), Equals, true)
+
+	_, err = transport.send(context.Background(), &WebhookRequest{URL: "nats://localhost", Subject: "two words"})
+	c.Assert(errors.Is(err, errInvalidRequest), Equals, true)
+}
+
+func (s *SuiteWebhookTransport) TestInvalidTransport(c *C) {
+	def := WebhookDefinition{Name: "test", Type: WebhookTypeAll, URL: "nats://localhost", Transport: "kafka"}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, `.*invalid transport "kafka".*`)
+
+	def = WebhookDefinition{Name: "test", Type: WebhookTypeAll, URL: "nats://localhost", Transport: TransportNATS}
+	c.Assert(prepareWebhookDefinition(&def), ErrorMatches, ".*needs a subject.*")
+}
+
+// fakeTransport records the requests it is given instead of delivering them
+type fakeTransport struct {
+	mu       sync.Mutex
+	requests []WebhookRequest
+	errs     []error // returned in order, then nil
+}
+
+func (t *fakeTransport) Send(req WebhookRequest) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.requests = append(t.requests, req)
+	if len(t.errs) == 0 {
+		return nil
+	}
+	err := t.errs[0]
+	t.errs = t.errs[1:]
+	return err
+}
+
+func (s *SuiteWebhookTransport) TestCustomTransport(c *C) {
+	transport := &fakeTransport{errs: []error{&HTTPStatusError{StatusCode: 503}}}
+
+	def := WebhookDefinition{
+		Name:    "fake",
+		Type:    WebhookTypeAll,
+		Active:  true,
+		URL:     "https://example.com/{{.JobName}}",
+		Method:  "PUT",
+		Headers: map[string]string{"X-Job": "{{.JobName}}"},
+		Body:    "{{.JobName}} failed={{.Failed}}",
+		Timeout: 5,
+		Retry:   &RetryConfig{Count: 1},
+	}
+
+	var results []SendResult
+	OnSendResult = func(r SendResult) { results = append(results, r) }
+	defer func() { OnSendResult = nil }()
+
+	webhook, err := NewWebhookFromDefinition(def, &TestLogger{}, transport)
+	c.Assert(err, IsNil)
+	wh := webhook.(*Webhook)
+	wh.sleep = func(time.Duration) {}
+
+	data := &WebhookTemplateData{JobName: "backup"}
+	wh.send(&TestLogger{}, data)
+
+	// The first attempt fails and is retried through the same transport
+	c.Assert(transport.requests, HasLen, 2)
+	c.Assert(transport.requests[1], DeepEquals, WebhookRequest{
+		Webhook: "fake",
+		Method:  "PUT",
+		URL:     "https://example.com/backup",
+		Headers: map[string]string{"X-Job": "backup"},
+		Body:    []byte("backup failed=false"),
+	})
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Success, Equals, true)
+	c.Assert(results[0].Attempts, Equals, 2)
+}
@@ -27,6 +27,7 @@ func main() {
 	logger := buildLogger()
 	parser := flags.NewNamedParser("ofelia", flags.Default)
 	parser.AddCommand("daemon", "daemon process", "", &cli.DaemonCommand{Logger: logger})
+	parser.AddCommand("run", "runs a job once, right away", "", &cli.RunCommand{Logger: logger})
 	parser.AddCommand("validate", "validates the config file", "", &cli.ValidateCommand{Logger: logger})
 
 	if _, err := parser.Parse(); err != nil {